@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+
+	"gomini/internal/image"
+)
+
+// bundleCommand dispatches the subcommands that build bundles from images
+func bundleCommand(args []string) {
+	if len(args) < 1 {
+		fatalf("Usage: gomini bundle from-image|import [options] <source> <bundle-dir>\n")
+	}
+
+	switch args[0] {
+	case "from-image":
+		fromImageCommand(args[1:])
+	case "import":
+		importCommand(args[1:])
+	default:
+		fatalf("Unknown bundle command: %s\n", args[0])
+	}
+}
+
+// fromImageCommand unpacks an image of a local OCI image layout into a bundle
+func fromImageCommand(args []string) {
+	fs := flag.NewFlagSet("bundle from-image", flag.ExitOnError)
+
+	ref := fs.String("ref", "", "Image to use when the layout holds several (org.opencontainers.image.ref.name)")
+	platformFlag := fs.String("platform", "linux/"+runtime.GOARCH, "Platform of the image as os/arch[/variant]")
+
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fatalf("Usage: gomini bundle from-image [options] <layout-dir> <bundle-dir>\n")
+	}
+	layoutDir, bundleDir := fs.Arg(0), fs.Arg(1)
+
+	platform, err := image.ParsePlatform(*platformFlag)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+
+	layout, err := image.OpenLayout(layoutDir)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+	config, layers, err := layout.Image(*ref, platform)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+
+	if err := image.CreateBundle(bundleDir, config, layers); err != nil {
+		fatalf("Error: %v\n", err)
+	}
+	fmt.Printf("Created bundle in %s\n", bundleDir)
+}
+
+// importCommand unpacks an image of a "docker save" archive into a bundle
+func importCommand(args []string) {
+	fs := flag.NewFlagSet("bundle import", flag.ExitOnError)
+
+	tag := fs.String("tag", "", "Image to use when the archive holds several, as repository:tag")
+	platformFlag := fs.String("platform", "linux/"+runtime.GOARCH, "Platform the image must be built for as os/arch[/variant]")
+
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fatalf("Usage: gomini bundle import [options] <archive> <bundle-dir>\n")
+	}
+	archivePath, bundleDir := fs.Arg(0), fs.Arg(1)
+
+	platform, err := image.ParsePlatform(*platformFlag)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+
+	archive, err := image.OpenArchive(archivePath)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+	config, layers, err := archive.Image(*tag, platform)
+	if err == nil {
+		err = image.CreateBundle(bundleDir, config, layers)
+	}
+	archive.Close()
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+	fmt.Printf("Created bundle in %s\n", bundleDir)
+}
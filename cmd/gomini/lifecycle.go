@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/cg"
+	"gomini/internal/ipam"
+	"gomini/internal/net"
+	"gomini/internal/nsenter"
+	"gomini/internal/proc"
+	"gomini/internal/spec"
+	"gomini/internal/state"
+)
+
+// createCommand sets up a container and parks its init process until "start"
+func createCommand(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+
+	root := rootFlag(fs)
+	bundle := fs.String("bundle", ".", "Bundle directory path")
+	pidFile := fs.String("pid-file", "", "File to write the container init PID to")
+	consoleSocket := fs.String("console-socket", "", "Unix socket to send the pty master to when process.terminal is set")
+	cpu := fs.Int64("cpu", 0, "CPU quota in microseconds per period")
+	cpuPeriod := fs.Int64("cpu-period", 0, "CPU period in microseconds (default: 100000)")
+	mem := fs.Int64("mem", 0, "Memory limit in bytes")
+	pids := fs.Int("pids", 0, "Maximum number of processes")
+	netMode := fs.String("net", net.ModeNone, "Network mode (none, host, bridge)")
+	bridge := fs.String("bridge", net.DefaultBridge, "Host bridge for --net bridge")
+	subnet := fs.String("subnet", net.DefaultSubnet, "IPv4 subnet of the bridge for --net bridge")
+	seccompProfile := fs.String("seccomp", "", "Seccomp profile: default, unconfined (default: bundle's linux.seccomp)")
+	rootless := fs.Bool("rootless", os.Geteuid() != 0, "Run in a user namespace without root privileges (default: true unless run as root)")
+	initProcess := fs.Bool("init", false, "Run a minimal init as PID 1 that forwards signals and reaps zombies")
+	overlay := fs.Bool("overlay", false, "Run on a writable overlay over the bundle rootfs, discarded on delete")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	// Only accepted to explain why they are refused, see below
+	var publish publishFlag
+	fs.Var(&publish, "publish", "Not supported, ports can only be published with run")
+	fs.Var(&publish, "p", "Not supported, ports can only be published with run")
+
+	fs.Parse(args)
+	id := requireID(fs, "create")
+
+	// Published ports are forwarded by a proxy in the gomini process, and
+	// create exits once the container is set up
+	if len(publish) > 0 {
+		fatalf("Error: --publish is only supported by run, create does not stay around to forward the ports\n")
+	}
+
+	bundleDir, err := filepath.Abs(*bundle)
+	if err != nil {
+		fatalf("Error resolving bundle path: %v\n", err)
+	}
+
+	config, err := spec.LoadConfig(bundleDir)
+	if err != nil {
+		fatalf("Error loading config: %v\n", err)
+	}
+
+	netConfig, err := net.NewConfig(*netMode, *bridge, *subnet)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+
+	store := state.NewStore(*root)
+	if err := store.Create(id); err != nil {
+		fatalf("Error creating container: %v\n", err)
+	}
+	unlock, err := store.Lock(id)
+	if err != nil {
+		store.Remove(id)
+		fatalf("Error locking container state: %v\n", err)
+	}
+	defer unlock()
+
+	st := &state.State{
+		OCIVersion:  config.OCIVersion,
+		ID:          id,
+		Status:      state.StatusCreating,
+		Bundle:      bundleDir,
+		Annotations: config.Annotations,
+		Created:     time.Now().UTC(),
+	}
+	if err := store.Save(st); err != nil {
+		store.Remove(id)
+		fatalf("Error saving state: %v\n", err)
+	}
+
+	containerProc := proc.NewContainerProcess(config, bundleDir)
+	containerProc.ID = id
+	if err := containerProc.OverrideSeccomp(*seccompProfile); err != nil {
+		store.Remove(id)
+		fatalf("Error: %v\n", err)
+	}
+	if *rootless {
+		containerProc.EnableRootless()
+	}
+	containerProc.Init = *initProcess
+	containerProc.ConsoleSocket = *consoleSocket
+	containerProc.SetNetwork(netConfig)
+	containerProc.NetworkFilesDir = store.NetworkDir(id)
+	if overlayEnabled(*overlay, config) {
+		if err := containerProc.EnableOverlay(store.OverlayDir(id)); err != nil {
+			store.Remove(id)
+			fatalf("Error: %v\n", err)
+		}
+	}
+	if err := leaseAddress(store, id, netConfig); err != nil {
+		store.Remove(id)
+		fatalf("Error: %v\n", err)
+	}
+
+	// Bundle resources apply by default, CLI flags override them
+	limits := proc.ResourceLimitsFromSpec(config.Linux.Resources)
+	if err := applyResourceOverrides(limits, *cpu, *cpuPeriod, *mem, *pids); err != nil {
+		releaseAddress(store, id)
+		store.Remove(id)
+		fatalf("Error: %v\n", err)
+	}
+
+	if err := containerProc.SetupCgroups(id, limits); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to setup cgroups: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Continuing without resource limits...\n")
+	} else {
+		st.CgroupPath = containerProc.CgroupManager.CgroupPath
+		if err := store.Save(st); err != nil {
+			containerProc.CgroupManager.Cleanup()
+			releaseAddress(store, id)
+			store.Remove(id)
+			fatalf("Error saving state: %v\n", err)
+		}
+	}
+
+	pid, err := containerProc.Create(store.ExecFifoPath(id))
+	if err != nil {
+		if containerProc.CgroupManager != nil {
+			containerProc.CgroupManager.Cleanup()
+		}
+		releaseAddress(store, id)
+		store.Remove(id)
+		fatalf("Error creating container: %v\n", err)
+	}
+
+	st.SetPid(pid)
+	st.Status = state.StatusCreated
+	if err := store.Save(st); err != nil {
+		fatalf("Error saving state: %v\n", err)
+	}
+
+	if *pidFile != "" {
+		if err := os.WriteFile(*pidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			fatalf("Error writing pid file: %v\n", err)
+		}
+	}
+
+	if *verbose {
+		fmt.Printf("Container %s created with init PID %d\n", id, pid)
+	}
+}
+
+// startCommand releases a created container's init process
+func startCommand(args []string) {
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	root := rootFlag(fs)
+	fs.Parse(args)
+	id := requireID(fs, "start")
+
+	store := state.NewStore(*root)
+	unlock := lockState(store, id)
+	defer unlock()
+	st := loadState(store, id)
+
+	if st.Status != state.StatusCreated {
+		fatalf("Error starting container: container %s is %s, not %s\n", id, st.Status, state.StatusCreated)
+	}
+
+	if err := proc.Start(store.ExecFifoPath(id), st.Pid); err != nil {
+		fatalf("Error starting container: %v\n", err)
+	}
+
+	st.Status = state.StatusRunning
+	if err := store.Save(st); err != nil {
+		fatalf("Error saving state: %v\n", err)
+	}
+}
+
+// execCommand runs an additional process inside a running container
+func execCommand(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	root := rootFlag(fs)
+	cwd := fs.String("cwd", "", "Working directory inside the container (default: bundle's process.cwd)")
+	tty := fs.Bool("tty", false, "Allocate a pseudo-terminal for the process")
+	fs.BoolVar(tty, "t", false, "Shorthand for --tty")
+	fs.Parse(args)
+	id := requireID(fs, "exec")
+
+	command := fs.Args()[1:]
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		fatalf("Usage: gomini exec [options] <container-id> -- <command> [args...]\n")
+	}
+	if !nsenter.Supported {
+		fatalf("Error: gomini was built without cgo, which exec needs to join namespaces\n")
+	}
+
+	// The lock keeps the container from being deleted while it is checked,
+	// the process then joins its namespaces through the PID checked here
+	store := state.NewStore(*root)
+	unlock := lockState(store, id)
+	st := loadState(store, id)
+	unlock()
+	if st.Status != state.StatusRunning {
+		fatalf("Error: container %s is not running\n", id)
+	}
+
+	config, err := spec.LoadConfig(st.Bundle)
+	if err != nil {
+		fatalf("Error loading config: %v\n", err)
+	}
+	// Only the process gets a terminal, not what the bundle asks for
+	config.Process.Terminal = *tty
+
+	containerProc := proc.NewContainerProcess(config, st.Bundle)
+	containerProc.ID = id
+	containerProc.OverrideArgs(command)
+	if *cwd != "" {
+		containerProc.WorkingDir = *cwd
+	}
+	if st.CgroupPath != "" {
+		containerProc.CgroupManager = &cg.CgroupManager{CgroupPath: st.CgroupPath}
+	}
+
+	err = containerProc.Exec(st.Pid)
+
+	var exitErr *proc.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.Code)
+	}
+	if err != nil {
+		fatalf("Error executing in container %s: %v\n", id, err)
+	}
+}
+
+// killCommand sends a signal to the container init process
+func killCommand(args []string) {
+	fs := flag.NewFlagSet("kill", flag.ExitOnError)
+	root := rootFlag(fs)
+	fs.Parse(args)
+	id := requireID(fs, "kill")
+
+	sig := unix.SIGTERM
+	if fs.NArg() > 1 {
+		parsed, err := parseSignal(fs.Arg(1))
+		if err != nil {
+			fatalf("Error: %v\n", err)
+		}
+		sig = parsed
+	}
+
+	store := state.NewStore(*root)
+	unlock := lockState(store, id)
+	defer unlock()
+	st := loadState(store, id)
+
+	if st.Status != state.StatusCreated && st.Status != state.StatusRunning {
+		fatalf("Error: container %s is not running\n", id)
+	}
+
+	if err := unix.Kill(st.Pid, sig); err != nil {
+		fatalf("Error sending %s to container %s: %v\n", unix.SignalName(sig), id, err)
+	}
+}
+
+// deleteCommand removes a stopped container and its resources
+func deleteCommand(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	root := rootFlag(fs)
+	force := fs.Bool("force", false, "Kill the container if it is still running")
+	keep := fs.Bool("keep", false, "Keep the overlay changes instead of discarding them")
+	fs.Parse(args)
+	id := requireID(fs, "delete")
+
+	store := state.NewStore(*root)
+	unlock := lockState(store, id)
+	defer unlock()
+	st := loadState(store, id)
+
+	switch st.Status {
+	case state.StatusRunning:
+		if !*force {
+			fatalf("Error: container %s is running, stop it first or use --force\n", id)
+		}
+		fallthrough
+	case state.StatusCreated:
+		// A created container is still parked on the exec fifo and can go
+		if err := killAndWait(st.Pid); err != nil {
+			fatalf("Error killing container %s: %v\n", id, err)
+		}
+	}
+
+	if *keep {
+		if err := keepOverlay(store, id); err != nil {
+			fatalf("Error: %v\n", err)
+		}
+	}
+
+	if st.CgroupPath != "" {
+		cgroupMgr := &cg.CgroupManager{CgroupPath: st.CgroupPath}
+		if err := cgroupMgr.Cleanup(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to cleanup cgroup: %v\n", err)
+		}
+	}
+
+	releaseAddress(store, id)
+
+	if err := store.Remove(id); err != nil {
+		fatalf("Error deleting container: %v\n", err)
+	}
+}
+
+// stateCommand prints the OCI state of a container as JSON
+func stateCommand(args []string) {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	root := rootFlag(fs)
+	fs.Parse(args)
+	id := requireID(fs, "state")
+
+	store := state.NewStore(*root)
+	st := loadState(store, id)
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		fatalf("Error encoding state: %v\n", err)
+	}
+	fmt.Println(string(data))
+}
+
+// listCommand prints a table of all known containers
+func listCommand(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	root := rootFlag(fs)
+	quiet := fs.Bool("q", false, "Only print container IDs")
+	fs.Parse(args)
+
+	store := state.NewStore(*root)
+	states, err := store.List()
+	if err != nil {
+		fatalf("Error listing containers: %v\n", err)
+	}
+
+	if *quiet {
+		for _, st := range states {
+			fmt.Println(st.ID)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPID\tSTATUS\tBUNDLE\tCREATED")
+	for _, st := range states {
+		st.RefreshStatus()
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", st.ID, st.Pid, st.Status, st.Bundle, st.Created.Local().Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+// lockState takes the state lock of a container or exits
+func lockState(store *state.Store, id string) func() {
+	unlock, err := store.Lock(id)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+	return unlock
+}
+
+// loadState loads a container's state and refreshes its status. Nothing is
+// written back, commands that change the state save it under lockState.
+func loadState(store *state.Store, id string) *state.State {
+	st, err := store.Load(id)
+	if err != nil {
+		fatalf("Error: %v\n", err)
+	}
+
+	st.RefreshStatus()
+	return st
+}
+
+// killAndWait sends SIGKILL to a process and waits for it to disappear
+func killAndWait(pid int) error {
+	if err := unix.Kill(pid, unix.SIGKILL); err != nil && err != unix.ESRCH {
+		return err
+	}
+
+	for i := 0; i < 100; i++ {
+		if !state.ProcessAlive(pid) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return fmt.Errorf("process %d did not exit", pid)
+}
+
+// maxSignal is the highest signal number, SIGRTMAX on Linux
+const maxSignal = 64
+
+// parseSignal accepts a signal number or name with or without the SIG prefix
+func parseSignal(value string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 1 || n > maxSignal {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.ToUpper(value)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("unknown signal %q", value)
+	}
+
+	return sig, nil
+}
+
+// leaseAddress assigns the container a bridge address from the leases kept
+// under the state root. Leases of containers that no longer exist are dropped
+// first, so a killed gomini process does not leak its address.
+func leaseAddress(store *state.Store, id string, netConfig *net.Config) error {
+	if !netConfig.NeedsSetup() {
+		return nil
+	}
+
+	allocator := ipam.NewAllocator(store.Root)
+	if err := allocator.Prune(store.Exists); err != nil {
+		return err
+	}
+
+	address, err := allocator.Allocate(netConfig.Subnet, id)
+	if err != nil {
+		return err
+	}
+
+	netConfig.Address = address
+	return nil
+}
+
+// releaseAddress drops the container's address lease, if any
+func releaseAddress(store *state.Store, id string) {
+	if err := ipam.NewAllocator(store.Root).Release(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to release address: %v\n", err)
+	}
+}
+
+// overlayEnabled reports whether a container gets an overlay rootfs, asked
+// for on the command line or by the bundle's annotation, or needed to
+// combine the layers of its rootfs
+func overlayEnabled(flag bool, config *spec.Config) bool {
+	return flag || config.Annotations[proc.OverlayAnnotation] == "true" || len(config.Root.Layers) > 0
+}
+
+// keepOverlay moves a container's overlay changes out of its state directory
+// so that they survive its removal
+func keepOverlay(store *state.Store, id string) error {
+	kept, err := store.KeepOverlay(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Kept overlay changes in %s\n", kept)
+	return nil
+}
+
+// rootFlag registers the --root option shared by all container commands
+func rootFlag(fs *flag.FlagSet) *string {
+	return fs.String("root", state.DefaultRootDir(), "Directory for container state")
+}
+
+// requireID returns the container ID positional argument or exits
+func requireID(fs *flag.FlagSet, command string) string {
+	if fs.NArg() < 1 {
+		fatalf("Usage: gomini %s [options] <container-id>\n", command)
+	}
+	return fs.Arg(0)
+}
+
+// fatalf prints an error message and exits
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(1)
+}
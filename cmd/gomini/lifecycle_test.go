@@ -0,0 +1,38 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected syscall.Signal
+		wantErr  bool
+	}{
+		{value: "9", expected: syscall.SIGKILL},
+		{value: "64", expected: syscall.Signal(64)},
+		{value: "SIGTERM", expected: syscall.SIGTERM},
+		{value: "TERM", expected: syscall.SIGTERM},
+		{value: "hup", expected: syscall.SIGHUP},
+		{value: "sigusr1", expected: syscall.SIGUSR1},
+		{value: "0", wantErr: true},
+		{value: "-9", wantErr: true},
+		{value: "65", wantErr: true},
+		{value: "SIGBOGUS", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSignal(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSignal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("parseSignal() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
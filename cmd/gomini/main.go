@@ -1,17 +1,33 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"gomini/internal/cg"
+	"gomini/internal/net"
+	"gomini/internal/portmap"
 	"gomini/internal/proc"
 	"gomini/internal/spec"
+	"gomini/internal/state"
 )
 
 const version = "0.1.0"
 
+func init() {
+	// The container init changes namespaces the kernel keeps per process,
+	// which only works from the main thread, so pin it there from the start
+	if len(os.Args) > 1 && os.Args[1] == "container-init" {
+		runtime.LockOSThread()
+	}
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		printUsage()
@@ -21,12 +37,34 @@ func main() {
 	switch os.Args[1] {
 	case "run":
 		runCommand(os.Args[2:])
+	case "create":
+		createCommand(os.Args[2:])
+	case "start":
+		startCommand(os.Args[2:])
+	case "exec":
+		execCommand(os.Args[2:])
+	case "kill":
+		killCommand(os.Args[2:])
+	case "delete":
+		deleteCommand(os.Args[2:])
+	case "state":
+		stateCommand(os.Args[2:])
+	case "list", "ps":
+		listCommand(os.Args[2:])
+	case "bundle":
+		bundleCommand(os.Args[2:])
 	case "container-init":
 		// Special case: handle container initialization
 		if err := proc.HandleContainerInit(); err != nil {
 			fmt.Fprintf(os.Stderr, "Container init failed: %v\n", err)
 			os.Exit(1)
 		}
+	case "container-exec":
+		// Started by "exec" inside a running container, see proc.Exec
+		if err := proc.HandleContainerExec(); err != nil {
+			fmt.Fprintf(os.Stderr, "Container exec failed: %v\n", err)
+			os.Exit(1)
+		}
 	case "version", "--version", "-v":
 		fmt.Printf("gomini version %s\n", version)
 	case "help", "--help", "-h":
@@ -43,40 +81,145 @@ func printUsage() {
 
 Usage:
   gomini run [options] -- [command]
+  gomini create [options] <container-id>
+  gomini start <container-id>
+  gomini exec [options] <container-id> -- <command> [args...]
+  gomini kill <container-id> [signal]
+  gomini delete [--force] [--keep] <container-id>
+  gomini state <container-id>
+  gomini list [-q]
+  gomini bundle from-image [options] <layout-dir> <bundle-dir>
+  gomini bundle import [options] <archive> <bundle-dir>
   gomini version
   gomini help
 
 Commands:
   run     Run a container from a bundle
+  create  Create a container and wait for start
+  start   Start a created container
+  exec    Run an additional process in a running container
+  kill    Send a signal to a container (default: SIGTERM)
+  delete  Delete a stopped container
+  state   Print the OCI state of a container
+  list    List containers (alias: ps)
+  bundle  Create a bundle from an image ("from-image": OCI image layout,
+          "import": "docker save" archive)
   version Show version information
   help    Show this help message
 
+Global options (all container commands):
+  --root DIR       Directory for container state (default: /run/gomini,
+                   or $XDG_RUNTIME_DIR/gomini when not run as root)
+
 Options for 'run':
+  --id ID          Container ID (default: container-<pid>)
   --bundle DIR     Bundle directory path (default: current directory)
   --hostname NAME  Set container hostname
-  --cpu QUOTA      CPU quota in microseconds per 100ms period
+  --cpu QUOTA      CPU quota in microseconds per period
+  --cpu-period US  CPU period in microseconds (default: 100000)
   --mem BYTES      Memory limit in bytes
   --pids COUNT     Maximum number of processes
-  --net MODE       Network mode (none, host) [default: none]
+  --net MODE       Network mode (none, host, bridge) [default: none]
+  --bridge NAME    Host bridge for bridge mode [default: gomini0]
+  --subnet CIDR    IPv4 subnet of the bridge [default: 10.88.0.0/16]
+  -p, --publish [IP:]HOST:CONTAINER[/PROTO]
+                   Forward a host TCP or UDP port to the container
+                   (bridge mode only, repeatable)
   --cmd COMMAND    Override command to run
+  --seccomp NAME   Use the built-in "default" profile or "unconfined"
+                   instead of the bundle's linux.seccomp
+  --rootless       Map root in the container to the calling user
+                   (default: on unless run as root)
+  --init           Run a minimal init as PID 1 that forwards signals to
+                   the command and reaps zombies
+  --overlay        Run on a writable overlay over the bundle's rootfs
+                   (also enabled by the annotation gomini.overlay=true
+                   and for a rootfs with root.layers)
+  --keep           Keep the overlay changes in <root>/<id>.upper when the
+                   container exits instead of discarding them
+  -t, --tty        Allocate a pseudo-terminal (default: process.terminal)
+  --console-socket PATH
+                   Send the pty master to the unix socket at PATH instead
+                   of attaching it to gomini's stdio
   --verbose        Enable verbose output
 
+Options for 'create':
+  --bundle DIR     Bundle directory path (default: current directory)
+  --pid-file FILE  Write the container init PID to FILE
+  --console-socket PATH
+                   Receive the pty master of a container with
+                   process.terminal set (required for such containers)
+  --cpu, --cpu-period, --mem, --pids, --net, --bridge, --subnet,
+  --seccomp, --rootless, --init, --overlay, --verbose as for 'run'
+                   (--publish is refused, ports can only be published
+                   with 'run')
+
+Options for 'delete':
+  --force          Kill the container if it is still running
+  --keep           Keep the overlay changes in <root>/<id>.upper
+
+Options for 'exec':
+  --cwd DIR        Working directory inside the container
+                   (default: the bundle's process.cwd)
+  -t, --tty        Allocate a pseudo-terminal for the process
+
+The process runs with the user, capabilities, environment and seccomp
+filter of the bundle's process, in the namespaces, root and cgroup of the
+container.
+
+Options for 'bundle from-image':
+  --ref NAME       Image to unpack when the layout holds several, by its
+                   org.opencontainers.image.ref.name annotation
+  --platform OS/ARCH[/VARIANT]
+                   Platform to pick from a multi-platform image
+                   (default: linux/<architecture of gomini>)
+
+Options for 'bundle import':
+  --tag NAME       Image to unpack when the archive holds several, as
+                   repository[:tag]
+  --platform OS/ARCH[/VARIANT]
+                   Platform the image must be built for
+                   (default: linux/<architecture of gomini>)
+
+Resource limits from the bundle's linux.resources apply by default;
+--cpu, --cpu-period, --mem and --pids override individual values.
+
 Examples:
   gomini run --bundle ./examples/alpine-bundle --hostname mini1 --cpu 10000 --mem 134217728 --pids 64 --cmd /bin/sh
   gomini run --bundle ./examples/alpine-bundle --verbose -- /bin/sh -c 'echo hello'
+  gomini run --bundle ./examples/alpine-bundle --net bridge -p 8080:80 -- httpd -f
+  gomini exec -t mycontainer -- /bin/sh
+  gomini bundle from-image ./alpine-oci ./alpine-bundle
+  gomini bundle import alpine.tar ./alpine-bundle
 `)
 }
 
 func runCommand(args []string) {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
 
+	root := rootFlag(fs)
+	id := fs.String("id", "", "Container ID (default: container-<pid>)")
 	bundle := fs.String("bundle", ".", "Bundle directory path")
 	hostname := fs.String("hostname", "", "Set container hostname")
-	cpu := fs.Int64("cpu", 0, "CPU quota in microseconds per 100ms period")
+	cpu := fs.Int64("cpu", 0, "CPU quota in microseconds per period")
+	cpuPeriod := fs.Int64("cpu-period", 0, "CPU period in microseconds (default: 100000)")
 	mem := fs.Int64("mem", 0, "Memory limit in bytes")
 	pids := fs.Int("pids", 0, "Maximum number of processes")
-	net := fs.String("net", "none", "Network mode (none, host)")
+	netMode := fs.String("net", net.ModeNone, "Network mode (none, host, bridge)")
+	bridge := fs.String("bridge", net.DefaultBridge, "Host bridge for --net bridge")
+	subnet := fs.String("subnet", net.DefaultSubnet, "IPv4 subnet of the bridge for --net bridge")
+	var publish publishFlag
+	fs.Var(&publish, "publish", "Forward a host port to the container: [ip:]host:container[/tcp|udp] (repeatable)")
+	fs.Var(&publish, "p", "Shorthand for --publish")
 	cmd := fs.String("cmd", "", "Override command to run")
+	seccompProfile := fs.String("seccomp", "", "Seccomp profile: default, unconfined (default: bundle's linux.seccomp)")
+	rootless := fs.Bool("rootless", os.Geteuid() != 0, "Run in a user namespace without root privileges (default: true unless run as root)")
+	initProcess := fs.Bool("init", false, "Run a minimal init as PID 1 that forwards signals and reaps zombies")
+	overlay := fs.Bool("overlay", false, "Run on a writable overlay over the bundle rootfs, discarded on exit")
+	keep := fs.Bool("keep", false, "Keep the overlay changes when the container exits")
+	tty := fs.Bool("tty", false, "Allocate a pseudo-terminal for the container (default: bundle's process.terminal)")
+	fs.BoolVar(tty, "t", false, "Shorthand for --tty")
+	consoleSocket := fs.String("console-socket", "", "Unix socket to send the pty master to instead of attaching it")
 	verbose := fs.Bool("verbose", false, "Enable verbose output")
 
 	fs.Parse(args)
@@ -89,9 +232,10 @@ func runCommand(args []string) {
 		fmt.Printf("  Bundle: %s\n", *bundle)
 		fmt.Printf("  Hostname: %s\n", *hostname)
 		fmt.Printf("  CPU: %d\n", *cpu)
+		fmt.Printf("  CPU period: %d\n", *cpuPeriod)
 		fmt.Printf("  Memory: %d\n", *mem)
 		fmt.Printf("  PIDs: %d\n", *pids)
-		fmt.Printf("  Network: %s\n", *net)
+		fmt.Printf("  Network: %s\n", *netMode)
 		fmt.Printf("  Command override: %s\n", *cmd)
 		fmt.Printf("  Positional args: %v\n", positionalArgs)
 	}
@@ -127,39 +271,203 @@ func runCommand(args []string) {
 
 	fmt.Printf("Final command to execute: %v\n", finalArgs)
 
+	useOverlay := overlayEnabled(*overlay, config)
+	if *keep && !useOverlay {
+		fmt.Fprintf(os.Stderr, "Error: --keep requires --overlay\n")
+		os.Exit(1)
+	}
+
+	netConfig, err := net.NewConfig(*netMode, *bridge, *subnet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Register the container so other gomini invocations can find it
+	containerID := *id
+	if containerID == "" {
+		containerID = fmt.Sprintf("container-%d", os.Getpid())
+	}
+
+	bundleDir, err := filepath.Abs(*bundle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving bundle path: %v\n", err)
+		os.Exit(1)
+	}
+
+	store := state.NewStore(*root)
+	if err := store.Create(containerID); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating container: %v\n", err)
+		os.Exit(1)
+	}
+
+	st := &state.State{
+		OCIVersion:  config.OCIVersion,
+		ID:          containerID,
+		Status:      state.StatusCreating,
+		Bundle:      bundleDir,
+		Annotations: config.Annotations,
+		Created:     time.Now().UTC(),
+	}
+	if err := saveLocked(store, st); err != nil {
+		store.Remove(containerID)
+		fmt.Fprintf(os.Stderr, "Error saving state: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Create container process
 	containerProc := proc.NewContainerProcess(config, *bundle)
+	containerProc.ID = containerID
+	containerProc.OnStart = func(pid int) {
+		st.SetPid(pid)
+		st.Status = state.StatusRunning
+		if err := saveLocked(store, st); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to save state: %v\n", err)
+		}
+	}
 
 	// Apply overrides
 	containerProc.OverrideArgs(finalArgs)
 	if *hostname != "" {
 		containerProc.OverrideHostname(*hostname)
 	}
-
-	// Setup cgroups if resource limits are specified
-	if *cpu > 0 || *mem > 0 || *pids > 0 {
-		limits := &cg.ResourceLimits{
-			CPUQuota:  *cpu,
-			CPUPeriod: 0, // Use default period
-			Memory:    *mem,
-			Pids:      *pids,
+	if err := containerProc.OverrideSeccomp(*seccompProfile); err != nil {
+		store.Remove(containerID)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *rootless {
+		containerProc.EnableRootless()
+	}
+	containerProc.Init = *initProcess
+	if *tty {
+		config.Process.Terminal = true
+	}
+	containerProc.ConsoleSocket = *consoleSocket
+	containerProc.SetNetwork(netConfig)
+	containerProc.NetworkFilesDir = store.NetworkDir(containerID)
+	if err := containerProc.PublishPorts(publish); err != nil {
+		store.Remove(containerID)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if useOverlay {
+		if err := containerProc.EnableOverlay(store.OverlayDir(containerID)); err != nil {
+			store.Remove(containerID)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+	}
+	if err := leaseAddress(store, containerID, netConfig); err != nil {
+		store.Remove(containerID)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-		// Generate container ID (simple timestamp-based ID for now)
-		containerID := fmt.Sprintf("container-%d", os.Getpid())
+	// Bundle resources apply by default, CLI flags override them
+	limits := proc.ResourceLimitsFromSpec(config.Linux.Resources)
+	if err := applyResourceOverrides(limits, *cpu, *cpuPeriod, *mem, *pids); err != nil {
+		releaseAddress(store, containerID)
+		store.Remove(containerID)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
+	// Setup cgroups if resource limits are specified
+	if !limits.IsEmpty() {
 		if err := containerProc.SetupCgroups(containerID, limits); err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: failed to setup cgroups: %v\n", err)
 			fmt.Fprintf(os.Stderr, "Continuing without resource limits...\n")
 		} else {
-			fmt.Printf("Resource limits applied: CPU=%d, Memory=%d, PIDs=%d\n", *cpu, *mem, *pids)
+			// Recorded right away, so the cgroup can be found for cleanup
+			// however the run ends
+			st.CgroupPath = containerProc.CgroupManager.CgroupPath
+			if err := saveLocked(store, st); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to save state: %v\n", err)
+			}
+			fmt.Printf("Resource limits applied: CPU=%d/%d, Memory=%d, PIDs=%d\n", limits.CPUQuota, limits.CPUPeriod, limits.Memory, limits.Pids)
 		}
 	}
 
 	// Run the container
 	fmt.Println("Starting container...")
-	if err := containerProc.Run(); err != nil {
+	err = containerProc.Run()
+
+	// The record is gone once the container exits unless the overlay
+	// changes cannot be kept as asked
+	releaseAddress(store, containerID)
+	removeState := true
+	if *keep {
+		if err := keepOverlay(store, containerID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to keep overlay, leaving %s in place: %v\n", store.Dir(containerID), err)
+			removeState = false
+		}
+	}
+	if removeState {
+		if err := store.Remove(containerID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to remove container state: %v\n", err)
+		}
+	}
+
+	// A container that ran but failed passes its status on to our caller
+	var exitErr *proc.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.Code)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Container execution failed: %v\n", err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
+
+// saveLocked saves the container state under its lock
+func saveLocked(store *state.Store, st *state.State) error {
+	unlock, err := store.Lock(st.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return store.Save(st)
+}
+
+// applyResourceOverrides replaces bundle resource limits with non-zero CLI values.
+// A period without a quota is refused, as it is in the bundle.
+func applyResourceOverrides(limits *cg.ResourceLimits, cpu, cpuPeriod, mem int64, pids int) error {
+	if cpu > 0 {
+		limits.CPUQuota = cpu
+	}
+	if cpuPeriod > 0 {
+		limits.CPUPeriod = cpuPeriod
+	}
+	if mem > 0 {
+		limits.Memory = mem
+	}
+	if pids > 0 {
+		limits.Pids = pids
+	}
+	if limits.CPUPeriod > 0 && limits.CPUQuota <= 0 {
+		return fmt.Errorf("--cpu-period requires a cpu quota, set --cpu or linux.resources.cpu.quota")
+	}
+	return nil
+}
+
+// publishFlag collects repeated --publish options
+type publishFlag []portmap.Mapping
+
+func (p *publishFlag) String() string {
+	var values []string
+	for _, m := range *p {
+		values = append(values, m.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (p *publishFlag) Set(value string) error {
+	m, err := portmap.ParseMapping(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, m)
+	return nil
+}
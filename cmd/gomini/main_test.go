@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gomini/internal/cg"
+)
+
+func TestApplyResourceOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    cg.ResourceLimits
+		cpu       int64
+		cpuPeriod int64
+		mem       int64
+		pids      int
+		expected  cg.ResourceLimits
+		wantErr   bool
+	}{
+		{
+			name:     "bundle limits kept",
+			limits:   cg.ResourceLimits{CPUQuota: 50000, CPUPeriod: 100000, Memory: 64 << 20, Pids: 10},
+			expected: cg.ResourceLimits{CPUQuota: 50000, CPUPeriod: 100000, Memory: 64 << 20, Pids: 10},
+		},
+		{
+			name:      "flags override the bundle",
+			limits:    cg.ResourceLimits{CPUQuota: 50000, CPUPeriod: 100000, Memory: 64 << 20, Pids: 10},
+			cpu:       20000,
+			cpuPeriod: 50000,
+			mem:       32 << 20,
+			pids:      5,
+			expected:  cg.ResourceLimits{CPUQuota: 20000, CPUPeriod: 50000, Memory: 32 << 20, Pids: 5},
+		},
+		{
+			name:     "flags fill unset limits",
+			limits:   cg.ResourceLimits{Memory: 64 << 20, MemoryLow: 32 << 20},
+			cpu:      20000,
+			pids:     5,
+			expected: cg.ResourceLimits{CPUQuota: 20000, Memory: 64 << 20, MemoryLow: 32 << 20, Pids: 5},
+		},
+		{
+			name:      "period with a bundle quota",
+			limits:    cg.ResourceLimits{CPUQuota: 50000},
+			cpuPeriod: 200000,
+			expected:  cg.ResourceLimits{CPUQuota: 50000, CPUPeriod: 200000},
+		},
+		{
+			name:      "period without a quota",
+			cpuPeriod: 200000,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := tt.limits
+			err := applyResourceOverrides(&limits, tt.cpu, tt.cpuPeriod, tt.mem, tt.pids)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyResourceOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(limits, tt.expected) {
+				t.Errorf("applyResourceOverrides() = %+v, want %+v", limits, tt.expected)
+			}
+		})
+	}
+}
@@ -4,4 +4,7 @@ go 1.24.0
 
 toolchain go1.24.4
 
-require golang.org/x/sys v0.36.0
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.36.0
+)
@@ -0,0 +1,196 @@
+package caps
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// capabilityNames maps OCI capability names to capability numbers
+var capabilityNames = map[string]int{
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+}
+
+// Set is a bitmask of capabilities
+type Set uint64
+
+// Has reports whether the set contains the capability
+func (s Set) Has(capability int) bool {
+	return s&(1<<uint(capability)) != 0
+}
+
+// ParseNames converts a list of CAP_* names into a capability set
+func ParseNames(names []string) (Set, error) {
+	var set Set
+	for _, name := range names {
+		capability, ok := capabilityNames[strings.ToUpper(name)]
+		if !ok {
+			return 0, util.NewSimpleError("parse capabilities", fmt.Sprintf("unknown capability %q", name))
+		}
+		set |= 1 << uint(capability)
+	}
+	return set, nil
+}
+
+// Capabilities holds the capability sets of the container process
+type Capabilities struct {
+	Bounding    Set
+	Effective   Set
+	Inheritable Set
+	Permitted   Set
+	Ambient     Set
+}
+
+// New parses the named capability sets
+func New(bounding, effective, inheritable, permitted, ambient []string) (*Capabilities, error) {
+	c := &Capabilities{}
+	sets := []struct {
+		names []string
+		set   *Set
+	}{
+		{bounding, &c.Bounding},
+		{effective, &c.Effective},
+		{inheritable, &c.Inheritable},
+		{permitted, &c.Permitted},
+		{ambient, &c.Ambient},
+	}
+
+	for _, s := range sets {
+		set, err := ParseNames(s.names)
+		if err != nil {
+			return nil, err
+		}
+		*s.set = set
+	}
+
+	return c, nil
+}
+
+// DropBounding removes every capability outside the bounding set from the
+// calling thread. It needs CAP_SETPCAP, so it must run before switching user.
+func (c *Capabilities) DropBounding() error {
+	last := LastCap()
+	for capability := 0; capability <= last; capability++ {
+		if c.Bounding.Has(capability) {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil {
+			// Capabilities unknown to the running kernel cannot be dropped
+			if err == unix.EINVAL {
+				continue
+			}
+			return util.NewError(fmt.Sprintf("drop bounding capability %d", capability), err)
+		}
+	}
+	return nil
+}
+
+// Apply sets the effective, permitted, inheritable and ambient sets of the
+// calling thread
+func (c *Capabilities) Apply() error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for i := 0; i < 2; i++ {
+		shift := uint(32 * i)
+		data[i].Effective = uint32(c.Effective >> shift)
+		data[i].Permitted = uint32(c.Permitted >> shift)
+		data[i].Inheritable = uint32(c.Inheritable >> shift)
+	}
+
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return util.NewError("capset", err)
+	}
+
+	// Ambient capabilities must also be permitted and inheritable
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return util.NewError("clear ambient capabilities", err)
+	}
+	last := LastCap()
+	for capability := 0; capability <= last; capability++ {
+		if !c.Ambient.Has(capability) {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(capability), 0, 0); err != nil {
+			return util.NewError(fmt.Sprintf("raise ambient capability %d", capability), err)
+		}
+	}
+
+	return nil
+}
+
+// KeepCaps controls whether permitted capabilities survive a switch from
+// root to a non-root user
+func KeepCaps(keep bool) error {
+	var value uintptr
+	if keep {
+		value = 1
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, value, 0, 0, 0); err != nil {
+		return util.NewError("set keepcaps", err)
+	}
+	return nil
+}
+
+// SetNoNewPrivileges stops execve from granting privileges through setuid
+// binaries or file capabilities
+func SetNoNewPrivileges() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return util.NewError("set no_new_privs", err)
+	}
+	return nil
+}
+
+// LastCap returns the highest capability number supported by the kernel
+func LastCap() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err == nil {
+		if last, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			return last
+		}
+	}
+	return unix.CAP_LAST_CAP
+}
@@ -0,0 +1,56 @@
+package caps
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		names    []string
+		expected Set
+		wantErr  bool
+	}{
+		{"empty", nil, 0, false},
+		{"single", []string{"CAP_CHOWN"}, 1 << unix.CAP_CHOWN, false},
+		{"several", []string{"CAP_KILL", "CAP_NET_BIND_SERVICE"}, 1<<unix.CAP_KILL | 1<<unix.CAP_NET_BIND_SERVICE, false},
+		{"lowercase", []string{"cap_sys_admin"}, 1 << unix.CAP_SYS_ADMIN, false},
+		{"above 32", []string{"CAP_CHECKPOINT_RESTORE"}, 1 << unix.CAP_CHECKPOINT_RESTORE, false},
+		{"duplicate", []string{"CAP_KILL", "CAP_KILL"}, 1 << unix.CAP_KILL, false},
+		{"without prefix", []string{"KILL"}, 0, true},
+		{"unknown", []string{"CAP_CHOWN", "CAP_BOGUS"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNames(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseNames() = %#x, want %#x", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	c, err := New([]string{"CAP_KILL", "CAP_CHOWN"}, []string{"CAP_KILL"}, nil, []string{"CAP_KILL"}, []string{"CAP_KILL"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	kill := Set(1 << unix.CAP_KILL)
+	if c.Bounding != kill|1<<unix.CAP_CHOWN || c.Effective != kill || c.Inheritable != 0 || c.Permitted != kill || c.Ambient != kill {
+		t.Errorf("New() = %+v", c)
+	}
+	if !c.Bounding.Has(unix.CAP_CHOWN) || c.Effective.Has(unix.CAP_CHOWN) {
+		t.Errorf("Has() disagrees with the sets: %+v", c)
+	}
+
+	if _, err := New(nil, nil, []string{"CAP_BOGUS"}, nil, nil); err == nil {
+		t.Error("New() with an unknown capability succeeded, want an error")
+	}
+}
@@ -2,31 +2,101 @@ package cg
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"gomini/internal/util"
 )
 
 // CgroupManager manages cgroup v2 resources for a container
 type CgroupManager struct {
-	CgroupPath string
+	CgroupPath  string
+	MountPoint  string
 	Controllers []string
+
+	// DelegateRoot is the topmost cgroup controllers are enabled from when
+	// only a delegated subtree is writable (empty means the mount point)
+	DelegateRoot string
 }
 
 // ResourceLimits defines resource limits for the container
 type ResourceLimits struct {
-	CPUQuota  int64 // CPU quota in microseconds
-	CPUPeriod int64 // CPU period in microseconds
-	Memory    int64 // Memory limit in bytes
-	Pids      int   // Maximum number of processes
+	CPUQuota   int64  // CPU quota in microseconds
+	CPUPeriod  int64  // CPU period in microseconds
+	CPUWeight  uint64 // Relative CPU weight (1-10000)
+	CPUSetCPUs string // CPUs the container may run on, e.g. "0-3"
+	CPUSetMems string // Memory nodes the container may use
+	Memory     int64  // Memory limit in bytes
+	MemoryLow  int64  // Best-effort memory protection in bytes
+	MemorySwap *int64 // Swap limit in bytes, -1 for unlimited, nil to leave unset
+	Pids       int    // Maximum number of processes
+
+	IOWeight        uint16           // Default block IO weight (1-10000)
+	IOWeightDevices []IOWeightDevice // Per-device block IO weights
+	IOMaxDevices    []IOMaxDevice    // Per-device block IO throttles
+
+	HugetlbLimits map[string]uint64 // Hugetlb limit in bytes by page size, e.g. "2MB"
+	Unified       map[string]string // Raw cgroup file writes, applied last
+}
+
+// IOWeightDevice is an io.weight entry for a single block device
+type IOWeightDevice struct {
+	Major  int64
+	Minor  int64
+	Weight uint16
+}
+
+// IOMaxDevice is an io.max entry for a single block device; zero means no limit
+type IOMaxDevice struct {
+	Major     int64
+	Minor     int64
+	ReadBps   uint64
+	WriteBps  uint64
+	ReadIOPS  uint64
+	WriteIOPS uint64
+}
+
+// IsEmpty reports whether no limit is set
+func (l *ResourceLimits) IsEmpty() bool {
+	return l.CPUQuota <= 0 && l.CPUWeight == 0 && l.CPUSetCPUs == "" && l.CPUSetMems == "" &&
+		l.Memory <= 0 && l.MemoryLow <= 0 && l.MemorySwap == nil &&
+		l.Pids <= 0 && l.IOWeight == 0 && len(l.IOWeightDevices) == 0 && len(l.IOMaxDevices) == 0 &&
+		len(l.HugetlbLimits) == 0 && len(l.Unified) == 0
+}
+
+// ConvertCPUSharesToWeight maps cgroup v1 CPU shares (2-262144) onto the
+// cgroup v2 cpu.weight range (1-10000). Shares outside that range are
+// clamped to it like the kernel does, zero stays unset.
+func ConvertCPUSharesToWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	shares = min(max(shares, 2), 262144)
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// ConvertBlkioWeight maps a cgroup v1 blkio weight (10-1000) onto the
+// cgroup v2 io.weight range (1-10000)
+func ConvertBlkioWeight(weight uint16) uint16 {
+	if weight == 0 {
+		return 0
+	}
+	if weight < 10 {
+		weight = 10
+	}
+	return uint16(1 + (uint64(weight)-10)*9999/990)
 }
 
 const (
-	defaultCPUPeriod = 100000 // 100ms default period
+	defaultCPUPeriod  = 100000 // 100ms default period
+	cleanupRetries    = 50
+	cleanupRetryDelay = 10 * time.Millisecond
 )
 
 // DetectCgroupV2MountPoint finds the cgroup v2 mount point
@@ -93,10 +163,75 @@ func NewCgroupManager(containerID string) (*CgroupManager, error) {
 
 	return &CgroupManager{
 		CgroupPath:  cgroupPath,
+		MountPoint:  mountPoint,
 		Controllers: controllers,
 	}, nil
 }
 
+// NewRootlessCgroupManager creates a cgroup manager for an unprivileged user.
+// The container's cgroup is placed below the topmost ancestor of the current
+// cgroup that the user owns, such as the user@UID.service subtree systemd
+// delegates to every logged-in user.
+func NewRootlessCgroupManager(containerID string) (*CgroupManager, error) {
+	mountPoint, err := DetectCgroupV2MountPoint()
+	if err != nil {
+		return nil, util.WrapError("detect cgroup v2 mount point", err)
+	}
+
+	delegateRoot, err := findDelegatedCgroup(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	controllers, err := getAvailableControllers(delegateRoot)
+	if err != nil {
+		return nil, util.WrapError("get available controllers", err)
+	}
+
+	return &CgroupManager{
+		CgroupPath:   filepath.Join(delegateRoot, "gomini", containerID),
+		MountPoint:   mountPoint,
+		Controllers:  controllers,
+		DelegateRoot: delegateRoot,
+	}, nil
+}
+
+// findDelegatedCgroup walks up from the cgroup of the current process and
+// returns the topmost directory owned by the effective user
+func findDelegatedCgroup(mountPoint string) (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", util.NewPathError("read cgroup membership", "/proc/self/cgroup", err)
+	}
+
+	var current string
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			current = filepath.Join(mountPoint, path)
+			break
+		}
+	}
+	if current == "" {
+		return "", util.NewSimpleError("find delegated cgroup", "process is not in a cgroup v2 hierarchy")
+	}
+
+	euid := uint32(os.Geteuid())
+	var delegated string
+	for dir := current; dir != mountPoint && strings.HasPrefix(dir, mountPoint); dir = filepath.Dir(dir) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil || st.Uid != euid {
+			break
+		}
+		delegated = dir
+	}
+
+	if delegated == "" {
+		return "", util.NewSimpleError("find delegated cgroup", fmt.Sprintf("no cgroup above %s is delegated to uid %d", current, euid))
+	}
+
+	return delegated, nil
+}
+
 // getAvailableControllers reads available controllers from cgroup.controllers
 func getAvailableControllers(mountPoint string) ([]string, error) {
 	controllersPath := filepath.Join(mountPoint, "cgroup.controllers")
@@ -116,31 +251,67 @@ func (cm *CgroupManager) Setup() error {
 		return util.NewPathError("create cgroup directory", cm.CgroupPath, err)
 	}
 
-	// Enable required controllers in parent cgroup
-	parentPath := filepath.Dir(cm.CgroupPath)
-	subtreeControlPath := filepath.Join(parentPath, "cgroup.subtree_control")
-
-	// Try to enable cpu, memory, and pids controllers
-	requiredControllers := []string{"cpu", "memory", "pids"}
+	// Try to enable every controller the resource limits can use
+	requiredControllers := []string{"cpu", "cpuset", "memory", "pids", "io", "hugetlb"}
 	var enabledControllers []string
 
 	for _, controller := range requiredControllers {
 		if contains(cm.Controllers, controller) {
-			enabledControllers = append(enabledControllers, "+"+controller)
+			enabledControllers = append(enabledControllers, controller)
 		}
 	}
 
-	if len(enabledControllers) > 0 {
-		controlString := strings.Join(enabledControllers, " ")
-		if err := os.WriteFile(subtreeControlPath, []byte(controlString), 0644); err != nil {
+	// A controller reaches the container's cgroup only if every ancestor
+	// below the mount point delegates it, so enable it all the way down
+	for _, dir := range cm.ancestors() {
+		subtreeControlPath := filepath.Join(dir, "cgroup.subtree_control")
+
+		// Write controllers one at a time so one failure doesn't block the rest
+		var failed []string
+		for _, controller := range enabledControllers {
+			if err := os.WriteFile(subtreeControlPath, []byte("+"+controller), 0644); err != nil {
+				failed = append(failed, controller)
+			}
+		}
+
+		if len(failed) > 0 {
 			// Log warning but don't fail - might not have permission or already enabled
-			fmt.Fprintf(os.Stderr, "Warning: failed to enable controllers: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Warning: failed to enable controllers %v in %s\n", failed, dir)
 		}
 	}
 
 	return nil
 }
 
+// ancestors returns the cgroups from the mount point (or delegate root) down to the parent of
+// the container's cgroup
+func (cm *CgroupManager) ancestors() []string {
+	parentPath := filepath.Dir(cm.CgroupPath)
+	top := cm.MountPoint
+	if cm.DelegateRoot != "" {
+		top = cm.DelegateRoot
+	}
+	if top == "" {
+		return []string{parentPath}
+	}
+
+	rel, err := filepath.Rel(top, parentPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return []string{parentPath}
+	}
+
+	dirs := []string{top}
+	current := top
+	if rel != "." {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			current = filepath.Join(current, part)
+			dirs = append(dirs, current)
+		}
+	}
+
+	return dirs
+}
+
 // ApplyLimits applies resource limits to the cgroup
 func (cm *CgroupManager) ApplyLimits(limits *ResourceLimits) error {
 	if limits.CPUQuota > 0 {
@@ -149,21 +320,137 @@ func (cm *CgroupManager) ApplyLimits(limits *ResourceLimits) error {
 		}
 	}
 
+	if limits.CPUWeight > 0 {
+		if err := cm.writeFile("cpu.weight", strconv.FormatUint(limits.CPUWeight, 10)); err != nil {
+			return util.WrapError("set CPU weight", err)
+		}
+	}
+
+	if limits.CPUSetCPUs != "" {
+		if err := cm.writeFile("cpuset.cpus", limits.CPUSetCPUs); err != nil {
+			return util.WrapError("set cpuset CPUs", err)
+		}
+	}
+
+	if limits.CPUSetMems != "" {
+		if err := cm.writeFile("cpuset.mems", limits.CPUSetMems); err != nil {
+			return util.WrapError("set cpuset memory nodes", err)
+		}
+	}
+
 	if limits.Memory > 0 {
 		if err := cm.setMemoryLimit(limits.Memory); err != nil {
 			return util.WrapError("set memory limit", err)
 		}
 	}
 
+	if limits.MemoryLow > 0 {
+		if err := cm.writeFile("memory.low", strconv.FormatInt(limits.MemoryLow, 10)); err != nil {
+			return util.WrapError("set memory low", err)
+		}
+	}
+
+	if limits.MemorySwap != nil {
+		if err := cm.writeFile("memory.swap.max", formatMax(*limits.MemorySwap)); err != nil {
+			return util.WrapError("set swap limit", err)
+		}
+	}
+
 	if limits.Pids > 0 {
 		if err := cm.setPidsLimit(limits.Pids); err != nil {
 			return util.WrapError("set pids limit", err)
 		}
 	}
 
+	if err := cm.setIOLimits(limits); err != nil {
+		return util.WrapError("set IO limits", err)
+	}
+
+	for pageSize, limit := range limits.HugetlbLimits {
+		name := fmt.Sprintf("hugetlb.%s.max", pageSize)
+		if err := cm.writeFile(name, strconv.FormatUint(limit, 10)); err != nil {
+			return util.WrapError("set hugetlb limit", err)
+		}
+	}
+
+	for key, value := range limits.Unified {
+		if err := cm.setUnified(key, value); err != nil {
+			return util.WrapError("set unified resource", err)
+		}
+	}
+
+	return nil
+}
+
+// setIOLimits writes io.weight and io.max entries
+func (cm *CgroupManager) setIOLimits(limits *ResourceLimits) error {
+	if limits.IOWeight > 0 {
+		value := fmt.Sprintf("default %d", limits.IOWeight)
+		if err := cm.writeFile("io.weight", value); err != nil {
+			return err
+		}
+	}
+
+	// io.weight and io.max accept one device entry per write
+	for _, dev := range limits.IOWeightDevices {
+		value := fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, dev.Weight)
+		if err := cm.writeFile("io.weight", value); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range limits.IOMaxDevices {
+		value := fmt.Sprintf("%d:%d", dev.Major, dev.Minor)
+		if dev.ReadBps > 0 {
+			value += fmt.Sprintf(" rbps=%d", dev.ReadBps)
+		}
+		if dev.WriteBps > 0 {
+			value += fmt.Sprintf(" wbps=%d", dev.WriteBps)
+		}
+		if dev.ReadIOPS > 0 {
+			value += fmt.Sprintf(" riops=%d", dev.ReadIOPS)
+		}
+		if dev.WriteIOPS > 0 {
+			value += fmt.Sprintf(" wiops=%d", dev.WriteIOPS)
+		}
+		if err := cm.writeFile("io.max", value); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// setUnified writes a raw value to a cgroup interface file
+func (cm *CgroupManager) setUnified(key string, value string) error {
+	// Keys name files directly inside the container's cgroup
+	if key == "" || strings.ContainsRune(key, '/') || key == "." || key == ".." {
+		return util.NewSimpleError("set unified resource", fmt.Sprintf("invalid cgroup file name %q", key))
+	}
+	if strings.HasPrefix(key, "cgroup.") && key != "cgroup.freeze" && key != "cgroup.max.depth" && key != "cgroup.max.descendants" {
+		return util.NewSimpleError("set unified resource", fmt.Sprintf("cgroup core file %q cannot be set", key))
+	}
+
+	return cm.writeFile(key, value)
+}
+
+// writeFile writes a value to an interface file of the cgroup
+func (cm *CgroupManager) writeFile(name string, value string) error {
+	path := filepath.Join(cm.CgroupPath, name)
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return util.NewPathError("write "+name, path, err)
+	}
+	return nil
+}
+
+// formatMax formats a limit value, mapping negative values to "max"
+func formatMax(value int64) string {
+	if value < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(value, 10)
+}
+
 // setCPULimit sets CPU quota and period
 func (cm *CgroupManager) setCPULimit(quota int64, period int64) error {
 	if period == 0 {
@@ -306,11 +593,20 @@ func (cm *CgroupManager) readPidsStat() (int, error) {
 
 // Cleanup removes the cgroup
 func (cm *CgroupManager) Cleanup() error {
-	if err := os.RemoveAll(cm.CgroupPath); err != nil {
-		return util.NewPathError("remove cgroup", cm.CgroupPath, err)
+	// Processes that were just killed may keep the cgroup busy for a moment
+	var err error
+	for i := 0; i < cleanupRetries; i++ {
+		err = os.Remove(cm.CgroupPath)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(cleanupRetryDelay)
 	}
 
-	return nil
+	return util.NewPathError("remove cgroup", cm.CgroupPath, err)
 }
 
 // ResourceStats holds resource usage statistics
@@ -328,4 +624,4 @@ func contains(slice []string, item string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
@@ -0,0 +1,138 @@
+package cg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertCPUSharesToWeight(t *testing.T) {
+	tests := []struct {
+		shares   uint64
+		expected uint64
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 1},
+		{1024, 39},
+		{262143, 9999},
+		{262144, 10000},
+		{262145, 10000},
+		{1 << 40, 10000},
+	}
+
+	for _, tt := range tests {
+		if got := ConvertCPUSharesToWeight(tt.shares); got != tt.expected {
+			t.Errorf("ConvertCPUSharesToWeight(%d) = %d, want %d", tt.shares, got, tt.expected)
+		}
+	}
+}
+
+func TestConvertBlkioWeight(t *testing.T) {
+	tests := []struct {
+		weight   uint16
+		expected uint16
+	}{
+		{0, 0},
+		{5, 1},
+		{10, 1},
+		{500, 4950},
+		{1000, 10000},
+	}
+
+	for _, tt := range tests {
+		if got := ConvertBlkioWeight(tt.weight); got != tt.expected {
+			t.Errorf("ConvertBlkioWeight(%d) = %d, want %d", tt.weight, got, tt.expected)
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	zero := int64(0)
+
+	tests := []struct {
+		name     string
+		limits   ResourceLimits
+		expected bool
+	}{
+		{"nothing", ResourceLimits{}, true},
+		{"period alone", ResourceLimits{CPUPeriod: 100000}, true},
+		{"memory", ResourceLimits{Memory: 1 << 20}, false},
+		{"no swap", ResourceLimits{MemorySwap: &zero}, false},
+		{"unified", ResourceLimits{Unified: map[string]string{"memory.high": "1M"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.IsEmpty(); got != tt.expected {
+				t.Errorf("IsEmpty() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLimits(t *testing.T) {
+	unlimited := int64(-1)
+
+	tests := []struct {
+		name     string
+		limits   ResourceLimits
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "cpu with default period",
+			limits:   ResourceLimits{CPUQuota: 10000, CPUWeight: 39},
+			expected: map[string]string{"cpu.max": "10000 100000", "cpu.weight": "39"},
+		},
+		{
+			name:     "memory",
+			limits:   ResourceLimits{Memory: 1 << 20, MemoryLow: 1 << 19, MemorySwap: &unlimited, Pids: 64},
+			expected: map[string]string{"memory.max": "1048576", "memory.low": "524288", "memory.swap.max": "max", "pids.max": "64"},
+		},
+		{
+			name: "io",
+			limits: ResourceLimits{
+				IOWeight:     100,
+				IOMaxDevices: []IOMaxDevice{{Major: 8, Minor: 0, ReadBps: 1024, WriteIOPS: 10}},
+			},
+			expected: map[string]string{"io.weight": "default 100", "io.max": "8:0 rbps=1024 wiops=10"},
+		},
+		{
+			name:     "hugetlb and unified",
+			limits:   ResourceLimits{HugetlbLimits: map[string]uint64{"2MB": 4096}, Unified: map[string]string{"memory.high": "100M"}},
+			expected: map[string]string{"hugetlb.2MB.max": "4096", "memory.high": "100M"},
+		},
+		{
+			name:    "unified outside the cgroup",
+			limits:  ResourceLimits{Unified: map[string]string{"../memory.max": "1"}},
+			wantErr: true,
+		},
+		{
+			name:    "unified core file",
+			limits:  ResourceLimits{Unified: map[string]string{"cgroup.procs": "1"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &CgroupManager{CgroupPath: t.TempDir()}
+			err := cm.ApplyLimits(&tt.limits)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for name, value := range tt.expected {
+				data, err := os.ReadFile(filepath.Join(cm.CgroupPath, name))
+				if err != nil {
+					t.Errorf("%s not written: %v", name, err)
+					continue
+				}
+				if string(data) != value {
+					t.Errorf("%s = %q, want %q", name, data, value)
+				}
+			}
+		})
+	}
+}
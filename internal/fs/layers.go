@@ -0,0 +1,157 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// Extended attributes overlayfs marks opaque directories with, which hide
+// the contents of the same directory in the layers below
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// FlattenLayers copies layers, bottom first, into the existing directory dst
+// so that it shows what overlayfs would show for them. Whiteouts, character
+// devices 0/0, remove what the layers below have at their path. Owners,
+// modes and modification times are kept, hard links become separate files.
+func FlattenLayers(dst string, layers []string) error {
+	for _, layer := range layers {
+		err := filepath.WalkDir(layer, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(layer, path)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return copyEntry(path, filepath.Join(dst, rel), info)
+		})
+		if err != nil {
+			return util.NewPathError("flatten layer", layer, err)
+		}
+	}
+
+	return nil
+}
+
+// copyEntry copies one file of a layer over whatever dst holds so far
+func copyEntry(src, dst string, info os.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	mode := info.Mode()
+
+	if mode&os.ModeCharDevice != 0 && stat.Rdev == 0 {
+		return os.RemoveAll(dst)
+	}
+
+	// Only a directory merges with what is below it, anything else replaces it
+	existing, err := os.Lstat(dst)
+	if err == nil && !(existing.IsDir() && info.IsDir()) {
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+		existing = nil
+	}
+
+	switch {
+	case info.IsDir():
+		if existing == nil {
+			if err := os.Mkdir(dst, 0700); err != nil {
+				return err
+			}
+		} else if opaque(src) {
+			if err := clearDir(dst); err != nil {
+				return err
+			}
+		}
+	case mode.IsRegular():
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	default:
+		if err := unix.Mknod(dst, stat.Mode, int(stat.Rdev)); err != nil {
+			return &os.PathError{Op: "mknod", Path: dst, Err: err}
+		}
+	}
+
+	// Owners that are not mapped into our user namespace cannot be set, the
+	// copy is then owned by us
+	if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil && !errors.Is(err, unix.EINVAL) {
+		return err
+	}
+	if mode&os.ModeSymlink == 0 {
+		// After the chown, which clears the setuid and setgid bits
+		if err := unix.Chmod(dst, stat.Mode&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: dst, Err: err}
+		}
+	}
+	// The time of a directory changes again as its entries are copied
+	if !info.IsDir() {
+		times := []unix.Timespec{unix.NsecToTimespec(stat.Atim.Nano()), unix.NsecToTimespec(stat.Mtim.Nano())}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "set times", Path: dst, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// opaque reports whether overlayfs marks the directory path as opaque
+func opaque(path string) bool {
+	buf := make([]byte, 1)
+	for _, name := range opaqueXattrs {
+		if n, err := unix.Lgetxattr(path, name, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// clearDir removes the contents of the directory path
+func clearDir(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents of the regular file src to the new file dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeLayer creates the files of a test layer. Names ending in "/" are
+// directories, "->" makes a symlink and a "!" prefix a whiteout.
+func writeLayer(t *testing.T, dir string, entries ...string) {
+	t.Helper()
+
+	for _, entry := range entries {
+		name, target, isLink := strings.Cut(entry, " -> ")
+		whiteout := strings.HasPrefix(name, "!")
+		path := filepath.Join(dir, strings.TrimPrefix(name, "!"))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case strings.HasSuffix(name, "/"):
+			err = os.MkdirAll(path, 0755)
+		case isLink:
+			err = os.Symlink(target, path)
+		case whiteout:
+			err = unix.Mknod(path, unix.S_IFCHR, 0)
+			if errors.Is(err, unix.EPERM) {
+				t.Skip("creating whiteouts needs root")
+			}
+		default:
+			err = os.WriteFile(path, []byte(dir), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listTree returns the paths below dir, with the layer each file came from
+func listTree(t *testing.T, dir string, layers map[string]string) []string {
+	t.Helper()
+
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case d.IsDir():
+			rel += "/"
+		case d.Type()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			rel += " -> " + target
+		default:
+			data, _ := os.ReadFile(path)
+			rel += " " + layers[string(data)]
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestFlattenLayers(t *testing.T) {
+	base, top := t.TempDir(), t.TempDir()
+	writeLayer(t, base, "etc/passwd", "etc/hosts", "bin/sh", "opt/app/data", "lib -> usr/lib", "var/cache/old")
+	writeLayer(t, top, "etc/hosts", "!bin/sh", "lib/", "opt/app -> /srv", "var/cache/", "!missing")
+	if err := unix.Setxattr(filepath.Join(top, "var/cache"), "user.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("cannot mark opaque directories here: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := FlattenLayers(dst, []string{base, top}); err != nil {
+		t.Fatalf("FlattenLayers() error = %v", err)
+	}
+
+	expected := []string{
+		"bin/",
+		"etc/",
+		"etc/hosts top",
+		"etc/passwd base",
+		"lib/",
+		"opt/",
+		"opt/app -> /srv",
+		"var/",
+		"var/cache/",
+	}
+	got := listTree(t, dst, map[string]string{base: "base", top: "top"})
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("flattened tree:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestFlattenLayersKeepsModes(t *testing.T) {
+	layer := t.TempDir()
+	path := filepath.Join(layer, "run.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0751); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := FlattenLayers(dst, []string{layer}); err != nil {
+		t.Fatalf("FlattenLayers() error = %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0751 {
+		t.Errorf("mode = %v, want 0751", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// Overlay is a writable overlayfs layer stacked on a read-only rootfs.
+// Changes made by the container go to UpperDir, WorkDir is scratch space
+// overlayfs needs on the same filesystem, and the merged view is mounted at
+// MergedDir.
+type Overlay struct {
+	UpperDir  string
+	WorkDir   string
+	MergedDir string
+}
+
+// NewOverlay returns the layout of an overlay kept in dir
+func NewOverlay(dir string) *Overlay {
+	return &Overlay{
+		UpperDir:  filepath.Join(dir, "upper"),
+		WorkDir:   filepath.Join(dir, "work"),
+		MergedDir: filepath.Join(dir, "merged"),
+	}
+}
+
+// Create creates the overlay directories. The upper directory becomes the
+// root directory of the merged view, so it takes over the mode of lower.
+func (o *Overlay) Create(lower string) error {
+	info, err := os.Stat(lower)
+	if err != nil {
+		return util.NewPathError("create overlay", lower, err)
+	}
+
+	for _, dir := range []string{o.UpperDir, o.WorkDir, o.MergedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return util.NewPathError("create overlay directory", dir, err)
+		}
+	}
+	if err := os.Chmod(o.UpperDir, info.Mode().Perm()); err != nil {
+		return util.NewPathError("create overlay directory", o.UpperDir, err)
+	}
+
+	return nil
+}
+
+// Mount mounts the overlay over the read-only lower layers, bottom first
+func (o *Overlay) Mount(lowers []string) error {
+	// overlayfs lists the lower layers from the top down
+	var dirs []string
+	for i := len(lowers) - 1; i >= 0; i-- {
+		lower, err := filepath.Abs(lowers[i])
+		if err != nil {
+			return util.NewPathError("mount overlay", lowers[i], err)
+		}
+		dirs = append(dirs, lower)
+	}
+
+	// The option string has no escaping for these
+	for _, dir := range append([]string{o.UpperDir, o.WorkDir}, dirs...) {
+		if strings.ContainsAny(dir, ",:") {
+			return util.NewSimpleError("mount overlay", fmt.Sprintf("path %q contains ',' or ':'", dir))
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(dirs, ":"), o.UpperDir, o.WorkDir)
+	if err := unix.Mount("overlay", o.MergedDir, "overlay", 0, data); err != nil {
+		return util.NewPathError("mount overlay", o.MergedDir, err)
+	}
+
+	return nil
+}
+
+// Unsupported reports whether a Mount error means that overlayfs cannot be
+// used here at all rather than a bad layer: the kernel lacks it, or, inside
+// a user namespace, does not allow unprivileged overlay mounts
+func Unsupported(err error, userNamespace bool) bool {
+	return errors.Is(err, unix.ENODEV) || (userNamespace && errors.Is(err, unix.EPERM))
+}
+
+// Flatten stands in for Mount where overlayfs is not available. The lower
+// layers are copied into the upper directory beneath what it already holds,
+// and the result is bind mounted at MergedDir. The container then changes
+// the copy, so the upper directory ends up holding the whole rootfs.
+func (o *Overlay) Flatten(lowers []string) error {
+	// The current contents are moved aside and applied last, as top layer
+	top := filepath.Join(o.WorkDir, "upper")
+	if err := os.Rename(o.UpperDir, top); err != nil {
+		return util.NewPathError("flatten overlay", o.UpperDir, err)
+	}
+	if err := os.Mkdir(o.UpperDir, 0755); err != nil {
+		return util.NewPathError("flatten overlay", o.UpperDir, err)
+	}
+
+	layers := append(append([]string{}, lowers...), top)
+	if err := FlattenLayers(o.UpperDir, layers); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(top); err != nil {
+		return util.NewPathError("flatten overlay", top, err)
+	}
+
+	if err := unix.Mount(o.UpperDir, o.MergedDir, "", unix.MS_BIND, ""); err != nil {
+		return util.NewPathError("bind mount flattened rootfs", o.MergedDir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+func TestUnsupported(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		userNamespace bool
+		expected      bool
+	}{
+		{"no overlayfs", unix.ENODEV, false, true},
+		{"no overlayfs in user namespace", unix.ENODEV, true, true},
+		{"refused in user namespace", unix.EPERM, true, true},
+		{"refused to root", unix.EPERM, false, false},
+		{"bad layer", unix.EINVAL, true, false},
+		{"wrapped", util.NewPathError("mount overlay", "/merged", unix.ENODEV), false, true},
+		{"wrapped twice", fmt.Errorf("switch root: %w", util.NewPathError("mount overlay", "/merged", unix.EPERM)), true, true},
+		{"nil", nil, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unsupported(tt.err, tt.userNamespace); got != tt.expected {
+				t.Errorf("Unsupported(%v, %v) = %v, want %v", tt.err, tt.userNamespace, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOverlayCreate(t *testing.T) {
+	lower := t.TempDir()
+	if err := os.Chmod(lower, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	overlay := NewOverlay(filepath.Join(t.TempDir(), "overlay"))
+	if err := overlay.Create(lower); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	for _, dir := range []string{overlay.UpperDir, overlay.WorkDir, overlay.MergedDir} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("%s was not created: %v", dir, err)
+		}
+	}
+	if info, err := os.Stat(overlay.UpperDir); err == nil && info.Mode().Perm() != 0750 {
+		t.Errorf("upper directory mode = %v, want the lower's 0750", info.Mode().Perm())
+	}
+}
+
+func TestSetupOverlayFallback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounting the copied layers needs root")
+	}
+
+	tests := []struct {
+		name          string
+		userNamespace bool
+		flattened     bool
+	}{
+		{"rootless", true, true},
+		{"privileged", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lower, rootfs := t.TempDir(), t.TempDir()
+			for path, data := range map[string]string{filepath.Join(lower, "lower"): "lower", filepath.Join(rootfs, "top"): "top"} {
+				if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			overlay := NewOverlay(filepath.Join(t.TempDir(), "overlay"))
+			if err := overlay.Create(rootfs); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			// What the kernel answers an unprivileged overlay mount
+			defer func(mount func(*Overlay, []string) error) { mountOverlay = mount }(mountOverlay)
+			mountOverlay = func(o *Overlay, lowers []string) error {
+				return util.NewPathError("mount overlay", o.MergedDir, unix.EPERM)
+			}
+
+			rm := &RootfsManager{RootfsPath: rootfs, Overlay: overlay, Layers: []string{lower}, UserNamespace: tt.userNamespace}
+			err := rm.setupOverlay()
+			if !tt.flattened {
+				if err == nil {
+					t.Error("setupOverlay() succeeded, want the mount error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setupOverlay() error = %v", err)
+			}
+			defer unix.Unmount(overlay.MergedDir, unix.MNT_DETACH)
+
+			if rm.RootfsPath != overlay.MergedDir {
+				t.Errorf("RootfsPath = %s, want %s", rm.RootfsPath, overlay.MergedDir)
+			}
+			for _, name := range []string{"lower", "top"} {
+				if data, err := os.ReadFile(filepath.Join(overlay.MergedDir, name)); err != nil || string(data) != name {
+					t.Errorf("%s in the flattened rootfs = %q, %v", name, data, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ResolveInRoot resolves the slash separated path name like the kernel
+// would with root as "/", so that symlinks in an untrusted rootfs cannot
+// lead outside of it. Missing components are kept as they are.
+func ResolveInRoot(root, name string) (string, error) {
+	resolved := ""
+	remaining := name
+	links := 0
+
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = strings.TrimPrefix(path.Dir("/"+resolved), "/")
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: unix.ELOOP}
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = target + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"lib":       "usr/lib",
+		"abs":       "/usr",
+		"up":        "../../../..",
+		"chain":     "lib",
+		"usr/self":  ".",
+		"usr/back":  "../usr/lib",
+		"loop":      "loop",
+		"dangling":  "missing/dir",
+		"usr/local": "/abs/../up/usr",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"usr/lib/file", "usr/lib/file"},
+		{"lib/file", "usr/lib/file"},
+		{"chain/file", "usr/lib/file"},
+		{"abs/lib", "usr/lib"},
+		{"up/etc/passwd", "etc/passwd"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"usr/self/self/lib", "usr/lib"},
+		{"usr/back/x", "usr/lib/x"},
+		{"dangling/file", "missing/dir/file"},
+		{"usr/local/lib", "usr/lib"},
+		{"missing/../lib", "usr/lib"},
+		// The last component is followed as well
+		{"lib", "usr/lib"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveInRoot(root, tt.name)
+			if err != nil {
+				t.Fatalf("ResolveInRoot() error = %v", err)
+			}
+			if expected := filepath.Join(root, tt.expected); got != expected {
+				t.Errorf("ResolveInRoot(%q) = %s, want %s", tt.name, got, expected)
+			}
+		})
+	}
+
+	if _, err := ResolveInRoot(root, "loop/file"); !errors.Is(err, unix.ELOOP) {
+		t.Errorf("ResolveInRoot(loop) error = %v, want ELOOP", err)
+	}
+}
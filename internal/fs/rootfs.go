@@ -1,10 +1,10 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"syscall"
 
 	"golang.org/x/sys/unix"
 	"gomini/internal/util"
@@ -14,6 +14,16 @@ import (
 type RootfsManager struct {
 	RootfsPath string
 	Readonly   bool
+	Mounts     []MountPoint // Mounted into the rootfs before switching root
+
+	// Overlay, when set, is mounted over the rootfs and becomes the new
+	// root instead, so the rootfs itself is never written to
+	Overlay *Overlay
+	Layers  []string // Read-only layers below the rootfs in the overlay, bottom first
+
+	// UserNamespace is set inside a user namespace, where a refused overlay
+	// mount falls back to a copy of the layers
+	UserNamespace bool
 }
 
 // NewRootfsManager creates a new rootfs manager
@@ -100,13 +110,27 @@ func (rm *RootfsManager) ChrootFallback() error {
 	return nil
 }
 
+// mountOverlay mounts an overlay, replaced in tests
+var mountOverlay = (*Overlay).Mount
+
 // SwitchRoot switches to the new root filesystem using pivot_root with chroot fallback
 func (rm *RootfsManager) SwitchRoot() error {
+	if rm.Overlay != nil {
+		if err := rm.setupOverlay(); err != nil {
+			return err
+		}
+	}
+
 	// Prepare the rootfs first
 	if err := rm.PrepareRootfs(); err != nil {
 		return util.WrapError("prepare rootfs", err)
 	}
 
+	// Set up configured mounts while host paths are still reachable
+	if err := rm.MountAll(); err != nil {
+		return util.WrapError("mount rootfs mounts", err)
+	}
+
 	// Try pivot_root first
 	if err := rm.PivotRoot(); err != nil {
 		fmt.Fprintf(os.Stderr, "pivot_root failed (%v), falling back to chroot\n", err)
@@ -127,49 +151,115 @@ type MountPoint struct {
 	Type        string
 	Options     []string
 	Flags       uintptr
+	Propagation []uintptr // Propagation changes applied after mounting
+	Data        string    // Filesystem-specific options passed to mount(2)
+}
+
+// mountFlags maps mount options to the flags they set or clear
+var mountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"async":         {true, unix.MS_SYNCHRONOUS},
+	"atime":         {true, unix.MS_NOATIME},
+	"bind":          {false, unix.MS_BIND},
+	"defaults":      {false, 0},
+	"dev":           {true, unix.MS_NODEV},
+	"diratime":      {true, unix.MS_NODIRATIME},
+	"dirsync":       {false, unix.MS_DIRSYNC},
+	"exec":          {true, unix.MS_NOEXEC},
+	"mand":          {false, unix.MS_MANDLOCK},
+	"noatime":       {false, unix.MS_NOATIME},
+	"nodev":         {false, unix.MS_NODEV},
+	"nodiratime":    {false, unix.MS_NODIRATIME},
+	"noexec":        {false, unix.MS_NOEXEC},
+	"nomand":        {true, unix.MS_MANDLOCK},
+	"norelatime":    {true, unix.MS_RELATIME},
+	"nostrictatime": {true, unix.MS_STRICTATIME},
+	"nosuid":        {false, unix.MS_NOSUID},
+	"rbind":         {false, unix.MS_BIND | unix.MS_REC},
+	"relatime":      {false, unix.MS_RELATIME},
+	"remount":       {false, unix.MS_REMOUNT},
+	"ro":            {false, unix.MS_RDONLY},
+	"rw":            {true, unix.MS_RDONLY},
+	"strictatime":   {false, unix.MS_STRICTATIME},
+	"suid":          {true, unix.MS_NOSUID},
+	"sync":          {false, unix.MS_SYNCHRONOUS},
+}
+
+// propagationFlags maps propagation options to their mount flags
+var propagationFlags = map[string]uintptr{
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"shared":      unix.MS_SHARED,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
+// ParseMountOptions splits OCI mount options into mount flags, propagation
+// changes and the remaining filesystem-specific data string
+func ParseMountOptions(options []string) (uintptr, []uintptr, string) {
+	var flags uintptr
+	var propagation []uintptr
+	var data []string
+
+	for _, option := range options {
+		if f, ok := mountFlags[option]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+		} else if p, ok := propagationFlags[option]; ok {
+			propagation = append(propagation, p)
+		} else {
+			data = append(data, option)
+		}
+	}
+
+	return flags, propagation, joinOptions(data)
+}
+
+// NewMountPoint creates a mount point with its options translated to flags
+func NewMountPoint(source, destination, fsType string, options []string) MountPoint {
+	flags, propagation, data := ParseMountOptions(options)
+	return MountPoint{
+		Source:      source,
+		Destination: destination,
+		Type:        fsType,
+		Options:     options,
+		Flags:       flags,
+		Propagation: propagation,
+		Data:        data,
+	}
 }
 
-// CreateBasicMounts creates essential mounts for the container
-func CreateBasicMounts() error {
-	mounts := []MountPoint{
-		{
-			Source:      "proc",
-			Destination: "/proc",
-			Type:        "proc",
-			Flags:       0,
-		},
-		{
-			Source:      "tmpfs",
-			Destination: "/dev",
-			Type:        "tmpfs",
-			Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
-			Flags:       syscall.MS_NOSUID,
-		},
-		{
-			Source:      "devpts",
-			Destination: "/dev/pts",
-			Type:        "devpts",
-			Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"},
-			Flags:       syscall.MS_NOSUID | syscall.MS_NOEXEC,
-		},
-		{
-			Source:      "tmpfs",
-			Destination: "/dev/shm",
-			Type:        "tmpfs",
-			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
-			Flags:       syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV,
-		},
-		{
-			Source:      "sysfs",
-			Destination: "/sys",
-			Type:        "sysfs",
-			Options:     []string{"nosuid", "noexec", "nodev", "ro"},
-			Flags:       syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV | syscall.MS_RDONLY,
-		},
-	}
-
-	for _, mount := range mounts {
-		if err := createMount(mount); err != nil {
+// IsBind reports whether the mount is a bind mount
+func (m MountPoint) IsBind() bool {
+	return m.Flags&unix.MS_BIND != 0
+}
+
+// MakeRootSlave stops mounts made in a new mount namespace from propagating
+// back to the host
+func MakeRootSlave() error {
+	if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return util.NewError("make / rslave", err)
+	}
+	return nil
+}
+
+// MountAll mounts the configured mount points inside the rootfs in order
+func (rm *RootfsManager) MountAll() error {
+	for _, mount := range rm.Mounts {
+		target, err := mountTarget(rm.RootfsPath, mount.Destination)
+		if err != nil {
+			return util.WrapError(fmt.Sprintf("create mount %s", mount.Destination), err)
+		}
+
+		if err := mountAt(mount, target); err != nil {
 			return util.WrapError(fmt.Sprintf("create mount %s", mount.Destination), err)
 		}
 	}
@@ -177,24 +267,171 @@ func CreateBasicMounts() error {
 	return nil
 }
 
-// createMount creates a single mount point
-func createMount(mount MountPoint) error {
-	// Create destination directory if it doesn't exist
-	if err := os.MkdirAll(mount.Destination, 0755); err != nil {
-		return util.NewPathError("create mount point", mount.Destination, err)
+// setupOverlay mounts the overlay over the layers and the rootfs, or copies
+// them where overlayfs is not available, and makes the result the rootfs
+func (rm *RootfsManager) setupOverlay() error {
+	lowers := append(append([]string{}, rm.Layers...), rm.RootfsPath)
+	err := mountOverlay(rm.Overlay, lowers)
+	if Unsupported(err, rm.UserNamespace) {
+		fmt.Fprintf(os.Stderr, "Warning: overlayfs is not available (%v), copying the rootfs layers instead\n", err)
+		err = rm.Overlay.Flatten(lowers)
+	}
+	if err != nil {
+		return err
+	}
+	rm.RootfsPath = rm.Overlay.MergedDir
+	return nil
+}
+
+// mountTarget returns the path a mount destination has inside the rootfs.
+// Symlinks in the rootfs, including one at the destination itself, are
+// resolved with the rootfs as "/", so they cannot lead to the host and a
+// mount over a symlinked file such as /etc/resolv.conf lands on its target.
+func mountTarget(rootfs, destination string) (string, error) {
+	target, err := ResolveInRoot(rootfs, filepath.Clean("/"+destination))
+	if err != nil {
+		return "", util.NewPathError("resolve mount point", destination, err)
 	}
 
-	// Prepare options string
-	var data string
-	if len(mount.Options) > 0 {
-		data = joinOptions(mount.Options)
+	return target, nil
+}
+
+// BasicMounts returns the essential mounts used when a bundle defines none
+func BasicMounts() []MountPoint {
+	return []MountPoint{
+		NewMountPoint("proc", "/proc", "proc", nil),
+		NewMountPoint("tmpfs", "/dev", "tmpfs", []string{"nosuid", "strictatime", "mode=755", "size=65536k"}),
+		NewMountPoint("devpts", "/dev/pts", "devpts", []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}),
+		NewMountPoint("tmpfs", "/dev/shm", "tmpfs", []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}),
+		NewMountPoint("sysfs", "/sys", "sysfs", []string{"nosuid", "noexec", "nodev", "ro"}),
+	}
+}
+
+// CgroupMount returns the cgroup2 mount that shows a container with its own
+// cgroup namespace its cgroup as the root of the hierarchy
+func CgroupMount() MountPoint {
+	return NewMountPoint("cgroup", "/sys/fs/cgroup", "cgroup2", []string{"nosuid", "noexec", "nodev", "relatime", "ro"})
+}
+
+// mountAt mounts a mount point at the given target path
+func mountAt(mount MountPoint, target string) error {
+	if mount.IsBind() {
+		return bindMount(mount, target)
+	}
+
+	// Only the unified hierarchy is supported, so OCI "cgroup" mounts get
+	// cgroup v2 like they do in other runtimes on v2 hosts
+	if mount.Type == "cgroup" {
+		mount.Type = "cgroup2"
+	}
+
+	// Create destination directory if it doesn't exist
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return util.NewPathError("create mount point", target, err)
 	}
 
 	// Perform the mount
-	if err := unix.Mount(mount.Source, mount.Destination, mount.Type, mount.Flags, data); err != nil {
+	if err := unix.Mount(mount.Source, target, mount.Type, mount.Flags, mount.Data); err != nil {
+		// A user namespace that does not own the network namespace may not
+		// mount sysfs, so fall back to the host's /sys like other runtimes
+		if mount.Type == "sysfs" && errors.Is(err, unix.EPERM) {
+			return bindMount(MountPoint{
+				Source:      "/sys",
+				Destination: mount.Destination,
+				Flags:       unix.MS_BIND | unix.MS_REC | mount.Flags&(unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC),
+				Propagation: mount.Propagation,
+			}, target)
+		}
 		return util.NewError("mount", err)
 	}
 
+	return setPropagation(mount, target)
+}
+
+// bindMount bind mounts a file or directory and applies its flags
+func bindMount(mount MountPoint, target string) error {
+	info, err := os.Stat(mount.Source)
+	if err != nil {
+		return util.NewPathError("stat bind source", mount.Source, err)
+	}
+
+	// The mount point must be of the same kind as the source
+	if info.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return util.NewPathError("create mount point", target, err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return util.NewPathError("create mount point", filepath.Dir(target), err)
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY|unix.O_NOFOLLOW, 0644)
+		if err != nil {
+			return util.NewPathError("create mount point", target, err)
+		}
+		f.Close()
+	}
+
+	bindFlags := mount.Flags & (unix.MS_BIND | unix.MS_REC)
+	if err := unix.Mount(mount.Source, target, "", bindFlags, ""); err != nil {
+		return util.NewError("bind mount", err)
+	}
+
+	// The kernel ignores other flags on the initial bind, so read-only and
+	// similar options need a second remount of the bind mount
+	if mount.Flags&^bindFlags != 0 {
+		remountFlags := mount.Flags | unix.MS_BIND | unix.MS_REMOUNT | lockedFlags(target, mount.Flags)
+		if err := unix.Mount("", target, "", remountFlags, ""); err != nil {
+			return util.NewError("remount bind mount", err)
+		}
+	}
+
+	return setPropagation(mount, target)
+}
+
+// lockedFlags returns the flags of an existing mount that a remount has to
+// keep. Inside a user namespace the kernel refuses to clear nosuid, nodev,
+// noexec or the atime mode of mounts inherited from the host.
+func lockedFlags(target string, requested uintptr) uintptr {
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return 0
+	}
+
+	var flags uintptr
+	for stFlag, msFlag := range map[int64]uintptr{
+		unix.ST_NOSUID: unix.MS_NOSUID,
+		unix.ST_NODEV:  unix.MS_NODEV,
+		unix.ST_NOEXEC: unix.MS_NOEXEC,
+	} {
+		if st.Flags&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+
+	// Keep the atime mode unless the mount asks for one explicitly
+	atimeFlags := uintptr(unix.MS_NOATIME | unix.MS_RELATIME | unix.MS_STRICTATIME)
+	if requested&atimeFlags == 0 {
+		if st.Flags&unix.ST_NOATIME != 0 {
+			flags |= unix.MS_NOATIME
+		}
+		if st.Flags&unix.ST_RELATIME != 0 {
+			flags |= unix.MS_RELATIME
+		}
+		if st.Flags&unix.ST_NODIRATIME != 0 {
+			flags |= unix.MS_NODIRATIME
+		}
+	}
+
+	return flags
+}
+
+// setPropagation applies the propagation changes of a mount point
+func setPropagation(mount MountPoint, target string) error {
+	for _, flag := range mount.Propagation {
+		if err := unix.Mount("", target, "", flag, ""); err != nil {
+			return util.NewError("set mount propagation", err)
+		}
+	}
 	return nil
 }
 
@@ -218,4 +455,4 @@ func EnsureDirectory(path string, mode os.FileMode) error {
 		return util.NewPathError("ensure directory", path, err)
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     []string
+		flags       uintptr
+		propagation []uintptr
+		data        string
+	}{
+		{"none", nil, 0, nil, ""},
+		{"flags", []string{"nosuid", "nodev", "noexec", "ro"}, unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_RDONLY, nil, ""},
+		{"later option clears", []string{"ro", "rw", "noexec", "exec"}, 0, nil, ""},
+		{"rbind", []string{"rbind"}, unix.MS_BIND | unix.MS_REC, nil, ""},
+		{"defaults", []string{"defaults"}, 0, nil, ""},
+		{"propagation in order", []string{"bind", "rprivate", "shared"}, unix.MS_BIND, []uintptr{unix.MS_PRIVATE | unix.MS_REC, unix.MS_SHARED}, ""},
+		{"data", []string{"nosuid", "mode=755", "size=65536k"}, unix.MS_NOSUID, nil, "mode=755,size=65536k"},
+		{"unknown kept as data", []string{"newinstance", "ptmxmode=0666"}, 0, nil, "newinstance,ptmxmode=0666"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, propagation, data := ParseMountOptions(tt.options)
+			if flags != tt.flags {
+				t.Errorf("flags = %#x, want %#x", flags, tt.flags)
+			}
+			if !reflect.DeepEqual(propagation, tt.propagation) {
+				t.Errorf("propagation = %v, want %v", propagation, tt.propagation)
+			}
+			if data != tt.data {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+		})
+	}
+}
+
+func TestMountTarget(t *testing.T) {
+	rootfs := t.TempDir()
+	for _, dir := range []string{"etc", "data/real"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"escape":        "/etc",
+		"relative":      "../../..",
+		"data/link":     "real",
+		"etc/localtime": "/usr/share/zoneinfo/UTC",
+		"loop":          "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(rootfs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		destination string
+		expected    string
+		wantErr     bool
+	}{
+		{"/proc", "proc", false},
+		{"sys/fs/cgroup", "sys/fs/cgroup", false},
+		{"/data/../etc/hosts", "etc/hosts", false},
+		{"/escape/shadow", "etc/shadow", false},
+		{"/relative/etc", "etc", false},
+		{"/data/link/file", "data/real/file", false},
+		{"/etc/localtime", "usr/share/zoneinfo/UTC", false},
+		{"/escape", "etc", false},
+		{"/data/link", "data/real", false},
+		{"/loop", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			target, err := mountTarget(rootfs, tt.destination)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("mountTarget() = %s, want an error", target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mountTarget() error = %v", err)
+			}
+			if expected := filepath.Join(rootfs, tt.expected); target != expected {
+				t.Errorf("mountTarget() = %s, want %s", target, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gomini/internal/fs"
+	"gomini/internal/util"
+)
+
+// archiveManifest is an entry of the manifest.json of a "docker save"
+// archive. Paths are relative to the archive root.
+type archiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Archive is a "docker save" archive, unpacked into a temporary directory
+// since its manifest, configuration and layers come in no fixed order
+type Archive struct {
+	Dir       string
+	manifests []archiveManifest
+}
+
+// OpenArchive unpacks the archive at path, which may itself be gzip or
+// zstd compressed. Close removes the unpacked files again.
+func OpenArchive(path string) (*Archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, util.NewPathError("open archive", path, err)
+	}
+	defer file.Close()
+
+	stream, err := decompress(file)
+	if err != nil {
+		return nil, util.NewPathError("decompress archive", path, err)
+	}
+	defer stream.Close()
+
+	dir, err := os.MkdirTemp("", "gomini-import-")
+	if err != nil {
+		return nil, util.NewError("create temporary directory", err)
+	}
+	a := &Archive{Dir: dir}
+
+	if err := a.extract(tar.NewReader(stream)); err != nil {
+		a.Close()
+		return nil, util.NewPathError("unpack archive", path, err)
+	}
+
+	manifestPath, err := a.path("manifest.json")
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	if err := readJSON(manifestPath, &a.manifests); err != nil {
+		a.Close()
+		return nil, util.WrapError("read archive manifest", err)
+	}
+
+	return a, nil
+}
+
+// extract writes the files of the archive below a.Dir. Symlinks, which
+// "docker save" uses for layers shared by several images, are created as
+// they are: every path is resolved with a.Dir as root, so chains of links
+// and links to directories work in any order and none leads out.
+func (a *Archive) extract(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := a.extractEntry(hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// extractEntry creates the file, directory or link of one archive entry
+func (a *Archive) extractEntry(hdr *tar.Header, r io.Reader) error {
+	name, err := localPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	parent, err := fs.ResolveInRoot(a.Dir, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(parent, filepath.Base(name))
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, 0700)
+	case tar.TypeReg:
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return err
+		}
+		return copyTo(target, r)
+	case tar.TypeSymlink:
+		// Relative to the directory of the link, but within the archive
+		if _, err := localPath(filepath.Join(filepath.Dir(name), hdr.Linkname)); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		// The file linked to comes earlier in the archive
+		source, err := a.path(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	}
+	return nil
+}
+
+// localPath cleans a path inside the archive and rejects any leading out
+func localPath(name string) (string, error) {
+	name = filepath.Clean(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+	return name, nil
+}
+
+// Close removes the unpacked archive
+func (a *Archive) Close() error {
+	return os.RemoveAll(a.Dir)
+}
+
+// Image resolves the image tagged tag, or the only image of the archive
+// when tag is empty, and checks that it is built for platform. The layers
+// are verified against the diff_ids of the image configuration.
+func (a *Archive) Image(tag string, platform Platform) (*Config, []Layer, error) {
+	manifest, err := a.selectTag(tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configPath, err := a.path(manifest.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config Config
+	if err := readJSON(configPath, &config); err != nil {
+		return nil, nil, util.WrapError("read image config", err)
+	}
+
+	p := Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if !p.matches(platform) {
+		return nil, nil, util.NewSimpleError("resolve image", fmt.Sprintf("image is built for %s, not %s", p, platform))
+	}
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, nil, util.NewSimpleError("resolve image", fmt.Sprintf("image config lists %d layers, manifest %d", len(config.RootFS.DiffIDs), len(manifest.Layers)))
+	}
+	var layers []Layer
+	for i, name := range manifest.Layers {
+		path, err := a.path(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		layers = append(layers, Layer{Path: path, DiffID: config.RootFS.DiffIDs[i]})
+	}
+
+	return &config, layers, nil
+}
+
+// selectTag returns the manifest of the image tagged tag. A tag without a
+// version also matches the "latest" one.
+func (a *Archive) selectTag(tag string) (*archiveManifest, error) {
+	var available []string
+	for i, manifest := range a.manifests {
+		for _, repoTag := range manifest.RepoTags {
+			if tag != "" && (repoTag == tag || repoTag == tag+":latest") {
+				return &a.manifests[i], nil
+			}
+		}
+		available = append(available, manifest.RepoTags...)
+	}
+	sort.Strings(available)
+
+	switch {
+	case tag != "":
+		return nil, util.NewSimpleError("resolve image", fmt.Sprintf("no image %q in archive (available: %s)", tag, strings.Join(available, ", ")))
+	case len(a.manifests) == 0:
+		return nil, util.NewSimpleError("resolve image", "archive manifest lists no images")
+	case len(a.manifests) > 1:
+		return nil, util.NewSimpleError("resolve image", fmt.Sprintf("archive holds several images, select one of %s", strings.Join(available, ", ")))
+	}
+	return &a.manifests[0], nil
+}
+
+// path returns the unpacked file for a path in the archive, following its
+// symlinks inside the archive
+func (a *Archive) path(name string) (string, error) {
+	name, err := localPath(name)
+	if err != nil {
+		return "", util.WrapError("resolve image", err)
+	}
+	path, err := fs.ResolveInRoot(a.Dir, name)
+	if err != nil {
+		return "", util.NewPathError("resolve image", name, err)
+	}
+	return path, nil
+}
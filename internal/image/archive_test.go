@@ -0,0 +1,209 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{"manifest.json", "manifest.json", false},
+		{"./abc/layer.tar", "abc/layer.tar", false},
+		{"abc/../def/layer.tar", "def/layer.tar", false},
+		{"../evil", "", true},
+		{"abc/../../evil", "", true},
+		{"/etc/passwd", "", true},
+		{"./", ".", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := localPath(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("localPath() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSelectTag(t *testing.T) {
+	one := []archiveManifest{{Config: "a.json", RepoTags: []string{"app:latest", "app:1"}}}
+	two := []archiveManifest{
+		{Config: "a.json", RepoTags: []string{"app:latest"}},
+		{Config: "b.json", RepoTags: []string{"db:v1"}},
+	}
+	untagged := []archiveManifest{{Config: "a.json"}}
+
+	tests := []struct {
+		name      string
+		manifests []archiveManifest
+		tag       string
+		expected  string
+		wantErr   bool
+	}{
+		{"only image", one, "", "a.json", false},
+		{"only untagged image", untagged, "", "a.json", false},
+		{"full tag", two, "db:v1", "b.json", false},
+		{"latest implied", two, "app", "a.json", false},
+		{"other tag of the image", one, "app:1", "a.json", false},
+		{"no latest", two, "db", "", true},
+		{"unknown tag", two, "web:1", "", true},
+		{"ambiguous", two, "", "", true},
+		{"empty manifest", nil, "", "", true},
+		{"untagged by tag", untagged, "app", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Archive{manifests: tt.manifests}
+			manifest, err := a.selectTag(tt.tag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && manifest.Config != tt.expected {
+				t.Errorf("selectTag() = %s, want %s", manifest.Config, tt.expected)
+			}
+		})
+	}
+}
+
+func TestArchiveExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []entry
+		path     string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "shared layer",
+			entries:  []entry{{name: "a/layer.tar"}, {name: "b/layer.tar", link: "../a/layer.tar"}},
+			path:     "b/layer.tar",
+			expected: "a/layer.tar",
+		},
+		{
+			name:     "chain before its target",
+			entries:  []entry{{name: "c/layer.tar", link: "../b/layer.tar"}, {name: "b", link: "a"}, {name: "a/layer.tar"}},
+			path:     "c/layer.tar",
+			expected: "a/layer.tar",
+		},
+		{
+			name:     "symlinked directory",
+			entries:  []entry{{name: "a/"}, {name: "a/layer.tar"}, {name: "b", link: "a"}},
+			path:     "b/layer.tar",
+			expected: "a/layer.tar",
+		},
+		{
+			name:     "hard link",
+			entries:  []entry{{name: "a/layer.tar"}, {name: "b/layer.tar", link: "a/layer.tar", hardLink: true}},
+			path:     "b/layer.tar",
+			expected: "a/layer.tar",
+		},
+		{
+			name:     "links stay inside",
+			entries:  []entry{{name: "etc/passwd"}, {name: "self", link: "."}, {name: "up", link: "self/.."}},
+			path:     "up/etc/passwd",
+			expected: "etc/passwd",
+		},
+		{
+			name:    "leading out",
+			entries: []entry{{name: "../evil"}},
+			wantErr: true,
+		},
+		{
+			name:    "link leading out",
+			entries: []entry{{name: "evil", link: "../../etc/passwd"}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate file",
+			entries: []entry{{name: "a/layer.tar"}, {name: "a/layer.tar"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Archive{Dir: t.TempDir()}
+			err := a.extract(tar.NewReader(bytes.NewReader(makeTar(t, tt.entries...))))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("extract() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extract() error = %v", err)
+			}
+
+			path, err := a.path(tt.path)
+			if err != nil {
+				t.Fatalf("path() error = %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.expected {
+				t.Errorf("%s has the contents of %s, want %s", tt.path, data, tt.expected)
+			}
+		})
+	}
+}
+
+func TestArchiveExtractNamesEntry(t *testing.T) {
+	a := &Archive{Dir: t.TempDir()}
+	err := a.extract(tar.NewReader(bytes.NewReader(makeTar(t, entry{name: "x/layer.tar"}, entry{name: "x/layer.tar"}))))
+	if err == nil || !strings.HasPrefix(err.Error(), "x/layer.tar: ") {
+		t.Errorf("extract() error = %v, want it to name x/layer.tar", err)
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	manifest := `[{"Config": "config.json", "RepoTags": ["app:latest"], "Layers": ["l/layer.tar"]}]`
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string]string{"manifest.json": manifest, "config.json": "{}", "l/layer.tar": "layer"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(buf.Bytes())
+	gz.Close()
+
+	path := filepath.Join(t.TempDir(), "image.tar.gz")
+	if err := os.WriteFile(path, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := OpenArchive(path)
+	if err != nil {
+		t.Fatalf("OpenArchive() error = %v", err)
+	}
+	dir := archive.Dir
+	if manifest, err := archive.selectTag("app"); err != nil || manifest.Layers[0] != "l/layer.tar" {
+		t.Errorf("selectTag() = %v, %v", manifest, err)
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s left behind after Close()", dir)
+	}
+}
@@ -0,0 +1,189 @@
+package image
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gomini/internal/fs"
+	"gomini/internal/spec"
+	"gomini/internal/util"
+)
+
+// Defaults for the generated config.json, as in the bundle of the README
+const (
+	bundleHostname = "gomini-container"
+	defaultPath    = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// CreateBundle makes dir a bundle running the image: the layers, bottom
+// first, are unpacked into its rootfs and a config.json is generated from
+// the image configuration. Nothing is left behind when this fails.
+func CreateBundle(dir string, config *Config, layers []Layer) (err error) {
+	rootfs := filepath.Join(dir, "rootfs")
+	configPath := filepath.Join(dir, "config.json")
+	for _, path := range []string{rootfs, configPath} {
+		if _, err := os.Lstat(path); err == nil {
+			return util.NewPathError("create bundle", path, os.ErrExist)
+		}
+	}
+
+	args := append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+	if len(args) == 0 {
+		return util.NewSimpleError("create bundle", "image has no Entrypoint or Cmd to run")
+	}
+
+	_, statErr := os.Stat(dir)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return util.NewPathError("create bundle", rootfs, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if os.IsNotExist(statErr) {
+			os.RemoveAll(dir)
+			return
+		}
+		os.RemoveAll(rootfs)
+		os.Remove(configPath)
+	}()
+
+	for i, layer := range layers {
+		fmt.Printf("Unpacking layer %d/%d\n", i+1, len(layers))
+		if err := ApplyLayer(rootfs, layer); err != nil {
+			return util.WrapError("create bundle", err)
+		}
+	}
+
+	user, err := processUser(rootfs, config.Config.User)
+	if err != nil {
+		return util.WrapError("create bundle", err)
+	}
+
+	env := config.Config.Env
+	if !hasPath(env) {
+		env = append([]string{defaultPath}, env...)
+	}
+	cwd := config.Config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	bundleConfig := spec.Config{
+		OCIVersion: "1.0.2",
+		Process: spec.Process{
+			User: user,
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+		},
+		Root:     spec.Root{Path: "rootfs"},
+		Hostname: bundleHostname,
+		Linux: spec.Linux{
+			Namespaces: []spec.Namespace{{Type: "pid"}, {Type: "uts"}, {Type: "mount"}, {Type: "ipc"}},
+		},
+	}
+	data, err := json.MarshalIndent(&bundleConfig, "", "    ")
+	if err != nil {
+		return util.NewError("marshal config", err)
+	}
+	if err := os.WriteFile(configPath, append(data, '\n'), 0644); err != nil {
+		return util.NewPathError("write config", configPath, err)
+	}
+
+	// The generated config has to pass the same checks as a handwritten one
+	if _, err := spec.LoadConfig(dir); err != nil {
+		return util.WrapError("create bundle", err)
+	}
+
+	return nil
+}
+
+// hasPath reports whether env sets PATH
+func hasPath(env []string) bool {
+	for _, entry := range env {
+		if strings.HasPrefix(entry, "PATH=") {
+			return true
+		}
+	}
+	return false
+}
+
+// processUser turns the User of an image, "user", "uid", "user:group" or
+// "uid:gid", into the user of the bundle's process. A user name alone is
+// left to the runtime, which also adds the groups of the user; other names
+// are looked up in the rootfs here.
+func processUser(rootfs, user string) (spec.User, error) {
+	if user == "" {
+		return spec.User{}, nil
+	}
+
+	name, group, hasGroup := strings.Cut(user, ":")
+	uid, err := strconv.Atoi(name)
+	if err != nil && !hasGroup {
+		return spec.User{Username: name}, nil
+	}
+
+	var gid int
+	if err != nil {
+		fields, err := findEntry(rootfs, "etc/passwd", func(fields []string) bool { return fields[0] == name })
+		if err != nil {
+			return spec.User{}, err
+		}
+		if uid, err = strconv.Atoi(fields[2]); err != nil {
+			return spec.User{}, util.NewSimpleError("lookup user", fmt.Sprintf("invalid uid for user %q", name))
+		}
+	} else if !hasGroup {
+		// A numeric user takes the primary group of its passwd entry, if any
+		fields, err := findEntry(rootfs, "etc/passwd", func(fields []string) bool { return fields[2] == name })
+		if err == nil {
+			gid, _ = strconv.Atoi(fields[3])
+		}
+		return spec.User{UID: uid, GID: gid}, nil
+	}
+
+	if gid, err = strconv.Atoi(group); err != nil {
+		fields, err := findEntry(rootfs, "etc/group", func(fields []string) bool { return fields[0] == group })
+		if err != nil {
+			return spec.User{}, err
+		}
+		if gid, err = strconv.Atoi(fields[2]); err != nil {
+			return spec.User{}, util.NewSimpleError("lookup group", fmt.Sprintf("invalid gid for group %q", group))
+		}
+	}
+
+	return spec.User{UID: uid, GID: gid}, nil
+}
+
+// findEntry returns the fields of the first line of a passwd or group file
+// in the rootfs that match
+func findEntry(rootfs, name string, match func(fields []string) bool) ([]string, error) {
+	path, err := fs.ResolveInRoot(rootfs, name)
+	if err != nil {
+		return nil, util.NewPathError("lookup user", name, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, util.NewPathError("lookup user", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Both files have at least name:password:id:gid-or-members
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) >= 4 && match(fields) {
+			return fields, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, util.NewPathError("lookup user", path, err)
+	}
+
+	return nil, util.NewSimpleError("lookup user", fmt.Sprintf("no matching entry in /%s", name))
+}
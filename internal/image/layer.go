@@ -0,0 +1,298 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+	"gomini/internal/fs"
+	"gomini/internal/util"
+)
+
+// Whiteout names in layer tarballs: ".wh.<name>" deletes name from the
+// layers below, the opaque marker hides everything they have in its directory
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Magic numbers of the compressions a layer may use
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ApplyLayer unpacks the layer on top of the rootfs at root. The blob is
+// verified before anything is unpacked, the DiffID while unpacking.
+func ApplyLayer(root string, layer Layer) error {
+	if layer.Digest != "" {
+		size := layer.Size
+		if size == 0 {
+			size = -1
+		}
+		if err := VerifyBlob(layer.Path, layer.Digest, size); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(layer.Path)
+	if err != nil {
+		return util.NewPathError("open layer", layer.Path, err)
+	}
+	defer file.Close()
+
+	stream, err := decompress(file)
+	if err != nil {
+		return util.NewPathError("decompress layer", layer.Path, err)
+	}
+	defer stream.Close()
+
+	var verifier *verifier
+	if layer.DiffID != "" {
+		if verifier, err = newVerifier(layer.DiffID); err != nil {
+			return err
+		}
+		stream = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(stream, verifier), stream}
+	}
+
+	if err := unpack(root, tar.NewReader(stream)); err != nil {
+		return util.NewPathError("unpack layer", layer.Path, err)
+	}
+
+	// The digest covers the padding after the end of the archive as well
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return util.NewPathError("read layer", layer.Path, err)
+	}
+	if verifier != nil {
+		if err := verifier.verify(); err != nil {
+			return util.NewPathError("verify layer", layer.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// decompress returns the tarball in r, which may be plain, gzip or zstd
+// compressed
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(buffered), nil
+	}
+}
+
+// unpack extracts the tar stream over root, applying its whiteouts
+func unpack(root string, tr *tar.Reader) error {
+	// Whiteouts only apply to the layers below, so the entries of this one
+	// are remembered to keep them from being removed
+	unpacked := make(map[string]bool)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+
+		parent, err := fs.ResolveInRoot(root, dir)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case base == whiteoutOpaque:
+			if err := removeLower(parent, unpacked); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix+whiteoutPrefix):
+			// Other aufs metadata has no meaning here
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removed := strings.TrimPrefix(base, whiteoutPrefix)
+			if removed == "." || removed == ".." {
+				return fmt.Errorf("invalid whiteout %s", hdr.Name)
+			}
+			target := filepath.Join(parent, removed)
+			if !unpacked[target] {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		target := filepath.Join(parent, base)
+		if err := extract(root, target, hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		unpacked[target] = true
+	}
+}
+
+// removeLower empties the directory dir except for what this layer unpacked
+func removeLower(dir string, unpacked map[string]bool) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path == dir || unpacked[path] {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// extract creates the file of a tar entry at target, replacing what the
+// layers below have there unless both are directories
+func extract(root, target string, hdr *tar.Header, r io.Reader) error {
+	if existing, err := os.Lstat(target); err == nil {
+		if !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	case tar.TypeReg:
+		if err := copyTo(target, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return finish(target, hdr, os.Symlink(hdr.Linkname, target))
+	case tar.TypeLink:
+		// The link target is named relative to the root, like the entry
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")
+		dir, err := fs.ResolveInRoot(root, path.Dir(name))
+		if err != nil {
+			return err
+		}
+		return os.Link(filepath.Join(dir, path.Base(name)), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(hdr.Mode & 07777)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= unix.S_IFCHR
+		case tar.TypeBlock:
+			mode |= unix.S_IFBLK
+		default:
+			mode |= unix.S_IFIFO
+		}
+		err := unix.Mknod(target, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		// Device nodes cannot be created without root, the runtime provides
+		// the usual ones in /dev anyway
+		if errors.Is(err, unix.EPERM) && hdr.Typeflag != tar.TypeFifo {
+			fmt.Fprintf(os.Stderr, "Warning: skipping device node %s: %v\n", hdr.Name, err)
+			return nil
+		}
+		if err != nil {
+			return &os.PathError{Op: "mknod", Path: target, Err: err}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Warning: skipping %s of unsupported type %q\n", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	return finish(target, hdr, nil)
+}
+
+// copyTo writes the contents of r to the new file target
+func copyTo(target string, r io.Reader) error {
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// finish applies the owner, mode, extended attributes and modification
+// time of a tar entry to the file created for it
+func finish(target string, hdr *tar.Header, err error) error {
+	if err != nil {
+		return err
+	}
+
+	// Without root the files stay ours, which is container root in a
+	// rootless container
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+			if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: cannot set %s on %s: %v\n", name, hdr.Name, err)
+			}
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		// After the chown, which clears the setuid and setgid bits
+		if err := unix.Chmod(target, uint32(hdr.Mode&07777)); err != nil {
+			return &os.PathError{Op: "chmod", Path: target, Err: err}
+		}
+	}
+
+	// The time of a directory changes again as its entries are unpacked
+	if hdr.Typeflag != tar.TypeDir {
+		times := []unix.Timespec{unix.NsecToTimespec(hdr.AccessTime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+		if hdr.AccessTime.IsZero() {
+			times[0] = times[1]
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "set times", Path: target, Err: err}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// entry is a file of a test layer: a directory when name ends in "/", a
+// symlink or hard link when link is set, a regular file otherwise
+type entry struct {
+	name     string
+	link     string
+	hardLink bool
+}
+
+// makeTar returns a tarball with the entries, file contents are their names
+func makeTar(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Uid: os.Getuid(), Gid: os.Getgid()}
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		case e.hardLink:
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, e.link
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		default:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tree lists the files below root, with the contents of regular files and
+// the targets of symlinks
+func tree(t *testing.T, root string) []string {
+	t.Helper()
+
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case d.IsDir():
+			rel += "/"
+		case d.Type()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			rel += " -> " + target
+		default:
+			data, _ := os.ReadFile(path)
+			rel += " = " + string(data)
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestUnpack(t *testing.T) {
+	base := []entry{
+		{name: "etc/"},
+		{name: "etc/passwd"},
+		{name: "bin/sh"},
+		{name: "bin/ls"},
+		{name: "usr/lib/"},
+		{name: "lib", link: "usr/lib"},
+		{name: "var/cache/old"},
+		{name: "abs", link: "/etc"},
+	}
+
+	tests := []struct {
+		name     string
+		layer    []entry
+		expected []string
+	}{
+		{
+			name:  "whiteout",
+			layer: []entry{{name: "bin/.wh.sh"}, {name: "etc/.wh.missing"}},
+			expected: []string{
+				"abs -> /etc", "bin/", "bin/ls = bin/ls", "etc/", "etc/passwd = etc/passwd",
+				"lib -> usr/lib", "usr/", "usr/lib/", "var/", "var/cache/", "var/cache/old = var/cache/old",
+			},
+		},
+		{
+			name:  "opaque keeps this layer",
+			layer: []entry{{name: "var/cache/new"}, {name: "var/cache/.wh..wh..opq"}},
+			expected: []string{
+				"abs -> /etc", "bin/", "bin/ls = bin/ls", "bin/sh = bin/sh", "etc/", "etc/passwd = etc/passwd",
+				"lib -> usr/lib", "usr/", "usr/lib/", "var/", "var/cache/", "var/cache/new = var/cache/new",
+			},
+		},
+		{
+			name:  "symlinks resolve in the rootfs",
+			layer: []entry{{name: "lib/libc.so"}, {name: "abs/hosts"}, {name: "../../escape"}},
+			expected: []string{
+				"abs -> /etc", "bin/", "bin/ls = bin/ls", "bin/sh = bin/sh", "escape = ../../escape",
+				"etc/", "etc/hosts = abs/hosts", "etc/passwd = etc/passwd", "lib -> usr/lib", "usr/",
+				"usr/lib/", "usr/lib/libc.so = lib/libc.so", "var/", "var/cache/", "var/cache/old = var/cache/old",
+			},
+		},
+		{
+			name:  "replace file and symlink",
+			layer: []entry{{name: "bin/sh", link: "ls"}, {name: "lib/"}, {name: "etc/passwd", link: "bin/ls", hardLink: true}},
+			expected: []string{
+				"abs -> /etc", "bin/", "bin/ls = bin/ls", "bin/sh -> ls", "etc/", "etc/passwd = bin/ls",
+				"lib/", "usr/", "usr/lib/", "var/", "var/cache/", "var/cache/old = var/cache/old",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, layer := range [][]entry{base, tt.layer} {
+				tr := tar.NewReader(bytes.NewReader(makeTar(t, layer...)))
+				if err := unpack(root, tr); err != nil {
+					t.Fatalf("unpack() error = %v", err)
+				}
+			}
+
+			got := tree(t, root)
+			if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("rootfs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestUnpackInvalidWhiteout(t *testing.T) {
+	tr := tar.NewReader(bytes.NewReader(makeTar(t, entry{name: "etc/.wh.."})))
+	if err := unpack(t.TempDir(), tr); err == nil {
+		t.Error("unpack() succeeded, want an error")
+	}
+}
+
+func TestApplyLayer(t *testing.T) {
+	layer := makeTar(t, entry{name: "etc/hostname"})
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(layer)
+	gz.Close()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdLayer := encoder.EncodeAll(layer, nil)
+
+	digest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	other := digest([]byte("other"))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		layer   Layer
+		wantErr bool
+	}{
+		{"plain", layer, Layer{DiffID: digest(layer)}, false},
+		{"gzip", compressed.Bytes(), Layer{Digest: digest(compressed.Bytes()), Size: int64(compressed.Len()), DiffID: digest(layer)}, false},
+		{"unverified", compressed.Bytes(), Layer{}, false},
+		{"wrong digest", compressed.Bytes(), Layer{Digest: other}, true},
+		{"wrong size", compressed.Bytes(), Layer{Digest: digest(compressed.Bytes()), Size: 1}, true},
+		{"wrong diff id", compressed.Bytes(), Layer{DiffID: other}, true},
+		{"zstd", zstdLayer, Layer{Digest: digest(zstdLayer), Size: int64(len(zstdLayer)), DiffID: digest(layer)}, false},
+		{"corrupt zstd", append([]byte{0x28, 0xb5, 0x2f, 0xfd}, layer...), Layer{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.layer.Path = filepath.Join(dir, "layer")
+			if err := os.WriteFile(tt.layer.Path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			root := filepath.Join(dir, "rootfs")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ApplyLayer(root, tt.layer)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("ApplyLayer() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyLayer() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "etc/hostname")); err != nil {
+				t.Errorf("layer not unpacked: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyLayerZstdFixture(t *testing.T) {
+	// Compressed by the zstd command, DiffID of the tarball inside
+	layer := Layer{
+		Path:   filepath.Join("testdata", "layer.tar.zst"),
+		Digest: "sha256:00cbf72b0c94adda1e020b73c334736609345184e668f73021e60a0c760d3476",
+		Size:   149,
+		DiffID: "sha256:a3bc06e198fa70a29ec7658e3c96edd1bf00c500ba2662bfddfa5a291e2e3261",
+	}
+
+	root := t.TempDir()
+	if err := ApplyLayer(root, layer); err != nil {
+		t.Fatalf("ApplyLayer() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "etc/issue"))
+	if err != nil || string(data) != "ID=zstd-fixture\n" {
+		t.Errorf("etc/issue = %q, %v, want the os-release it links to", data, err)
+	}
+}
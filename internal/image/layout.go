@@ -0,0 +1,350 @@
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gomini/internal/util"
+)
+
+// Media types of the OCI image format and their Docker equivalents
+const (
+	MediaTypeIndex          = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// RefAnnotation names an image in the index of a layout
+const RefAnnotation = "org.opencontainers.image.ref.name"
+
+// Descriptor points to a blob by its digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform is the system an image is built for
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses "os/arch" with an optional "/variant"
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, util.NewSimpleError("parse platform", fmt.Sprintf("invalid platform %q, expected os/arch[/variant]", s))
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// matches reports whether an image for p runs on want. A variant is only
+// compared when one is asked for.
+func (p Platform) matches(want Platform) bool {
+	return p.OS == want.OS && p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant)
+}
+
+// Index lists the manifests of a layout or of a multi-platform image
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest lists the configuration and layers of an image
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Config is the part of an image configuration a bundle is made from
+type Config struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	Config       struct {
+		User       string   `json:"User"`
+		Env        []string `json:"Env"`
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+		WorkingDir string   `json:"WorkingDir"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Layer is a layer tarball to unpack. Digest and Size, when set, are checked
+// against the blob as stored, DiffID against the uncompressed tarball.
+type Layer struct {
+	Path   string
+	Digest string
+	Size   int64
+	DiffID string
+}
+
+// Layout is an OCI image layout directory with an index.json and the blobs
+// it refers to under blobs/<algorithm>/<hex>
+type Layout struct {
+	Dir string
+}
+
+// OpenLayout checks that dir holds an OCI image layout
+func OpenLayout(dir string) (*Layout, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		return nil, util.NewPathError("open image layout", dir, err)
+	}
+	var marker struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(data, &marker); err != nil || marker.ImageLayoutVersion == "" {
+		return nil, util.NewPathError("open image layout", dir, fmt.Errorf("invalid oci-layout file"))
+	}
+	return &Layout{Dir: dir}, nil
+}
+
+// Image resolves the image named ref, or the only image of the layout when
+// ref is empty, for platform. It returns the image configuration and the
+// layers, bottom first, with the digests they are verified against.
+func (l *Layout) Image(ref string, platform Platform) (*Config, []Layer, error) {
+	var index Index
+	if err := readJSON(filepath.Join(l.Dir, "index.json"), &index); err != nil {
+		return nil, nil, util.WrapError("read image index", err)
+	}
+
+	candidates, err := selectRef(index.Manifests, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, config, err := l.resolve(candidates, platform)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, nil, util.NewSimpleError("resolve image", fmt.Sprintf("image config lists %d layers, manifest %d", len(config.RootFS.DiffIDs), len(manifest.Layers)))
+	}
+	var layers []Layer
+	for i, desc := range manifest.Layers {
+		path, err := l.blobPath(desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		layers = append(layers, Layer{Path: path, Digest: desc.Digest, Size: desc.Size, DiffID: config.RootFS.DiffIDs[i]})
+	}
+
+	return config, layers, nil
+}
+
+// selectRef returns the index entries for ref. Without a ref all entries are
+// taken as long as they name at most one image.
+func selectRef(manifests []Descriptor, ref string) ([]Descriptor, error) {
+	var selected []Descriptor
+	names := make(map[string]bool)
+	for _, desc := range manifests {
+		name := desc.Annotations[RefAnnotation]
+		if name != "" {
+			names[name] = true
+		}
+		if ref == "" || name == ref {
+			selected = append(selected, desc)
+		}
+	}
+
+	var available []string
+	for name := range names {
+		available = append(available, name)
+	}
+	sort.Strings(available)
+	if ref == "" && len(names) > 1 {
+		return nil, util.NewSimpleError("resolve image", fmt.Sprintf("layout holds several images, select one of %s", strings.Join(available, ", ")))
+	}
+	if len(selected) == 0 {
+		if ref != "" {
+			return nil, util.NewSimpleError("resolve image", fmt.Sprintf("no image %q in layout (available: %s)", ref, strings.Join(available, ", ")))
+		}
+		return nil, util.NewSimpleError("resolve image", "layout index lists no images")
+	}
+	return selected, nil
+}
+
+// resolve returns the first manifest among descs, nested indexes included,
+// for an image built for platform
+func (l *Layout) resolve(descs []Descriptor, platform Platform) (*Manifest, *Config, error) {
+	var found []string
+	for _, desc := range descs {
+		if desc.Platform != nil && !desc.Platform.matches(platform) {
+			found = append(found, desc.Platform.String())
+			continue
+		}
+
+		switch desc.MediaType {
+		case MediaTypeIndex, MediaTypeDockerList:
+			var index Index
+			if err := l.readBlob(desc, &index); err != nil {
+				return nil, nil, err
+			}
+			return l.resolve(index.Manifests, platform)
+		case MediaTypeManifest, MediaTypeDockerManifest:
+			var manifest Manifest
+			if err := l.readBlob(desc, &manifest); err != nil {
+				return nil, nil, err
+			}
+			var config Config
+			if err := l.readBlob(manifest.Config, &config); err != nil {
+				return nil, nil, err
+			}
+			p := Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+			if !p.matches(platform) {
+				found = append(found, p.String())
+				continue
+			}
+			return &manifest, &config, nil
+		default:
+			return nil, nil, util.NewSimpleError("resolve image", fmt.Sprintf("unsupported media type %q", desc.MediaType))
+		}
+	}
+
+	message := fmt.Sprintf("no image for %s", platform)
+	if len(found) > 0 {
+		message += fmt.Sprintf(" (found: %s)", strings.Join(found, ", "))
+	}
+	return nil, nil, util.NewSimpleError("resolve image", message)
+}
+
+// readBlob reads the JSON blob desc points to into v after verifying it
+func (l *Layout) readBlob(desc Descriptor, v interface{}) error {
+	path, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if err := VerifyBlob(path, desc.Digest, desc.Size); err != nil {
+		return err
+	}
+	return readJSON(path, v)
+}
+
+// blobPath returns the path of the blob with digest in the layout
+func (l *Layout) blobPath(digest string) (string, error) {
+	algorithm, encoded, err := parseDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, "blobs", algorithm, encoded), nil
+}
+
+// VerifyBlob checks the size, unless negative, and the digest of the file
+// at path
+func VerifyBlob(path, digest string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return util.NewPathError("verify blob", path, err)
+	}
+	defer file.Close()
+
+	verifier, err := newVerifier(digest)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(verifier, file)
+	if err != nil {
+		return util.NewPathError("verify blob", path, err)
+	}
+	if size >= 0 && n != size {
+		return util.NewPathError("verify blob", path, fmt.Errorf("size is %d bytes, expected %d", n, size))
+	}
+	if err := verifier.verify(); err != nil {
+		return util.NewPathError("verify blob", path, err)
+	}
+	return nil
+}
+
+// verifier hashes what is written to it to compare it with a digest
+type verifier struct {
+	hash.Hash
+	digest string
+}
+
+func newVerifier(digest string) (*verifier, error) {
+	algorithm, _, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{digest: digest}
+	switch algorithm {
+	case "sha256":
+		v.Hash = sha256.New()
+	case "sha512":
+		v.Hash = sha512.New()
+	}
+	return v, nil
+}
+
+func (v *verifier) verify() error {
+	algorithm, _, _ := strings.Cut(v.digest, ":")
+	actual := algorithm + ":" + hex.EncodeToString(v.Sum(nil))
+	if actual != v.digest {
+		return fmt.Errorf("content has digest %s, expected %s", actual, v.digest)
+	}
+	return nil
+}
+
+// parseDigest splits "algorithm:hex", which also becomes a path in the layout
+func parseDigest(digest string) (algorithm, encoded string, err error) {
+	algorithm, encoded, _ = strings.Cut(digest, ":")
+	lengths := map[string]int{"sha256": 64, "sha512": 128}
+	length, known := lengths[algorithm]
+	valid := known && len(encoded) == length
+	for _, c := range encoded {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			valid = false
+		}
+	}
+	if !valid {
+		return "", "", util.NewSimpleError("parse digest", fmt.Sprintf("unsupported or invalid digest %q", digest))
+	}
+	return algorithm, encoded, nil
+}
+
+// readJSON unmarshals the file at path into v
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return util.NewPathError("read", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return util.NewPathError("parse", path, err)
+	}
+	return nil
+}
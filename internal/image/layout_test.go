@@ -0,0 +1,175 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gomini/internal/spec"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Platform
+		wantErr  bool
+	}{
+		{"linux/amd64", Platform{OS: "linux", Architecture: "amd64"}, false},
+		{"linux/arm64/v8", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, false},
+		{"linux", Platform{}, true},
+		{"linux/", Platform{}, true},
+		{"/amd64", Platform{}, true},
+		{"linux/arm/v7/extra", Platform{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParsePlatform(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParsePlatform() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	arm := Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	tests := []struct {
+		name     string
+		want     Platform
+		expected bool
+	}{
+		{"any variant", Platform{OS: "linux", Architecture: "arm"}, true},
+		{"same variant", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"other variant", Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{"other architecture", Platform{OS: "linux", Architecture: "arm64"}, false},
+		{"other os", Platform{OS: "windows", Architecture: "arm"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := arm.matches(tt.want); got != tt.expected {
+				t.Errorf("matches(%s) = %v, want %v", tt.want, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	sha256Hex := strings.Repeat("ab", 32)
+	sha512Hex := strings.Repeat("cd", 64)
+
+	tests := []struct {
+		digest    string
+		algorithm string
+		wantErr   bool
+	}{
+		{"sha256:" + sha256Hex, "sha256", false},
+		{"sha512:" + sha512Hex, "sha512", false},
+		{"sha256:" + sha256Hex[:62], "", true},
+		{"sha256:" + strings.ToUpper(sha256Hex), "", true},
+		{"sha256:../../" + sha256Hex[6:], "", true},
+		{"md5:" + sha256Hex, "", true},
+		{sha256Hex, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.digest, func(t *testing.T) {
+			algorithm, _, err := parseDigest(tt.digest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if algorithm != tt.algorithm {
+				t.Errorf("parseDigest() algorithm = %q, want %q", algorithm, tt.algorithm)
+			}
+		})
+	}
+}
+
+func TestSelectRef(t *testing.T) {
+	named := func(name string) Descriptor {
+		return Descriptor{Digest: name, Annotations: map[string]string{RefAnnotation: name}}
+	}
+
+	tests := []struct {
+		name      string
+		manifests []Descriptor
+		ref       string
+		expected  []string
+		wantErr   bool
+	}{
+		{"only image", []Descriptor{named("app:1")}, "", []string{"app:1"}, false},
+		{"unnamed image", []Descriptor{{Digest: "a"}}, "", []string{"a"}, false},
+		{"one image for several platforms", []Descriptor{named("app:1"), named("app:1")}, "", []string{"app:1", "app:1"}, false},
+		{"by ref", []Descriptor{named("app:1"), named("app:2")}, "app:2", []string{"app:2"}, false},
+		{"ambiguous", []Descriptor{named("app:1"), named("app:2")}, "", nil, true},
+		{"unknown ref", []Descriptor{named("app:1")}, "app:3", nil, true},
+		{"empty index", nil, "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := selectRef(tt.manifests, tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, desc := range selected {
+				got = append(got, desc.Digest)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("selectRef() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\nbroken:x:abc:1\n",
+		"etc/group":  "root:x:0:\nstaff:x:50:app\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(rootfs, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		user     string
+		expected spec.User
+		wantErr  bool
+	}{
+		{"", spec.User{}, false},
+		{"app", spec.User{Username: "app"}, false},
+		{"1000", spec.User{UID: 1000, GID: 1000}, false},
+		{"4242", spec.User{UID: 4242}, false},
+		{"app:staff", spec.User{UID: 1000, GID: 50}, false},
+		{"app:7", spec.User{UID: 1000, GID: 7}, false},
+		{"1000:50", spec.User{UID: 1000, GID: 50}, false},
+		{"nobody:staff", spec.User{}, true},
+		{"app:nogroup", spec.User{}, true},
+		{"broken:0", spec.User{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			got, err := processUser(rootfs, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.UID != tt.expected.UID || got.GID != tt.expected.GID || got.Username != tt.expected.Username) {
+				t.Errorf("processUser() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
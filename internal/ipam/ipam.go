@@ -0,0 +1,187 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+const leaseFile = "ipam.json"
+
+// Allocator hands out IPv4 addresses from bridge subnets and records them as
+// leases in a JSON file. A lock file serializes concurrent gomini processes.
+// The first address of a subnet is the gateway and is never leased.
+type Allocator struct {
+	Path string
+}
+
+// leases maps subnet to address to the container ID holding the lease
+type leases map[string]map[string]string
+
+// NewAllocator creates an allocator keeping its leases in the given directory
+func NewAllocator(dir string) *Allocator {
+	return &Allocator{Path: filepath.Join(dir, leaseFile)}
+}
+
+// Allocate returns the address leased to the container in the subnet,
+// leasing the lowest free address if it has none yet
+func (a *Allocator) Allocate(subnet netip.Prefix, containerID string) (netip.Addr, error) {
+	subnet = subnet.Masked()
+	var allocated netip.Addr
+
+	err := a.update(func(l leases) error {
+		taken := l[subnet.String()]
+		if taken == nil {
+			taken = make(map[string]string)
+			l[subnet.String()] = taken
+		}
+
+		for addr, id := range taken {
+			if id == containerID {
+				allocated = netip.MustParseAddr(addr)
+				return nil
+			}
+		}
+
+		gateway := subnet.Addr().Next()
+		broadcast := lastAddr(subnet)
+		for addr := gateway.Next(); addr.IsValid() && addr.Less(broadcast); addr = addr.Next() {
+			if _, ok := taken[addr.String()]; !ok {
+				taken[addr.String()] = containerID
+				allocated = addr
+				return nil
+			}
+		}
+
+		return util.NewSimpleError("allocate address", fmt.Sprintf("subnet %s is exhausted", subnet))
+	})
+
+	return allocated, err
+}
+
+// Release drops every lease held by the container
+func (a *Allocator) Release(containerID string) error {
+	if _, err := os.Stat(a.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return a.update(func(l leases) error {
+		for _, taken := range l {
+			for addr, id := range taken {
+				if id == containerID {
+					delete(taken, addr)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Prune drops the leases of containers for which active returns false, such
+// as containers whose gomini process was killed before it could clean up
+func (a *Allocator) Prune(active func(containerID string) bool) error {
+	if _, err := os.Stat(a.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return a.update(func(l leases) error {
+		for _, taken := range l {
+			for addr, id := range taken {
+				if !active(id) {
+					delete(taken, addr)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// update runs fn on the current leases under the lock and saves the result
+func (a *Allocator) update(fn func(leases) error) error {
+	if err := os.MkdirAll(filepath.Dir(a.Path), 0711); err != nil {
+		return util.NewPathError("create ipam directory", filepath.Dir(a.Path), err)
+	}
+
+	lockPath := a.Path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return util.NewPathError("open ipam lock", lockPath, err)
+	}
+	defer lock.Close()
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return util.NewPathError("lock ipam", lockPath, err)
+	}
+
+	l, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(l); err != nil {
+		return err
+	}
+
+	return a.save(l)
+}
+
+// load reads the lease file, which may not exist yet
+func (a *Allocator) load() (leases, error) {
+	l := make(leases)
+
+	data, err := os.ReadFile(a.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, util.NewPathError("read leases", a.Path, err)
+	}
+
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, util.NewPathError("parse leases", a.Path, err)
+	}
+
+	return l, nil
+}
+
+// save atomically replaces the lease file
+func (a *Allocator) save(l leases) error {
+	for subnet, taken := range l {
+		if len(taken) == 0 {
+			delete(l, subnet)
+		}
+	}
+
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return util.NewError("marshal leases", err)
+	}
+
+	tmp := a.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return util.NewPathError("write leases", tmp, err)
+	}
+	if err := os.Rename(tmp, a.Path); err != nil {
+		return util.NewPathError("rename leases", a.Path, err)
+	}
+
+	return nil
+}
+
+// lastAddr returns the broadcast address of an IPv4 subnet
+func lastAddr(subnet netip.Prefix) netip.Addr {
+	b := subnet.Addr().As4()
+	hostBits := 32 - subnet.Bits()
+	for i := 3; i >= 0 && hostBits > 0; i-- {
+		bits := min(hostBits, 8)
+		b[i] |= byte(1<<bits - 1)
+		hostBits -= bits
+	}
+	return netip.AddrFrom4(b)
+}
@@ -0,0 +1,140 @@
+package ipam
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	subnet := netip.MustParsePrefix("10.88.0.0/29")
+
+	tests := []struct {
+		name     string
+		subnet   netip.Prefix
+		ids      []string
+		expected []string
+	}{
+		{"lowest free after gateway", subnet, []string{"a", "b"}, []string{"10.88.0.2", "10.88.0.3"}},
+		{"same container same address", subnet, []string{"a", "a"}, []string{"10.88.0.2", "10.88.0.2"}},
+		{"unmasked subnet", netip.MustParsePrefix("10.88.0.5/29"), []string{"a"}, []string{"10.88.0.2"}},
+		{"until broadcast", subnet, []string{"a", "b", "c", "d", "e"}, []string{"10.88.0.2", "10.88.0.3", "10.88.0.4", "10.88.0.5", "10.88.0.6"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocator := NewAllocator(t.TempDir())
+			for i, id := range tt.ids {
+				addr, err := allocator.Allocate(tt.subnet, id)
+				if err != nil {
+					t.Fatalf("Allocate(%s) error = %v", id, err)
+				}
+				if addr.String() != tt.expected[i] {
+					t.Errorf("Allocate(%s) = %s, want %s", id, addr, tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateExhausted(t *testing.T) {
+	allocator := NewAllocator(t.TempDir())
+	subnet := netip.MustParsePrefix("10.88.0.0/30")
+
+	if _, err := allocator.Allocate(subnet, "a"); err != nil {
+		t.Fatalf("Allocate(a) error = %v", err)
+	}
+	if addr, err := allocator.Allocate(subnet, "b"); err == nil {
+		t.Errorf("Allocate(b) = %s, want an exhausted subnet", addr)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	allocator := NewAllocator(t.TempDir())
+	subnet := netip.MustParsePrefix("10.88.0.0/24")
+	other := netip.MustParsePrefix("10.89.0.0/24")
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := allocator.Allocate(subnet, id); err != nil {
+			t.Fatalf("Allocate(%s) error = %v", id, err)
+		}
+	}
+	if _, err := allocator.Allocate(other, "a"); err != nil {
+		t.Fatalf("Allocate(a) error = %v", err)
+	}
+
+	if err := allocator.Release("a"); err != nil {
+		t.Fatalf("Release(a) error = %v", err)
+	}
+
+	// The lowest address is free again, b keeps its own
+	tests := []struct {
+		subnet   netip.Prefix
+		id       string
+		expected string
+	}{
+		{subnet, "b", "10.88.0.3"},
+		{subnet, "c", "10.88.0.2"},
+		{other, "c", "10.89.0.2"},
+	}
+	for _, tt := range tests {
+		addr, err := allocator.Allocate(tt.subnet, tt.id)
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", tt.id, err)
+		}
+		if addr.String() != tt.expected {
+			t.Errorf("Allocate(%s, %s) = %s, want %s", tt.subnet, tt.id, addr, tt.expected)
+		}
+	}
+}
+
+func TestReleaseWithoutLeases(t *testing.T) {
+	allocator := NewAllocator(t.TempDir())
+	if err := allocator.Release("a"); err != nil {
+		t.Errorf("Release() error = %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	allocator := NewAllocator(t.TempDir())
+	subnet := netip.MustParsePrefix("10.88.0.0/24")
+
+	for _, id := range []string{"gone", "alive"} {
+		if _, err := allocator.Allocate(subnet, id); err != nil {
+			t.Fatalf("Allocate(%s) error = %v", id, err)
+		}
+	}
+
+	if err := allocator.Prune(func(id string) bool { return id == "alive" }); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+
+	addr, err := allocator.Allocate(subnet, "new")
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if addr.String() != "10.88.0.2" {
+		t.Errorf("Allocate() = %s, want the pruned 10.88.0.2", addr)
+	}
+}
+
+func TestLastAddr(t *testing.T) {
+	tests := []struct {
+		subnet   string
+		expected string
+	}{
+		{"10.88.0.0/16", "10.88.255.255"},
+		{"10.88.0.0/24", "10.88.0.255"},
+		{"10.88.0.0/29", "10.88.0.7"},
+		{"10.88.0.0/20", "10.88.15.255"},
+		{"10.0.0.0/8", "10.255.255.255"},
+		{"10.88.0.4/32", "10.88.0.4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.subnet, func(t *testing.T) {
+			if got := lastAddr(netip.MustParsePrefix(tt.subnet)); got.String() != tt.expected {
+				t.Errorf("lastAddr(%s) = %s, want %s", tt.subnet, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package net
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gomini/internal/fs"
+	"gomini/internal/util"
+)
+
+// Network files generated for a bridged container
+const (
+	hostsFile  = "hosts"
+	resolvFile = "resolv.conf"
+)
+
+// WriteEtcFiles writes the container's hosts and resolv.conf into dir, from
+// where EtcMounts shows them at /etc, so the container can resolve its own
+// name and reach the host's DNS servers without its rootfs being modified
+func WriteEtcFiles(dir, hostname string, address netip.Addr) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return util.NewPathError("create directory", dir, err)
+	}
+
+	hosts := "127.0.0.1\tlocalhost\n" +
+		"::1\tlocalhost ip6-localhost ip6-loopback\n"
+	if hostname != "" {
+		hosts += fmt.Sprintf("%s\t%s\n", address, hostname)
+	}
+	if err := writeEtcFile(filepath.Join(dir, hostsFile), hosts); err != nil {
+		return err
+	}
+
+	resolv, nameservers := resolvConf("/etc/resolv.conf")
+	if nameservers == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the host has no nameserver reachable from the container, DNS will not work\n")
+	}
+	return writeEtcFile(filepath.Join(dir, resolvFile), resolv)
+}
+
+// EtcMounts returns the read-only bind mounts of the files written by
+// WriteEtcFiles over /etc/hosts and /etc/resolv.conf
+func EtcMounts(dir string) []fs.MountPoint {
+	options := []string{"bind", "ro", "nosuid", "nodev", "noexec"}
+	return []fs.MountPoint{
+		fs.NewMountPoint(filepath.Join(dir, hostsFile), "/etc/hosts", "bind", options),
+		fs.NewMountPoint(filepath.Join(dir, resolvFile), "/etc/resolv.conf", "bind", options),
+	}
+}
+
+// resolvConf derives the container's resolv.conf from the host's, dropping
+// loopback nameservers such as the systemd-resolved stub, and returns it
+// with the number of nameservers left
+func resolvConf(hostPath string) (string, int) {
+	var lines []string
+	nameservers := 0
+
+	if f, err := os.Open(hostPath); err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				addr, err := netip.ParseAddr(fields[1])
+				if err != nil || addr.IsLoopback() {
+					continue
+				}
+				nameservers++
+			case "search", "domain", "options":
+			default:
+				continue
+			}
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+
+	if len(lines) == 0 {
+		return "", 0
+	}
+	return strings.Join(lines, "\n") + "\n", nameservers
+}
+
+// writeEtcFile writes one of the generated network files
+func writeEtcFile(path, content string) error {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return util.NewPathError("write file", path, err)
+	}
+
+	return nil
+}
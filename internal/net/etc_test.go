@@ -0,0 +1,126 @@
+package net
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvConf(t *testing.T) {
+	tests := []struct {
+		name        string
+		host        string
+		expected    string
+		nameservers int
+	}{
+		{
+			name:        "copied",
+			host:        "nameserver 192.0.2.53\nsearch example.com\noptions ndots:2\n",
+			expected:    "nameserver 192.0.2.53\nsearch example.com\noptions ndots:2\n",
+			nameservers: 1,
+		},
+		{
+			name:        "loopback dropped",
+			host:        "nameserver 127.0.0.53\nnameserver ::1\nnameserver 2001:db8::53\n",
+			expected:    "nameserver 2001:db8::53\n",
+			nameservers: 1,
+		},
+		{
+			name:        "comments and unknown keys dropped",
+			host:        "# generated\nnameserver   192.0.2.53  \nsortlist 10.0.0.0\nnameserver bogus\n",
+			expected:    "nameserver 192.0.2.53\n",
+			nameservers: 1,
+		},
+		{
+			name:        "only loopback",
+			host:        "nameserver 127.0.0.53\nsearch example.com\n",
+			expected:    "search example.com\n",
+			nameservers: 0,
+		},
+		{
+			name:        "empty",
+			host:        "",
+			expected:    "",
+			nameservers: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resolv.conf")
+			if err := os.WriteFile(path, []byte(tt.host), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, nameservers := resolvConf(path)
+			if got != tt.expected {
+				t.Errorf("resolvConf() = %q, want %q", got, tt.expected)
+			}
+			if nameservers != tt.nameservers {
+				t.Errorf("resolvConf() nameservers = %d, want %d", nameservers, tt.nameservers)
+			}
+		})
+	}
+}
+
+func TestResolvConfMissing(t *testing.T) {
+	if got, nameservers := resolvConf(filepath.Join(t.TempDir(), "missing")); got != "" || nameservers != 0 {
+		t.Errorf("resolvConf() = %q, %d, want nothing", got, nameservers)
+	}
+}
+
+func TestWriteEtcFilesHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		expected string
+	}{
+		{"with hostname", "web", "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n10.88.0.2\tweb\n"},
+		{"without hostname", "", "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "network")
+			if err := WriteEtcFiles(dir, tt.hostname, netip.MustParseAddr("10.88.0.2")); err != nil {
+				t.Fatalf("WriteEtcFiles() error = %v", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, hostsFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.expected {
+				t.Errorf("hosts = %q, want %q", data, tt.expected)
+			}
+			if _, err := os.Stat(filepath.Join(dir, resolvFile)); err != nil {
+				t.Errorf("resolv.conf not written: %v", err)
+			}
+		})
+	}
+}
+
+func TestEtcMounts(t *testing.T) {
+	mounts := EtcMounts("/run/gomini/c/network")
+
+	expected := map[string]string{
+		"/etc/hosts":       "/run/gomini/c/network/hosts",
+		"/etc/resolv.conf": "/run/gomini/c/network/resolv.conf",
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("EtcMounts() returned %d mounts, want %d", len(mounts), len(expected))
+	}
+	for _, mount := range mounts {
+		if expected[mount.Destination] != mount.Source {
+			t.Errorf("mount of %s at %s, want %s", mount.Source, mount.Destination, expected[mount.Destination])
+		}
+		readonly := false
+		for _, option := range mount.Options {
+			readonly = readonly || option == "ro"
+		}
+		if !readonly {
+			t.Errorf("mount at %s is not read-only: %v", mount.Destination, mount.Options)
+		}
+	}
+}
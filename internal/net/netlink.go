@@ -0,0 +1,280 @@
+package net
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// vethInfoPeer is VETH_INFO_PEER from linux/veth.h
+const vethInfoPeer = 1
+
+// attribute is a netlink route attribute with optional nested attributes
+type attribute struct {
+	typ      uint16
+	data     []byte
+	children []attribute
+}
+
+// encode serializes the attribute, padded to the netlink alignment
+func (a attribute) encode() []byte {
+	payload := append([]byte{}, a.data...)
+	for _, child := range a.children {
+		payload = append(payload, child.encode()...)
+	}
+
+	length := unix.SizeofRtAttr + len(payload)
+	b := make([]byte, nlmAlign(length))
+	binary.NativeEndian.PutUint16(b[0:], uint16(length))
+	binary.NativeEndian.PutUint16(b[2:], a.typ)
+	copy(b[unix.SizeofRtAttr:], payload)
+	return b
+}
+
+// stringAttr encodes a NUL-terminated string attribute
+func stringAttr(typ uint16, value string) attribute {
+	return attribute{typ: typ, data: append([]byte(value), 0)}
+}
+
+// uint32Attr encodes a 32-bit attribute
+func uint32Attr(typ uint16, value uint32) attribute {
+	data := make([]byte, 4)
+	binary.NativeEndian.PutUint32(data, value)
+	return attribute{typ: typ, data: data}
+}
+
+// nlmAlign rounds a length up to the 4-byte netlink alignment
+func nlmAlign(length int) int {
+	return (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
+
+// ifInfomsg encodes the struct ifinfomsg header of link requests
+func ifInfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:], flags)
+	binary.NativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// conn is a NETLINK_ROUTE socket bound to the network namespace of the
+// thread that opened it
+type conn struct {
+	fd  int
+	seq uint32
+}
+
+// dial opens a routing netlink socket
+func dial() (*conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, util.NewError("open netlink socket", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, util.NewError("bind netlink socket", err)
+	}
+
+	return &conn{fd: fd}, nil
+}
+
+// Close closes the socket
+func (c *conn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// request is a netlink request without its sequence number
+type request struct {
+	msgType uint16
+	flags   uint16
+	header  []byte
+	attrs   []attribute
+}
+
+// newRequest builds a request that asks the kernel for an acknowledgement
+func newRequest(msgType, flags uint16, header []byte, attrs ...attribute) request {
+	return request{msgType: msgType, flags: flags | unix.NLM_F_REQUEST | unix.NLM_F_ACK, header: header, attrs: attrs}
+}
+
+// encode serializes the request with the given sequence number
+func (r request) encode(seq uint32) []byte {
+	payload := append([]byte{}, r.header...)
+	for _, attr := range r.attrs {
+		payload = append(payload, attr.encode()...)
+	}
+
+	msg := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	binary.NativeEndian.PutUint16(msg[4:], r.msgType)
+	binary.NativeEndian.PutUint16(msg[6:], r.flags)
+	binary.NativeEndian.PutUint32(msg[8:], seq)
+	return append(msg, payload...)
+}
+
+// execute sends a request and waits for the kernel's acknowledgement
+func (c *conn) execute(r request) error {
+	c.seq++
+	msg := r.encode(c.seq)
+
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return util.NewError("send netlink request", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return util.NewError("receive netlink response", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return util.NewError("parse netlink response", err)
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return util.NewSimpleError("parse netlink response", "truncated error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			case unix.NLMSG_DONE:
+				return nil
+			}
+		}
+	}
+}
+
+// linkIndex returns the interface index of a link in the current namespace
+func linkIndex(name string) (int, error) {
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return 0, util.NewError("lookup link "+name, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, util.NewError("open socket", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFINDEX, ifr); err != nil {
+		return 0, util.NewError("lookup link "+name, err)
+	}
+
+	return int(ifr.Uint32()), nil
+}
+
+// addBridge creates a bridge device
+func (c *conn) addBridge(name string) error {
+	err := c.execute(newRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfomsg(0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name),
+		attribute{typ: unix.IFLA_LINKINFO, children: []attribute{
+			stringAttr(unix.IFLA_INFO_KIND, "bridge"),
+		}},
+	))
+	if err != nil {
+		return util.NewError("create bridge "+name, err)
+	}
+	return nil
+}
+
+// addVeth creates a veth pair whose peer end is created directly in the
+// network namespace of the given process
+func (c *conn) addVeth(name, peer string, peerPid int) error {
+	peerInfo := append(ifInfomsg(0, 0, 0), stringAttr(unix.IFLA_IFNAME, peer).encode()...)
+	peerInfo = append(peerInfo, uint32Attr(unix.IFLA_NET_NS_PID, uint32(peerPid)).encode()...)
+
+	err := c.execute(newRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfomsg(0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name),
+		attribute{typ: unix.IFLA_LINKINFO, children: []attribute{
+			stringAttr(unix.IFLA_INFO_KIND, "veth"),
+			{typ: unix.IFLA_INFO_DATA, children: []attribute{
+				{typ: vethInfoPeer, data: peerInfo},
+			}},
+		}},
+	))
+	if err != nil {
+		return util.NewError("create veth "+name, err)
+	}
+	return nil
+}
+
+// deleteLink removes a link
+func (c *conn) deleteLink(index int) error {
+	if err := c.execute(newRequest(unix.RTM_DELLINK, 0, ifInfomsg(index, 0, 0))); err != nil {
+		return util.NewError("delete link", err)
+	}
+	return nil
+}
+
+// setMaster attaches a link to a bridge
+func (c *conn) setMaster(index, master int) error {
+	if err := c.execute(newRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, 0, 0), uint32Attr(unix.IFLA_MASTER, uint32(master)))); err != nil {
+		return util.NewError("set link master", err)
+	}
+	return nil
+}
+
+// setUp brings a link up
+func (c *conn) setUp(index int) error {
+	if err := c.execute(linkUpRequest(index)); err != nil {
+		return util.NewError("set link up", err)
+	}
+	return nil
+}
+
+// linkUpRequest builds the request that sets IFF_UP on a link
+func linkUpRequest(index int) request {
+	return newRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, unix.IFF_UP, unix.IFF_UP))
+}
+
+// addAddress assigns an IPv4 address to a link
+func (c *conn) addAddress(index int, prefix netip.Prefix) error {
+	header := make([]byte, unix.SizeofIfAddrmsg)
+	header[0] = unix.AF_INET
+	header[1] = uint8(prefix.Bits())
+	header[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(header[4:], uint32(index))
+
+	addr := prefix.Addr().AsSlice()
+	err := c.execute(newRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, header,
+		attribute{typ: unix.IFA_LOCAL, data: addr},
+		attribute{typ: unix.IFA_ADDRESS, data: addr},
+	))
+	if err != nil {
+		return util.NewError("add address "+prefix.String(), err)
+	}
+	return nil
+}
+
+// addDefaultRoute routes all IPv4 traffic through a gateway on a link
+func (c *conn) addDefaultRoute(index int, gateway netip.Addr) error {
+	header := make([]byte, unix.SizeofRtMsg)
+	header[0] = unix.AF_INET
+	header[4] = unix.RT_TABLE_MAIN
+	header[5] = unix.RTPROT_BOOT
+	header[6] = unix.RT_SCOPE_UNIVERSE
+	header[7] = unix.RTN_UNICAST
+
+	err := c.execute(newRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, header,
+		attribute{typ: unix.RTA_GATEWAY, data: gateway.AsSlice()},
+		uint32Attr(unix.RTA_OIF, uint32(index)),
+	))
+	if err != nil {
+		return util.NewError("add default route via "+gateway.String(), err)
+	}
+	return nil
+}
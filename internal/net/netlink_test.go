@@ -0,0 +1,179 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNlmAlign(t *testing.T) {
+	tests := []struct {
+		length   int
+		expected int
+	}{
+		{0, 0},
+		{1, 4},
+		{4, 4},
+		{5, 8},
+		{7, 8},
+		{8, 8},
+		{17, 20},
+	}
+
+	for _, tt := range tests {
+		if got := nlmAlign(tt.length); got != tt.expected {
+			t.Errorf("nlmAlign(%d) = %d, want %d", tt.length, got, tt.expected)
+		}
+	}
+}
+
+// rtattr encodes an attribute header followed by its padded payload
+func rtattr(length, typ uint16, payload ...byte) []byte {
+	b := make([]byte, unix.SizeofRtAttr)
+	binary.NativeEndian.PutUint16(b[0:], length)
+	binary.NativeEndian.PutUint16(b[2:], typ)
+	return append(b, payload...)
+}
+
+func TestAttributeEncode(t *testing.T) {
+	master := make([]byte, 4)
+	binary.NativeEndian.PutUint32(master, 7)
+
+	tests := []struct {
+		name     string
+		attr     attribute
+		expected []byte
+	}{
+		{
+			name:     "empty",
+			attr:     attribute{typ: unix.IFLA_LINKINFO},
+			expected: rtattr(4, unix.IFLA_LINKINFO),
+		},
+		{
+			name:     "string padded",
+			attr:     stringAttr(unix.IFLA_IFNAME, "eth0"),
+			expected: rtattr(9, unix.IFLA_IFNAME, 'e', 't', 'h', '0', 0, 0, 0, 0),
+		},
+		{
+			name:     "string aligned",
+			attr:     stringAttr(unix.IFLA_IFNAME, "lo0"),
+			expected: rtattr(8, unix.IFLA_IFNAME, 'l', 'o', '0', 0),
+		},
+		{
+			name:     "uint32",
+			attr:     uint32Attr(unix.IFLA_MASTER, 7),
+			expected: rtattr(8, unix.IFLA_MASTER, master...),
+		},
+		{
+			name: "nested",
+			attr: attribute{typ: unix.IFLA_LINKINFO, children: []attribute{
+				stringAttr(unix.IFLA_INFO_KIND, "veth"),
+				uint32Attr(unix.IFLA_MASTER, 7),
+			}},
+			expected: append(rtattr(24, unix.IFLA_LINKINFO),
+				append(rtattr(9, unix.IFLA_INFO_KIND, 'v', 'e', 't', 'h', 0, 0, 0, 0),
+					rtattr(8, unix.IFLA_MASTER, master...)...)...),
+		},
+		{
+			name: "data before children",
+			attr: attribute{typ: vethInfoPeer, data: []byte{1, 2}, children: []attribute{
+				{typ: unix.IFLA_IFNAME},
+			}},
+			expected: append(rtattr(10, vethInfoPeer, 1, 2), append(rtattr(4, unix.IFLA_IFNAME), 0, 0)...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.attr.encode()
+			if !bytes.Equal(got, tt.expected) {
+				t.Errorf("encode() = %v, want %v", got, tt.expected)
+			}
+			if len(got)%unix.NLMSG_ALIGNTO != 0 {
+				t.Errorf("encode() length %d is not aligned", len(got))
+			}
+		})
+	}
+}
+
+func TestIfInfomsg(t *testing.T) {
+	b := ifInfomsg(3, unix.IFF_UP, unix.IFF_UP)
+	if len(b) != unix.SizeofIfInfomsg {
+		t.Fatalf("ifInfomsg() length = %d, want %d", len(b), unix.SizeofIfInfomsg)
+	}
+
+	if b[0] != unix.AF_UNSPEC {
+		t.Errorf("family = %d, want AF_UNSPEC", b[0])
+	}
+	if index := binary.NativeEndian.Uint32(b[4:]); index != 3 {
+		t.Errorf("index = %d, want 3", index)
+	}
+	if flags := binary.NativeEndian.Uint32(b[8:]); flags != unix.IFF_UP {
+		t.Errorf("flags = %#x, want IFF_UP", flags)
+	}
+	if change := binary.NativeEndian.Uint32(b[12:]); change != unix.IFF_UP {
+		t.Errorf("change = %#x, want IFF_UP", change)
+	}
+}
+
+func TestRequestEncode(t *testing.T) {
+	req := newRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfomsg(0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, "gomini0"),
+		uint32Attr(unix.IFLA_MASTER, 7),
+	)
+	msg := req.encode(42)
+
+	msgs, err := syscall.ParseNetlinkMessage(msg)
+	if err != nil {
+		t.Fatalf("ParseNetlinkMessage() error = %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("ParseNetlinkMessage() = %d messages, want 1", len(msgs))
+	}
+
+	header := msgs[0].Header
+	if int(header.Len) != len(msg) {
+		t.Errorf("Len = %d, want %d", header.Len, len(msg))
+	}
+	if header.Type != unix.RTM_NEWLINK {
+		t.Errorf("Type = %d, want RTM_NEWLINK", header.Type)
+	}
+	if expected := uint16(unix.NLM_F_CREATE | unix.NLM_F_EXCL | unix.NLM_F_REQUEST | unix.NLM_F_ACK); header.Flags != expected {
+		t.Errorf("Flags = %#x, want %#x", header.Flags, expected)
+	}
+	if header.Seq != 42 {
+		t.Errorf("Seq = %d, want 42", header.Seq)
+	}
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[0])
+	if err != nil {
+		t.Fatalf("ParseNetlinkRouteAttr() error = %v", err)
+	}
+	if len(attrs) != 2 {
+		t.Fatalf("ParseNetlinkRouteAttr() = %d attributes, want 2", len(attrs))
+	}
+	if attrs[0].Attr.Type != unix.IFLA_IFNAME || string(attrs[0].Value) != "gomini0\x00" {
+		t.Errorf("attribute 0 = %d %q, want IFLA_IFNAME \"gomini0\\x00\"", attrs[0].Attr.Type, attrs[0].Value)
+	}
+	if attrs[1].Attr.Type != unix.IFLA_MASTER || binary.NativeEndian.Uint32(attrs[1].Value) != 7 {
+		t.Errorf("attribute 1 = %d %v, want IFLA_MASTER 7", attrs[1].Attr.Type, attrs[1].Value)
+	}
+}
+
+func TestLinkUpRequest(t *testing.T) {
+	msg := linkUpRequest(1).encode(7)
+
+	expected := make([]byte, unix.NLMSG_HDRLEN)
+	binary.NativeEndian.PutUint32(expected[0:], uint32(unix.NLMSG_HDRLEN+unix.SizeofIfInfomsg))
+	binary.NativeEndian.PutUint16(expected[4:], unix.RTM_NEWLINK)
+	binary.NativeEndian.PutUint16(expected[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(expected[8:], 7)
+	expected = append(expected, ifInfomsg(1, unix.IFF_UP, unix.IFF_UP)...)
+
+	if !bytes.Equal(msg, expected) {
+		t.Errorf("linkUpRequest(1).encode(7) = %v, want %v", msg, expected)
+	}
+}
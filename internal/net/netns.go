@@ -0,0 +1,56 @@
+package net
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// InNetns runs fn inside the network namespace of the given process.
+// Namespaces are per thread, so fn runs on a dedicated goroutine locked to
+// its thread. If the original namespace cannot be restored, the goroutine
+// exits still locked and the runtime discards the thread.
+func InNetns(pid int, fn func() error) error {
+	result := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- util.NewError("open current network namespace", err)
+			return
+		}
+		defer unix.Close(origin)
+
+		path := fmt.Sprintf("/proc/%d/ns/net", pid)
+		target, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- util.NewPathError("open network namespace", path, err)
+			return
+		}
+		defer unix.Close(target)
+
+		if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			result <- util.NewPathError("enter network namespace", path, err)
+			return
+		}
+
+		fnErr := fn()
+
+		if err := unix.Setns(origin, unix.CLONE_NEWNET); err != nil {
+			result <- util.NewError("restore network namespace", err)
+			return
+		}
+		runtime.UnlockOSThread()
+
+		result <- fnErr
+	}()
+
+	return <-result
+}
@@ -0,0 +1,207 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// Network modes selected with --net
+const (
+	ModeNone   = "none"   // Own network namespace with only loopback
+	ModeHost   = "host"   // Share the host's network namespace
+	ModeBridge = "bridge" // Own namespace connected to a host bridge via veth
+)
+
+const (
+	DefaultBridge      = "gomini0"
+	DefaultSubnet      = "10.88.0.0/16"
+	ContainerInterface = "eth0"
+)
+
+// Config describes how a container is connected to the network
+type Config struct {
+	Mode   string
+	Bridge string       // Host bridge for ModeBridge
+	Subnet netip.Prefix // IPv4 subnet of the bridge, its first address is the gateway
+
+	// Address is the container's address in Subnet, leased from IPAM
+	Address netip.Addr
+}
+
+// Endpoint describes a container connected to a bridge
+type Endpoint struct {
+	HostInterface string
+	Address       netip.Prefix
+	Gateway       netip.Addr
+}
+
+// NewConfig validates the network mode and bridge settings
+func NewConfig(mode, bridge, subnet string) (*Config, error) {
+	switch mode {
+	case ModeNone, ModeHost, ModeBridge:
+	default:
+		return nil, util.NewSimpleError("network config", fmt.Sprintf("unknown network mode %q (use none, host or bridge)", mode))
+	}
+
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return nil, util.NewError("network config", err)
+	}
+	if !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return nil, util.NewSimpleError("network config", fmt.Sprintf("subnet %s must be IPv4 with room for at least two hosts", subnet))
+	}
+
+	if len(bridge) == 0 || len(bridge) >= unix.IFNAMSIZ {
+		return nil, util.NewSimpleError("network config", fmt.Sprintf("invalid bridge name %q", bridge))
+	}
+
+	return &Config{Mode: mode, Bridge: bridge, Subnet: prefix.Masked()}, nil
+}
+
+// NeedsNamespace reports whether the container gets its own network namespace
+func (c *Config) NeedsNamespace() bool {
+	return c.Mode != ModeHost
+}
+
+// NeedsSetup reports whether the network has to be configured from the host
+// side once the container's network namespace exists
+func (c *Config) NeedsSetup() bool {
+	return c.Mode == ModeBridge
+}
+
+// Setup configures the network namespace of the container init process from
+// the host side. It returns the bridge endpoint in bridge mode.
+func Setup(config *Config, containerID string, pid int) (*Endpoint, error) {
+	if config.Mode == ModeBridge {
+		return setupBridge(config, containerID, pid)
+	}
+	return nil, nil
+}
+
+// setupBridge connects the container to the bridge with a veth pair and
+// configures its address and default route
+func setupBridge(config *Config, containerID string, pid int) (*Endpoint, error) {
+	if !config.Subnet.Contains(config.Address) {
+		return nil, util.NewSimpleError("setup bridge", fmt.Sprintf("address %s is not in subnet %s", config.Address, config.Subnet))
+	}
+
+	gateway := config.Subnet.Addr().Next()
+	endpoint := &Endpoint{
+		HostInterface: hostInterfaceName(containerID),
+		Address:       netip.PrefixFrom(config.Address, config.Subnet.Bits()),
+		Gateway:       gateway,
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	bridgeIndex, err := ensureBridge(c, config.Bridge, netip.PrefixFrom(gateway, config.Subnet.Bits()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.addVeth(endpoint.HostInterface, ContainerInterface, pid); err != nil {
+		return nil, err
+	}
+	hostIndex, err := linkIndex(endpoint.HostInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.setMaster(hostIndex, bridgeIndex)
+	if err == nil {
+		err = c.setUp(hostIndex)
+	}
+	if err == nil {
+		err = InNetns(pid, func() error {
+			return configureContainerSide(endpoint)
+		})
+	}
+	if err != nil {
+		// Deleting the host end removes the container end as well
+		c.deleteLink(hostIndex)
+		return nil, err
+	}
+
+	return endpoint, nil
+}
+
+// ensureBridge returns the bridge's index, creating the bridge with the
+// gateway address if it does not exist yet
+func ensureBridge(c *conn, name string, gateway netip.Prefix) (int, error) {
+	index, err := linkIndex(name)
+	if errors.Is(err, unix.ENODEV) {
+		if err := c.addBridge(name); err != nil {
+			return 0, err
+		}
+		index, err = linkIndex(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.addAddress(index, gateway); err != nil && !errors.Is(err, unix.EEXIST) {
+		return 0, err
+	}
+
+	if err := c.setUp(index); err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+// configureContainerSide sets up the container end of the veth pair; it runs
+// inside the container's network namespace
+func configureContainerSide(endpoint *Endpoint) error {
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	index, err := linkIndex(ContainerInterface)
+	if err != nil {
+		return err
+	}
+	if err := c.addAddress(index, endpoint.Address); err != nil {
+		return err
+	}
+	if err := c.setUp(index); err != nil {
+		return err
+	}
+
+	return c.addDefaultRoute(index, endpoint.Gateway)
+}
+
+// BringUpLoopback brings up lo in the current network namespace. A new
+// network namespace starts with lo down, so even 127.0.0.1 is unreachable.
+func BringUpLoopback() error {
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	index, err := linkIndex("lo")
+	if err != nil {
+		return err
+	}
+
+	return c.setUp(index)
+}
+
+// hostInterfaceName derives the name of the host end of the veth pair
+func hostInterfaceName(containerID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(containerID))
+	return fmt.Sprintf("veth%08x", h.Sum32())
+}
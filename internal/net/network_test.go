@@ -0,0 +1,116 @@
+package net
+
+import (
+	"fmt"
+	gonet "net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNewConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		bridge    string
+		subnet    string
+		expected  netip.Prefix
+		namespace bool
+		setup     bool
+		wantErr   bool
+	}{
+		{name: "none", mode: ModeNone, bridge: DefaultBridge, subnet: DefaultSubnet, expected: netip.MustParsePrefix(DefaultSubnet), namespace: true},
+		{name: "host", mode: ModeHost, bridge: DefaultBridge, subnet: DefaultSubnet, expected: netip.MustParsePrefix(DefaultSubnet)},
+		{name: "bridge", mode: ModeBridge, bridge: DefaultBridge, subnet: DefaultSubnet, expected: netip.MustParsePrefix(DefaultSubnet), namespace: true, setup: true},
+		{name: "subnet masked", mode: ModeBridge, bridge: "br0", subnet: "172.30.4.9/24", expected: netip.MustParsePrefix("172.30.4.0/24"), namespace: true, setup: true},
+		{name: "smallest subnet", mode: ModeBridge, bridge: "br0", subnet: "192.0.2.0/30", expected: netip.MustParsePrefix("192.0.2.0/30"), namespace: true, setup: true},
+		{name: "unknown mode", mode: "macvlan", bridge: DefaultBridge, subnet: DefaultSubnet, wantErr: true},
+		{name: "empty mode", mode: "", bridge: DefaultBridge, subnet: DefaultSubnet, wantErr: true},
+		{name: "subnet without prefix", mode: ModeBridge, bridge: DefaultBridge, subnet: "10.88.0.0", wantErr: true},
+		{name: "ipv6 subnet", mode: ModeBridge, bridge: DefaultBridge, subnet: "fd00::/64", wantErr: true},
+		{name: "subnet too small", mode: ModeBridge, bridge: DefaultBridge, subnet: "192.0.2.0/31", wantErr: true},
+		{name: "empty bridge", mode: ModeBridge, bridge: "", subnet: DefaultSubnet, wantErr: true},
+		{name: "bridge name too long", mode: ModeBridge, bridge: strings.Repeat("b", unix.IFNAMSIZ), subnet: DefaultSubnet, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewConfig(tt.mode, tt.bridge, tt.subnet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if config.Mode != tt.mode || config.Bridge != tt.bridge {
+				t.Errorf("NewConfig() = %s %s, want %s %s", config.Mode, config.Bridge, tt.mode, tt.bridge)
+			}
+			if config.Subnet != tt.expected {
+				t.Errorf("Subnet = %s, want %s", config.Subnet, tt.expected)
+			}
+			if config.NeedsNamespace() != tt.namespace {
+				t.Errorf("NeedsNamespace() = %v, want %v", config.NeedsNamespace(), tt.namespace)
+			}
+			if config.NeedsSetup() != tt.setup {
+				t.Errorf("NeedsSetup() = %v, want %v", config.NeedsSetup(), tt.setup)
+			}
+		})
+	}
+}
+
+func TestHostInterfaceName(t *testing.T) {
+	ids := []string{"a", "b", "web", "web-1", strings.Repeat("x", 200)}
+	seen := map[string]string{}
+
+	for _, id := range ids {
+		name := hostInterfaceName(id)
+		if !strings.HasPrefix(name, "veth") || len(name) != len("veth")+8 {
+			t.Errorf("hostInterfaceName(%q) = %q, want veth and 8 hex digits", id, name)
+		}
+		if len(name) >= unix.IFNAMSIZ {
+			t.Errorf("hostInterfaceName(%q) = %q, longer than an interface name may be", id, name)
+		}
+		if again := hostInterfaceName(id); again != name {
+			t.Errorf("hostInterfaceName(%q) = %q then %q, want the same name", id, name, again)
+		}
+		if other, ok := seen[name]; ok {
+			t.Errorf("hostInterfaceName(%q) = %q, same as for %q", id, name, other)
+		}
+		seen[name] = id
+	}
+}
+
+func TestBringUpLoopback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		// The thread is left locked so it exits with the namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errs <- err
+			return
+		}
+		if err := BringUpLoopback(); err != nil {
+			errs <- err
+			return
+		}
+
+		lo, err := gonet.InterfaceByName("lo")
+		if err == nil && lo.Flags&gonet.FlagUp == 0 {
+			err = fmt.Errorf("lo is down, flags %v", lo.Flags)
+		}
+		errs <- err
+	}()
+
+	if err := <-errs; err != nil {
+		t.Fatalf("BringUpLoopback() error = %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package ns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// nsGetNstype is NS_GET_NSTYPE from linux/nsfs.h
+const nsGetNstype = 0xb703
+
+// joinOrder is the order namespaces are entered in. The user namespace comes
+// first because it decides which capabilities apply to the others, and the
+// mount namespace comes last because entering it changes how paths resolve.
+var joinOrder = []NamespaceType{USER, IPC, UTS, NET, PID, CGROUP, TIME, MOUNT}
+
+// procNames are the names of the namespace files under /proc/<pid>/ns. A
+// new time namespace is only entered on exec, which an init that stays in
+// front of the container command never does, so its children's one counts.
+var procNames = map[NamespaceType]string{
+	USER:   "user",
+	IPC:    "ipc",
+	UTS:    "uts",
+	NET:    "net",
+	PID:    "pid",
+	CGROUP: "cgroup",
+	TIME:   "time_for_children",
+	MOUNT:  "mnt",
+}
+
+// Path is an existing namespace to join instead of creating a new one
+type Path struct {
+	Type NamespaceType
+	Path string
+}
+
+// CloneFlag returns the CLONE_NEW* flag of a namespace type
+func CloneFlag(nsType NamespaceType) uintptr {
+	switch nsType {
+	case UTS:
+		return unix.CLONE_NEWUTS
+	case PID:
+		return unix.CLONE_NEWPID
+	case MOUNT:
+		return unix.CLONE_NEWNS
+	case IPC:
+		return unix.CLONE_NEWIPC
+	case NET:
+		return unix.CLONE_NEWNET
+	case USER:
+		return unix.CLONE_NEWUSER
+	case CGROUP:
+		return unix.CLONE_NEWCGROUP
+	case TIME:
+		return unix.CLONE_NEWTIME
+	}
+	return 0
+}
+
+// SortPaths orders namespaces the way they have to be joined
+func SortPaths(paths []Path) {
+	rank := func(nsType NamespaceType) int {
+		for i, t := range joinOrder {
+			if t == nsType {
+				return i
+			}
+		}
+		return len(joinOrder)
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return rank(paths[i].Type) < rank(paths[j].Type)
+	})
+}
+
+// ProcessPaths returns the namespaces of a process that differ from our own,
+// in the order they have to be joined. Namespaces the kernel does not
+// support are skipped.
+func ProcessPaths(pid int) ([]Path, error) {
+	// Every file below would be missing, which must not read as no namespaces
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d/ns", pid)); err != nil {
+		return nil, util.NewError("read namespaces", err)
+	}
+
+	var paths []Path
+	for _, nsType := range joinOrder {
+		name := procNames[nsType]
+		path := fmt.Sprintf("/proc/%d/ns/%s", pid, name)
+
+		// The link target names the namespace, e.g. net:[4026531840]
+		target, err := os.Readlink(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, util.NewPathError("read namespace", path, err)
+		}
+
+		own, err := os.Readlink("/proc/self/ns/" + name)
+		if err != nil {
+			return nil, util.NewPathError("read namespace", "/proc/self/ns/"+name, err)
+		}
+		if target != own {
+			paths = append(paths, Path{Type: nsType, Path: path})
+		}
+	}
+	return paths, nil
+}
+
+// Open opens a namespace file and checks that it really is a namespace of
+// the declared type
+func Open(p Path) (int, error) {
+	flag := CloneFlag(p.Type)
+	if flag == 0 {
+		return -1, util.NewSimpleError("open namespace", fmt.Sprintf("cannot join namespace type %q", p.Type))
+	}
+
+	fd, err := unix.Open(p.Path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, util.NewPathError("open namespace", p.Path, err)
+	}
+
+	actual, err := unix.IoctlRetInt(fd, nsGetNstype)
+	if err != nil {
+		unix.Close(fd)
+		return -1, util.NewPathError("open namespace", p.Path, fmt.Errorf("not a namespace: %w", err))
+	}
+	if uintptr(actual) != flag {
+		unix.Close(fd)
+		return -1, util.NewPathError("open namespace", p.Path, fmt.Errorf("not a %s namespace", p.Type))
+	}
+
+	return fd, nil
+}
+
+// Join enters the namespace of an open namespace file. Only the calling
+// thread is moved, so the caller must be locked to its OS thread.
+func Join(fd int, nsType NamespaceType) error {
+	// Threads share their root and working directory, which setns refuses
+	// to change for a mount namespace
+	if nsType == MOUNT {
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			return util.NewError("unshare filesystem attributes", err)
+		}
+	}
+
+	if err := unix.Setns(fd, int(CloneFlag(nsType))); err != nil {
+		return util.NewError(fmt.Sprintf("join %s namespace", nsType), err)
+	}
+
+	return nil
+}
+
+// RunInNamespaces runs fn on a thread that has joined the given namespaces,
+// so processes it starts are created inside them. A PID namespace only
+// applies to such children. The thread is not restored afterwards; its
+// goroutine exits still locked and the runtime discards it.
+func RunInNamespaces(paths []Path, fn func() error) error {
+	if len(paths) == 0 {
+		return fn()
+	}
+
+	paths = append([]Path(nil), paths...)
+	SortPaths(paths)
+
+	// Open everything up front, before any namespace changes path lookups
+	var fds []int
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	for _, p := range paths {
+		fd, err := Open(p)
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		for i, p := range paths {
+			if err := Join(fds[i], p.Type); err != nil {
+				result <- err
+				return
+			}
+		}
+
+		result <- fn()
+	}()
+
+	return <-result
+}
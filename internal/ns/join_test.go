@@ -0,0 +1,106 @@
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func pathTypes(paths []Path) []NamespaceType {
+	var types []NamespaceType
+	for _, p := range paths {
+		types = append(types, p.Type)
+	}
+	return types
+}
+
+func TestSortPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []Path
+		expected []Path
+	}{
+		{
+			name:     "user first and mount last",
+			paths:    []Path{{Type: MOUNT}, {Type: NET}, {Type: USER}, {Type: PID}, {Type: UTS}},
+			expected: []Path{{Type: USER}, {Type: UTS}, {Type: NET}, {Type: PID}, {Type: MOUNT}},
+		},
+		{
+			name:     "every type",
+			paths:    []Path{{Type: MOUNT}, {Type: TIME}, {Type: CGROUP}, {Type: PID}, {Type: NET}, {Type: UTS}, {Type: IPC}, {Type: USER}},
+			expected: []Path{{Type: USER}, {Type: IPC}, {Type: UTS}, {Type: NET}, {Type: PID}, {Type: CGROUP}, {Type: TIME}, {Type: MOUNT}},
+		},
+		{
+			name:     "unknown types after mount",
+			paths:    []Path{{Type: "bogus"}, {Type: MOUNT}, {Type: USER}},
+			expected: []Path{{Type: USER}, {Type: MOUNT}, {Type: "bogus"}},
+		},
+		{
+			name:     "same type keeps its order",
+			paths:    []Path{{Type: NET, Path: "b"}, {Type: USER}, {Type: NET, Path: "a"}},
+			expected: []Path{{Type: USER}, {Type: NET, Path: "b"}, {Type: NET, Path: "a"}},
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SortPaths(tt.paths)
+			if !reflect.DeepEqual(tt.paths, tt.expected) {
+				t.Errorf("SortPaths() = %v, want %v", tt.paths, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessPaths(t *testing.T) {
+	paths, err := ProcessPaths(os.Getpid())
+	if err != nil {
+		t.Fatalf("ProcessPaths() error = %v", err)
+	}
+	if len(paths) != 0 {
+		t.Errorf("ProcessPaths() of ourselves = %v, want none", paths)
+	}
+
+	if _, err := ProcessPaths(-1); err == nil {
+		t.Errorf("ProcessPaths() of a missing process error = nil, want an error")
+	}
+}
+
+func TestProcessPathsOrder(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces needs root")
+	}
+
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUSER,
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot create namespaces: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	paths, err := ProcessPaths(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("ProcessPaths() error = %v", err)
+	}
+
+	expected := []NamespaceType{USER, IPC, UTS, MOUNT}
+	if types := pathTypes(paths); !reflect.DeepEqual(types, expected) {
+		t.Fatalf("ProcessPaths() = %v, want %v", types, expected)
+	}
+	for _, p := range paths {
+		if want := fmt.Sprintf("/proc/%d/ns/%s", cmd.Process.Pid, procNames[p.Type]); p.Path != want {
+			t.Errorf("ProcessPaths() %s path = %s, want %s", p.Type, p.Path, want)
+		}
+	}
+}
@@ -13,22 +13,26 @@ import (
 type NamespaceType string
 
 const (
-	UTS   NamespaceType = "uts"
-	PID   NamespaceType = "pid"
-	MOUNT NamespaceType = "mount"
-	IPC   NamespaceType = "ipc"
-	NET   NamespaceType = "net"
-	USER  NamespaceType = "user"
+	UTS    NamespaceType = "uts"
+	PID    NamespaceType = "pid"
+	MOUNT  NamespaceType = "mount"
+	IPC    NamespaceType = "ipc"
+	NET    NamespaceType = "net"
+	USER   NamespaceType = "user"
+	CGROUP NamespaceType = "cgroup"
+	TIME   NamespaceType = "time"
 )
 
 // NamespaceConfig holds configuration for namespace creation
 type NamespaceConfig struct {
-	UTS   bool
-	PID   bool
-	Mount bool
-	IPC   bool
-	Net   bool
-	User  bool
+	UTS    bool
+	PID    bool
+	Mount  bool
+	IPC    bool
+	Net    bool
+	User   bool
+	Cgroup bool
+	Time   bool
 }
 
 // CloneFlags converts namespace configuration to clone flags
@@ -53,6 +57,12 @@ func (nc *NamespaceConfig) CloneFlags() uintptr {
 	if nc.User {
 		flags |= unix.CLONE_NEWUSER
 	}
+	if nc.Cgroup {
+		flags |= unix.CLONE_NEWCGROUP
+	}
+	if nc.Time {
+		flags |= unix.CLONE_NEWTIME
+	}
 
 	return flags
 }
@@ -79,6 +89,12 @@ func (nc *NamespaceConfig) String() string {
 	if nc.User {
 		enabled = append(enabled, "USER")
 	}
+	if nc.Cgroup {
+		enabled = append(enabled, "CGROUP")
+	}
+	if nc.Time {
+		enabled = append(enabled, "TIME")
+	}
 
 	return fmt.Sprintf("Namespaces: %v", enabled)
 }
@@ -98,6 +114,33 @@ func CreateNamespaces(config *NamespaceConfig) error {
 	return nil
 }
 
+// ClockOffset shifts a clock of a new time namespace
+type ClockOffset struct {
+	Clock    string // "monotonic" or "boottime"
+	Secs     int64
+	Nanosecs uint32
+}
+
+// SetTimeOffsets sets the clock offsets of the time namespace created by
+// unsharing CLONE_NEWTIME. The kernel keeps that namespace per process for
+// its next children and exec, so this must be called from the main thread
+// before either happens.
+func SetTimeOffsets(offsets []ClockOffset) error {
+	var data []byte
+	for _, offset := range offsets {
+		data = fmt.Appendf(data, "%s %d %d\n", offset.Clock, offset.Secs, offset.Nanosecs)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := os.WriteFile("/proc/self/timens_offsets", data, 0); err != nil {
+		return util.NewError("set time offsets", err)
+	}
+
+	return nil
+}
+
 // SetHostname sets the hostname in the UTS namespace
 func SetHostname(hostname string) error {
 	if hostname == "" {
@@ -126,6 +169,10 @@ func NamespaceFromSpec(specType string) NamespaceType {
 		return NET
 	case "user":
 		return USER
+	case "cgroup":
+		return CGROUP
+	case "time":
+		return TIME
 	default:
 		return ""
 	}
@@ -149,6 +196,10 @@ func ConfigFromSpec(namespaces []string) *NamespaceConfig {
 			config.Net = true
 		case USER:
 			config.User = true
+		case CGROUP:
+			config.Cgroup = true
+		case TIME:
+			config.Time = true
 		}
 	}
 
@@ -170,6 +221,12 @@ func WaitForChild(pid int) (int, error) {
 		return -1, util.NewError("wait for child", err)
 	}
 
+	return ExitStatus(status)
+}
+
+// ExitStatus converts a wait status to a shell-style exit code: the exit
+// status of a process that exited, or 128 plus the signal that killed it
+func ExitStatus(status syscall.WaitStatus) (int, error) {
 	if status.Exited() {
 		return status.ExitStatus(), nil
 	}
@@ -179,4 +236,4 @@ func WaitForChild(pid int) (int, error) {
 	}
 
 	return -1, util.NewSimpleError("wait for child", "unexpected child status")
-}
\ No newline at end of file
+}
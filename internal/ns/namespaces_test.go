@@ -0,0 +1,35 @@
+package ns
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   syscall.WaitStatus
+		expected int
+		wantErr  bool
+	}{
+		{name: "success", status: 0, expected: 0},
+		{name: "exit 3", status: 3 << 8, expected: 3},
+		{name: "exit 255", status: 255 << 8, expected: 255},
+		{name: "SIGKILL", status: syscall.WaitStatus(syscall.SIGKILL), expected: 137},
+		{name: "SIGTERM", status: syscall.WaitStatus(syscall.SIGTERM), expected: 143},
+		{name: "SIGSEGV with core dump", status: 0x80 | syscall.WaitStatus(syscall.SIGSEGV), expected: 139},
+		{name: "stopped", status: 0x7f | syscall.WaitStatus(syscall.SIGSTOP)<<8, expected: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExitStatus(tt.status)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExitStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ExitStatus() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+}
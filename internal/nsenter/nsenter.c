@@ -0,0 +1,73 @@
+//go:build linux && cgo
+
+#define _GNU_SOURCE
+#include <errno.h>
+#include <sched.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+static void fail(const char *op)
+{
+	fprintf(stderr, "Container exec failed: %s: %s\n", op, strerror(errno));
+	exit(1);
+}
+
+static int parse_fd(const char *value, char **end)
+{
+	errno = 0;
+	long fd = strtol(value, end, 10);
+	if (*end == value || errno != 0 || fd < 0 || fd > 65535) {
+		errno = EINVAL;
+		fail("parse namespace descriptor");
+	}
+	return (int)fd;
+}
+
+/*
+ * Joins the namespaces in GOMINI_NSENTER_FDS, a comma separated list of
+ * inherited namespace descriptors in the order to enter them, and switches
+ * to the root directory held by GOMINI_NSENTER_ROOT. The parent has already
+ * checked the descriptors, see ns.Open, and leaves out the PID namespace:
+ * once it is joined the kernel refuses to create the runtime's threads.
+ *
+ * This runs as a constructor, before the Go runtime starts: joining a user
+ * or time namespace requires a single-threaded process, which a Go program
+ * never is once its own code runs.
+ */
+__attribute__((constructor)) static void nsenter(void)
+{
+	const char *fds = getenv("GOMINI_NSENTER_FDS");
+	if (fds == NULL)
+		return;
+
+	while (*fds != '\0') {
+		char *end;
+		int fd = parse_fd(fds, &end);
+		if (*end != ',' && *end != '\0') {
+			errno = EINVAL;
+			fail("parse namespace descriptor");
+		}
+
+		if (setns(fd, 0) < 0)
+			fail("join namespace");
+		close(fd);
+
+		fds = *end == ',' ? end + 1 : end;
+	}
+
+	const char *root = getenv("GOMINI_NSENTER_ROOT");
+	if (root != NULL) {
+		char *end;
+		int fd = parse_fd(root, &end);
+
+		if (fchdir(fd) < 0)
+			fail("change to container root");
+		if (chroot(".") < 0)
+			fail("change root");
+		if (chdir("/") < 0)
+			fail("change to container root");
+		close(fd);
+	}
+}
@@ -0,0 +1,11 @@
+//go:build linux && cgo
+
+// Package nsenter moves "gomini exec" into the namespaces of a running
+// container before the Go runtime starts, see nsenter.c. Importing it links
+// the constructor into the binary.
+package nsenter
+
+import "C"
+
+// Supported reports whether namespaces are joined on startup
+const Supported = true
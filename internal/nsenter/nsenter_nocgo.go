@@ -0,0 +1,9 @@
+//go:build !linux || !cgo
+
+// Package nsenter moves "gomini exec" into the namespaces of a running
+// container before the Go runtime starts. It needs cgo, without it the
+// constructor is missing.
+package nsenter
+
+// Supported reports whether namespaces are joined on startup
+const Supported = false
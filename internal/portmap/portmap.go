@@ -0,0 +1,309 @@
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gomini/internal/util"
+)
+
+// udpIdleTimeout is how long a UDP flow without traffic keeps its socket
+const udpIdleTimeout = 60 * time.Second
+
+// dialTimeout bounds connecting to the container, so Close never waits long
+const dialTimeout = 5 * time.Second
+
+// udpBufferSize fits the largest UDP datagram
+const udpBufferSize = 65535
+
+// Mapping forwards a host port to a port in the container
+type Mapping struct {
+	HostIP        netip.Addr // Unspecified listens on all addresses
+	HostPort      uint16
+	ContainerPort uint16
+	Protocol      string // "tcp" or "udp"
+}
+
+// String formats the mapping the way it is written on the command line
+func (m Mapping) String() string {
+	host := strconv.Itoa(int(m.HostPort))
+	if m.HostIP.IsValid() {
+		host = net.JoinHostPort(m.HostIP.String(), host)
+	}
+	return fmt.Sprintf("%s:%d/%s", host, m.ContainerPort, m.Protocol)
+}
+
+// ParseMapping parses [hostIP:]hostPort:containerPort[/protocol]
+func ParseMapping(value string) (Mapping, error) {
+	m := Mapping{Protocol: "tcp"}
+
+	spec, protocol, found := strings.Cut(value, "/")
+	if found {
+		m.Protocol = strings.ToLower(protocol)
+	}
+	if m.Protocol != "tcp" && m.Protocol != "udp" {
+		return m, util.NewSimpleError("parse port mapping", fmt.Sprintf("unknown protocol %q in %q", protocol, value))
+	}
+
+	// The container port follows the last colon, so IPv6 host addresses
+	// in brackets still work
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return m, util.NewSimpleError("parse port mapping", fmt.Sprintf("%q is not host:container", value))
+	}
+	host, containerPort := spec[:i], spec[i+1:]
+
+	if j := strings.LastIndex(host, ":"); j >= 0 {
+		ip, err := parseHostIP(host[:j])
+		if err != nil {
+			return m, util.WrapError("parse port mapping", err)
+		}
+		m.HostIP = ip
+		host = host[j+1:]
+	}
+
+	var err error
+	if m.HostPort, err = parsePort(host); err != nil {
+		return m, util.WrapError("parse port mapping", err)
+	}
+	if m.ContainerPort, err = parsePort(containerPort); err != nil {
+		return m, util.WrapError("parse port mapping", err)
+	}
+
+	return m, nil
+}
+
+// parseHostIP parses the host address of a mapping, an IPv4 address or an
+// IPv6 address in brackets
+func parseHostIP(value string) (netip.Addr, error) {
+	addr, bracketed := strings.CutPrefix(value, "[")
+	if bracketed {
+		var closed bool
+		if addr, closed = strings.CutSuffix(addr, "]"); !closed {
+			return netip.Addr{}, util.NewSimpleError("parse host address", fmt.Sprintf("unbalanced brackets in %q", value))
+		}
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, util.NewError("parse host address", err)
+	}
+	if ip.Is6() != bracketed {
+		return netip.Addr{}, util.NewSimpleError("parse host address", fmt.Sprintf("%q must be an IPv4 address or an IPv6 address in brackets", value))
+	}
+	return ip, nil
+}
+
+// parsePort parses a port number between 1 and 65535
+func parsePort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		return 0, util.NewSimpleError("parse port", fmt.Sprintf("invalid port %q", value))
+	}
+	return uint16(port), nil
+}
+
+// Proxy forwards published host ports to a container in userspace, so no
+// firewall rules are needed
+type Proxy struct {
+	mu      sync.Mutex
+	closers map[io.Closer]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// Start listens on the host side of every mapping and forwards to the
+// container address. Nothing is left listening if any port fails to bind.
+func Start(mappings []Mapping, container netip.Addr) (*Proxy, error) {
+	p := &Proxy{closers: make(map[io.Closer]struct{})}
+
+	for _, m := range mappings {
+		target := net.JoinHostPort(container.String(), strconv.Itoa(int(m.ContainerPort)))
+		listen := net.JoinHostPort(listenHost(m.HostIP), strconv.Itoa(int(m.HostPort)))
+
+		switch m.Protocol {
+		case "tcp":
+			l, err := net.Listen("tcp", listen)
+			if err != nil {
+				p.Close()
+				return nil, util.NewError("publish "+m.String(), err)
+			}
+			p.track(l)
+			p.wg.Add(1)
+			go p.serveTCP(l, target)
+		case "udp":
+			conn, err := net.ListenPacket("udp", listen)
+			if err != nil {
+				p.Close()
+				return nil, util.NewError("publish "+m.String(), err)
+			}
+			p.track(conn)
+			p.wg.Add(1)
+			go p.serveUDP(conn, target)
+		}
+	}
+
+	return p, nil
+}
+
+// Close stops all listeners and open connections and waits for the
+// forwarding goroutines to finish
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	closers := p.closers
+	p.closers = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for c := range closers {
+		c.Close()
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// track registers a listener or connection to be closed by Close. It closes
+// the connection right away if the proxy is already closed.
+func (p *Proxy) track(c io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return
+	}
+	p.closers[c] = struct{}{}
+}
+
+// untrack forgets a connection that has been closed
+func (p *Proxy) untrack(c io.Closer) {
+	p.mu.Lock()
+	delete(p.closers, c)
+	p.mu.Unlock()
+}
+
+// serveTCP accepts host connections and pipes each one to the container
+func (p *Proxy) serveTCP(l net.Listener, target string) {
+	defer p.wg.Done()
+
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.track(client)
+			defer p.untrack(client)
+			defer client.Close()
+
+			backend, err := net.DialTimeout("tcp", target, dialTimeout)
+			if err != nil {
+				return
+			}
+			p.track(backend)
+			defer p.untrack(backend)
+			defer backend.Close()
+
+			var copies sync.WaitGroup
+			copies.Add(2)
+			go pipe(backend, client, &copies)
+			go pipe(client, backend, &copies)
+			copies.Wait()
+		}()
+	}
+}
+
+// pipe copies one direction of a TCP connection and then half-closes the
+// destination so the peer sees EOF
+func pipe(dst, src net.Conn, done *sync.WaitGroup) {
+	defer done.Done()
+	io.Copy(dst, src)
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
+
+// serveUDP relays datagrams between host clients and the container. Every
+// client address gets its own socket towards the container so replies can be
+// routed back.
+func (p *Proxy) serveUDP(conn net.PacketConn, target string) {
+	defer p.wg.Done()
+
+	var mu sync.Mutex
+	flows := make(map[string]net.Conn)
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		mu.Lock()
+		backend, ok := flows[client.String()]
+		if !ok {
+			backend, err = net.Dial("udp", target)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			flows[client.String()] = backend
+			p.track(backend)
+
+			p.wg.Add(1)
+			go func(client net.Addr, backend net.Conn) {
+				defer p.wg.Done()
+				p.replyUDP(conn, client, backend)
+
+				mu.Lock()
+				delete(flows, client.String())
+				mu.Unlock()
+				p.untrack(backend)
+				backend.Close()
+			}(client, backend)
+		}
+		mu.Unlock()
+
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		backend.Write(buf[:n])
+	}
+}
+
+// replyUDP sends the container's replies back to the client until the flow
+// has been idle for udpIdleTimeout
+func (p *Proxy) replyUDP(conn net.PacketConn, client net.Addr, backend net.Conn) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+// listenHost returns the address to listen on for a mapping
+func listenHost(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	return ip.String()
+}
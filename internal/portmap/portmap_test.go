@@ -0,0 +1,55 @@
+package portmap
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Mapping
+		wantErr  bool
+	}{
+		{value: "8080:80", expected: Mapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		{value: "5353:53/udp", expected: Mapping{HostPort: 5353, ContainerPort: 53, Protocol: "udp"}},
+		{value: "8080:80/TCP", expected: Mapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		{value: "127.0.0.1:8080:80", expected: Mapping{HostIP: netip.MustParseAddr("127.0.0.1"), HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		{value: "[::1]:8080:80", expected: Mapping{HostIP: netip.MustParseAddr("::1"), HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		{value: "[2001:db8::1]:53:53/udp", expected: Mapping{HostIP: netip.MustParseAddr("2001:db8::1"), HostPort: 53, ContainerPort: 53, Protocol: "udp"}},
+		{value: "80", wantErr: true},
+		{value: "8080:80/sctp", wantErr: true},
+		{value: "0:80", wantErr: true},
+		{value: "8080:65536", wantErr: true},
+		{value: "http:80", wantErr: true},
+		{value: "localhost:8080:80", wantErr: true},
+		{value: "::1:8080:80", wantErr: true},
+		{value: "[::1:8080:80", wantErr: true},
+		{value: "::1]:8080:80", wantErr: true},
+		{value: "[127.0.0.1]:8080:80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseMapping(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMapping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.expected {
+				t.Errorf("ParseMapping() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMappingString(t *testing.T) {
+	for _, value := range []string{"8080:80/tcp", "127.0.0.1:5353:53/udp", "[::1]:8080:80/tcp"} {
+		m, err := ParseMapping(value)
+		if err != nil {
+			t.Fatalf("ParseMapping(%s) error = %v", value, err)
+		}
+		if got := m.String(); got != value {
+			t.Errorf("String() = %q, want %q", got, value)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package proc
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/util"
+)
+
+// Pseudo-terminal multiplexers to try, the one of the container's own devpts
+// instance first since /dev/ptmx is not created in a fresh /dev
+var ptmxPaths = []string{"/dev/pts/ptmx", "/dev/ptmx"}
+
+// openConsoleSocket returns the socket the container sends its pty master
+// over. With a console socket path the caller receives it directly and only
+// the child's end is returned; otherwise gomini keeps the parent's end of a
+// socket pair to proxy the terminal itself.
+func openConsoleSocket(path string) (parent, child *os.File, err error) {
+	if path != "" {
+		fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return nil, nil, util.NewError("open console socket", err)
+		}
+		if err := unix.Connect(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+			unix.Close(fd)
+			return nil, nil, util.NewPathError("connect console socket", path, err)
+		}
+		return nil, os.NewFile(uintptr(fd), path), nil
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, util.NewError("create console socket", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "console"), os.NewFile(uintptr(fds[1]), "console"), nil
+}
+
+// setupConsole allocates a pty in the container, sends its master over the
+// console socket and makes the slave the controlling terminal and stdio of
+// this process. The slave is handed to the container user so that it can
+// reopen it by path.
+func setupConsole(socketFD int, uid, gid int) error {
+	defer unix.Close(socketFD)
+
+	master := -1
+	var err error
+	for _, path := range ptmxPaths {
+		master, err = unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return util.NewError("open pty master", err)
+	}
+	defer unix.Close(master)
+
+	if err := unix.IoctlSetPointerInt(master, unix.TIOCSPTLCK, 0); err != nil {
+		return util.NewError("unlock pty", err)
+	}
+	// TIOCGPTPEER opens the slave belonging to this master without going
+	// through a path, its argument holds the open flags
+	r, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(master), unix.TIOCGPTPEER, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC)
+	if errno != 0 {
+		return util.NewError("open pty slave", errno)
+	}
+	slave := int(r)
+	defer unix.Close(slave)
+
+	if err := unix.Fchown(slave, uid, gid); err != nil {
+		return util.NewError("chown pty slave", err)
+	}
+
+	if err := sendConsole(socketFD, master); err != nil {
+		return err
+	}
+
+	// A new session has no controlling terminal, so the slave can become it
+	if _, err := unix.Setsid(); err != nil {
+		return util.NewError("create session", err)
+	}
+	if err := unix.IoctlSetInt(slave, unix.TIOCSCTTY, 0); err != nil {
+		return util.NewError("set controlling terminal", err)
+	}
+	for fd := 0; fd <= 2; fd++ {
+		if err := unix.Dup2(slave, fd); err != nil {
+			return util.NewError("redirect stdio to pty", err)
+		}
+	}
+
+	return nil
+}
+
+// sendConsole passes the pty master over the console socket
+func sendConsole(socketFD, master int) error {
+	if err := unix.Sendmsg(socketFD, []byte("console"), unix.UnixRights(master), nil, 0); err != nil {
+		return util.NewError("send pty master", err)
+	}
+	return nil
+}
+
+// receiveConsole receives the pty master the container sends over the socket
+func receiveConsole(socket *os.File) (*os.File, error) {
+	buf := make([]byte, 16)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	_, oobn, _, _, err := unix.Recvmsg(int(socket.Fd()), buf, oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		return nil, util.NewError("receive pty master", err)
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, util.NewError("receive pty master", err)
+	}
+	for _, m := range messages {
+		fds, err := unix.ParseUnixRights(&m)
+		if err == nil && len(fds) == 1 {
+			return os.NewFile(uintptr(fds[0]), "pty-master"), nil
+		}
+	}
+
+	return nil, util.NewSimpleError("receive pty master", "container exited without sending its console")
+}
+
+// proxyConsole connects our stdio to the container's pty. A terminal on
+// stdin is put into raw mode so that every key, Ctrl-C included, reaches the
+// container unchanged. The returned function waits for the remaining output
+// once the container has exited and restores the terminal.
+func proxyConsole(master *os.File) func() {
+	restore := func() {}
+	if termios, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err == nil {
+		raw := *termios
+		raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		raw.Oflag &^= unix.OPOST
+		raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		raw.Cflag &^= unix.CSIZE | unix.PARENB
+		raw.Cflag |= unix.CS8
+		raw.Cc[unix.VMIN] = 1
+		raw.Cc[unix.VTIME] = 0
+		if err := unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, &raw); err == nil {
+			restore = func() {
+				unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, termios)
+			}
+		}
+	}
+	resizeConsole(master)
+
+	// Input is copied until we exit, a read from stdin cannot be cancelled
+	go io.Copy(master, os.Stdin)
+
+	// Reading the master fails with EIO once the last slave is closed
+	output := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, master)
+		close(output)
+	}()
+
+	return func() {
+		<-output
+		master.Close()
+		restore()
+	}
+}
+
+// resizeConsole copies the window size of our terminal to the container's
+// pty, whose foreground process group then receives SIGWINCH
+func resizeConsole(master *os.File) {
+	size, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	if err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, size); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to resize console: %v\n", err)
+	}
+}
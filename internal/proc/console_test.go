@@ -0,0 +1,137 @@
+package proc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// sameFile reports whether two descriptors refer to the same open file
+func sameFile(t *testing.T, a, b *os.File) bool {
+	t.Helper()
+	var sa, sb unix.Stat_t
+	if err := unix.Fstat(int(a.Fd()), &sa); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Fstat(int(b.Fd()), &sb); err != nil {
+		t.Fatal(err)
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino
+}
+
+func TestConsoleSocketPair(t *testing.T) {
+	parent, child, err := openConsoleSocket("")
+	if err != nil {
+		t.Fatalf("openConsoleSocket() error = %v", err)
+	}
+	defer parent.Close()
+
+	master, err := os.CreateTemp(t.TempDir(), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	// setupConsole closes its end after sending, as the container does
+	if err := sendConsole(int(child.Fd()), int(master.Fd())); err != nil {
+		t.Fatalf("sendConsole() error = %v", err)
+	}
+	child.Close()
+
+	received, err := receiveConsole(parent)
+	if err != nil {
+		t.Fatalf("receiveConsole() error = %v", err)
+	}
+	defer received.Close()
+
+	if received.Fd() == master.Fd() {
+		t.Errorf("receiveConsole() = fd %d, want a new descriptor", received.Fd())
+	}
+	if !sameFile(t, received, master) {
+		t.Errorf("receiveConsole() did not return the sent file")
+	}
+	flags, err := unix.FcntlInt(received.Fd(), unix.F_GETFD, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.FD_CLOEXEC == 0 {
+		t.Errorf("received descriptor is not close-on-exec")
+	}
+}
+
+func TestReceiveConsoleWithoutConsole(t *testing.T) {
+	parent, child, err := openConsoleSocket("")
+	if err != nil {
+		t.Fatalf("openConsoleSocket() error = %v", err)
+	}
+	defer parent.Close()
+
+	// The container exited before sending anything
+	child.Close()
+
+	received, err := receiveConsole(parent)
+	if err == nil {
+		received.Close()
+		t.Fatal("receiveConsole() error = nil, want an error")
+	}
+	if !strings.Contains(err.Error(), "without sending its console") {
+		t.Errorf("receiveConsole() error = %v", err)
+	}
+}
+
+func TestConsoleSocketPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.sock")
+	listener, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(listener)
+	if err := unix.Bind(listener, &unix.SockaddrUnix{Name: path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Listen(listener, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, child, err := openConsoleSocket(path)
+	if err != nil {
+		t.Fatalf("openConsoleSocket() error = %v", err)
+	}
+	if parent != nil {
+		t.Errorf("openConsoleSocket() parent = %v, want nil with a socket path", parent)
+	}
+
+	fd, _, err := unix.Accept4(listener, unix.SOCK_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := os.NewFile(uintptr(fd), "accepted")
+	defer accepted.Close()
+
+	master, err := os.CreateTemp(t.TempDir(), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	if err := sendConsole(int(child.Fd()), int(master.Fd())); err != nil {
+		t.Fatalf("sendConsole() error = %v", err)
+	}
+	child.Close()
+
+	received, err := receiveConsole(accepted)
+	if err != nil {
+		t.Fatalf("receiveConsole() error = %v", err)
+	}
+	defer received.Close()
+	if !sameFile(t, received, master) {
+		t.Errorf("receiveConsole() did not return the sent file")
+	}
+
+	if _, _, err := openConsoleSocket(filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Errorf("openConsoleSocket() of a missing socket error = nil, want an error")
+	}
+}
@@ -2,28 +2,97 @@ package proc
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
+	"gomini/internal/caps"
 	"gomini/internal/cg"
 	"gomini/internal/fs"
+	"gomini/internal/net"
 	"gomini/internal/ns"
+	"gomini/internal/portmap"
+	"gomini/internal/seccomp"
 	"gomini/internal/spec"
 	"gomini/internal/util"
 )
 
 // ContainerProcess represents a container process configuration
 type ContainerProcess struct {
-	Config        *spec.Config
-	BundleDir     string
-	Hostname      string
-	Args          []string
-	Env           []string
-	WorkingDir    string
-	CgroupManager *cg.CgroupManager
+	ID             string // Container ID, used to name host network devices
+	Config         *spec.Config
+	BundleDir      string
+	Hostname       string
+	Args           []string
+	Env            []string
+	WorkingDir     string
+	CgroupManager  *cg.CgroupManager
 	ResourceLimits *cg.ResourceLimits
+
+	// Rootless runs the container as an unprivileged user inside a user
+	// namespace, see EnableRootless
+	Rootless bool
+
+	// Network overrides the bundle's network namespace, see SetNetwork.
+	// Endpoint records the bridge connection once the container is set up.
+	Network  *net.Config
+	Endpoint *net.Endpoint
+
+	// NetworkFilesDir is where /etc/hosts and /etc/resolv.conf of a bridged
+	// container are written before they are bind mounted into it
+	NetworkFilesDir string
+
+	// Publish lists host ports forwarded to the container while it runs,
+	// see PublishPorts
+	Publish []portmap.Mapping
+
+	// Overlay stacks a writable layer on the bundle's rootfs, which the
+	// container then uses without modifying it, see EnableOverlay
+	Overlay *fs.Overlay
+
+	// SeccompProfile selects the built-in profile or no filtering instead of
+	// the bundle's linux.seccomp (empty keeps the bundle's)
+	SeccompProfile string
+
+	// Init keeps a minimal init process in front of the container command
+	// that forwards signals and reaps zombies, see runInit
+	Init bool
+
+	// ConsoleSocket is the path of a unix socket that receives the pty
+	// master of a container with process.terminal set. Without it, run
+	// proxies the terminal itself.
+	ConsoleSocket string
+
+	// console is the pty master received from the container
+	console *os.File
+
+	// OnStart is called with the init PID once a forked container is running
+	OnStart func(pid int)
+
+	// syncFD is the inherited pipe the init process reads from before it
+	// continues, once the parent has finished its part of the setup
+	syncFD int
+
+	// consoleFD is the inherited socket the pty master is sent over
+	consoleFD int
+
+	// setgroupsDenied is set when the user namespace denies setgroups but
+	// /proc/self does not tell, as for the exec helper outside of the
+	// container's PID namespace
+	setgroupsDenied bool
+
+	// execFifoFD is the inherited fifo descriptor that blocks a created
+	// container until "start" is called (0 when not created via "create")
+	execFifoFD int
 }
 
 // NewContainerProcess creates a new container process configuration
@@ -52,9 +121,178 @@ func (cp *ContainerProcess) OverrideHostname(hostname string) {
 	}
 }
 
+// EnableRootless prepares the container for an unprivileged caller. A user
+// namespace is added if the bundle has none, and without explicit mappings
+// root in the container is mapped to the caller's user and group. Only such
+// single-ID mappings can be written without privileges.
+func (cp *ContainerProcess) EnableRootless() {
+	cp.Rootless = true
+
+	linux := &cp.Config.Linux
+	if !linux.HasNamespace("user") {
+		linux.Namespaces = append(linux.Namespaces, spec.Namespace{Type: "user"})
+	}
+	if len(linux.UIDMappings) == 0 {
+		linux.UIDMappings = []spec.IDMapping{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}}
+	}
+	if len(linux.GIDMappings) == 0 {
+		linux.GIDMappings = []spec.IDMapping{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}}
+	}
+}
+
+// SetNetwork selects the network mode. Host networking drops the bundle's
+// network namespace, the other modes add one if needed.
+func (cp *ContainerProcess) SetNetwork(config *net.Config) {
+	cp.Network = config
+
+	linux := &cp.Config.Linux
+	if config.NeedsNamespace() {
+		if !linux.HasNamespace("network") {
+			linux.Namespaces = append(linux.Namespaces, spec.Namespace{Type: "network"})
+		}
+		return
+	}
+
+	var namespaces []spec.Namespace
+	for _, namespace := range linux.Namespaces {
+		if namespace.Type != "network" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	linux.Namespaces = namespaces
+}
+
+// PublishPorts forwards host ports to the container. The proxy needs the
+// container's bridge address, so SetNetwork must select bridge mode first.
+func (cp *ContainerProcess) PublishPorts(mappings []portmap.Mapping) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+	if cp.Network == nil || cp.Network.Mode != net.ModeBridge {
+		return util.NewSimpleError("publish ports", "publishing ports requires bridge networking")
+	}
+
+	cp.Publish = mappings
+	return nil
+}
+
+// OverlayAnnotation enables EnableOverlay from the bundle when set to "true"
+const OverlayAnnotation = "gomini.overlay"
+
+// EnableOverlay gives the container a writable overlay on top of the
+// bundle's rootfs, with its layer directories created in dir. Containers
+// sharing a bundle then no longer see or change each other's files. A
+// rootfs made of layers, see spec.Root, is always combined this way.
+func (cp *ContainerProcess) EnableOverlay(dir string) error {
+	// The overlay is mounted by the init process in its own mount namespace
+	if !cp.namespaceConfig().Mount {
+		return util.NewSimpleError("enable overlay", "an overlay rootfs requires a new mount namespace")
+	}
+
+	overlay := fs.NewOverlay(dir)
+	if err := overlay.Create(cp.Config.GetRootfsPath(cp.BundleDir)); err != nil {
+		return util.WrapError("enable overlay", err)
+	}
+	cp.Overlay = overlay
+	return nil
+}
+
+// Seccomp profiles accepted by OverrideSeccomp
+const (
+	SeccompDefault    = "default"
+	SeccompUnconfined = "unconfined"
+)
+
+// OverrideSeccomp replaces the bundle's seccomp profile with the built-in
+// default profile or disables filtering
+func (cp *ContainerProcess) OverrideSeccomp(profile string) error {
+	switch profile {
+	case "":
+		return nil
+	case SeccompDefault:
+		cp.Config.Linux.Seccomp = seccomp.DefaultProfile()
+	case SeccompUnconfined:
+		cp.Config.Linux.Seccomp = nil
+	default:
+		return util.NewSimpleError("seccomp profile", fmt.Sprintf("unknown profile %q (use %q or %q)", profile, SeccompDefault, SeccompUnconfined))
+	}
+	cp.SeccompProfile = profile
+	return nil
+}
+
+// ResourceLimitsFromSpec converts the bundle's linux.resources to cgroup limits
+func ResourceLimitsFromSpec(resources spec.Resources) *cg.ResourceLimits {
+	limits := &cg.ResourceLimits{
+		CPUQuota:   resources.CPU.Quota,
+		CPUPeriod:  resources.CPU.Period,
+		CPUWeight:  cg.ConvertCPUSharesToWeight(resources.CPU.Shares),
+		CPUSetCPUs: resources.CPU.Cpus,
+		CPUSetMems: resources.CPU.Mems,
+		Memory:     resources.Memory.Limit,
+		MemoryLow:  resources.Memory.Reservation,
+		Pids:       resources.Pids.Limit,
+		IOWeight:   cg.ConvertBlkioWeight(resources.BlockIO.Weight),
+		Unified:    resources.Unified,
+	}
+
+	// OCI swap is memory plus swap while cgroup v2 limits swap alone
+	switch {
+	case resources.Memory.Swap < 0:
+		unlimited := int64(-1)
+		limits.MemorySwap = &unlimited
+	case resources.Memory.Swap > 0 && resources.Memory.Limit > 0:
+		swap := resources.Memory.Swap - resources.Memory.Limit
+		limits.MemorySwap = &swap
+	}
+
+	blockIO := resources.BlockIO
+	for _, dev := range blockIO.WeightDevice {
+		limits.IOWeightDevices = append(limits.IOWeightDevices, cg.IOWeightDevice{
+			Major:  dev.Major,
+			Minor:  dev.Minor,
+			Weight: cg.ConvertBlkioWeight(dev.Weight),
+		})
+	}
+
+	// OCI lists each throttle separately, io.max takes them per device
+	devices := map[[2]int64]*cg.IOMaxDevice{}
+	var order [][2]int64
+	throttle := func(list []spec.ThrottleDevice, set func(*cg.IOMaxDevice, uint64)) {
+		for _, dev := range list {
+			key := [2]int64{dev.Major, dev.Minor}
+			if devices[key] == nil {
+				devices[key] = &cg.IOMaxDevice{Major: dev.Major, Minor: dev.Minor}
+				order = append(order, key)
+			}
+			set(devices[key], dev.Rate)
+		}
+	}
+	throttle(blockIO.ThrottleReadBpsDevice, func(d *cg.IOMaxDevice, v uint64) { d.ReadBps = v })
+	throttle(blockIO.ThrottleWriteBpsDevice, func(d *cg.IOMaxDevice, v uint64) { d.WriteBps = v })
+	throttle(blockIO.ThrottleReadIOPSDevice, func(d *cg.IOMaxDevice, v uint64) { d.ReadIOPS = v })
+	throttle(blockIO.ThrottleWriteIOPSDevice, func(d *cg.IOMaxDevice, v uint64) { d.WriteIOPS = v })
+	for _, key := range order {
+		limits.IOMaxDevices = append(limits.IOMaxDevices, *devices[key])
+	}
+
+	for _, hugepage := range resources.HugepageLimits {
+		if limits.HugetlbLimits == nil {
+			limits.HugetlbLimits = make(map[string]uint64)
+		}
+		limits.HugetlbLimits[hugepage.PageSize] = hugepage.Limit
+	}
+
+	return limits
+}
+
 // SetupCgroups initializes cgroup management for the container
 func (cp *ContainerProcess) SetupCgroups(containerID string, limits *cg.ResourceLimits) error {
-	cgroupMgr, err := cg.NewCgroupManager(containerID)
+	newManager := cg.NewCgroupManager
+	if cp.Rootless {
+		newManager = cg.NewRootlessCgroupManager
+	}
+
+	cgroupMgr, err := newManager(containerID)
 	if err != nil {
 		return util.WrapError("create cgroup manager", err)
 	}
@@ -65,6 +303,7 @@ func (cp *ContainerProcess) SetupCgroups(containerID string, limits *cg.Resource
 
 	if limits != nil {
 		if err := cgroupMgr.ApplyLimits(limits); err != nil {
+			cgroupMgr.Cleanup()
 			return util.WrapError("apply cgroup limits", err)
 		}
 	}
@@ -74,53 +313,209 @@ func (cp *ContainerProcess) SetupCgroups(containerID string, limits *cg.Resource
 	return nil
 }
 
-// Run executes the container process
-func (cp *ContainerProcess) Run() error {
-	// Create namespace configuration from spec
+// namespaceConfig builds the configuration of the namespaces to create from
+// the spec; namespaces with a path are joined instead, see joinedNamespaces
+func (cp *ContainerProcess) namespaceConfig() *ns.NamespaceConfig {
 	var nsTypes []string
 	for _, ns := range cp.Config.Linux.Namespaces {
-		nsTypes = append(nsTypes, ns.Type)
+		if ns.Path == "" {
+			nsTypes = append(nsTypes, ns.Type)
+		}
 	}
-	nsConfig := ns.ConfigFromSpec(nsTypes)
+	return ns.ConfigFromSpec(nsTypes)
+}
 
-	fmt.Printf("Creating namespaces: %s\n", nsConfig.String())
+// joinedNamespaces returns the existing namespaces from the spec in the order
+// they are joined
+func (cp *ContainerProcess) joinedNamespaces() ([]ns.Path, error) {
+	var paths []ns.Path
+	for _, namespace := range cp.Config.Linux.Namespaces {
+		if namespace.Path == "" {
+			continue
+		}
 
-	// Fork process for namespace isolation
-	if nsConfig.PID {
-		// When using PID namespace, we need to fork and let the child become PID 1
-		return cp.runWithPIDNamespace(nsConfig)
-	} else {
-		// No PID namespace, run directly with other namespaces
-		return cp.runWithNamespaces(nsConfig)
+		nsType := ns.NamespaceFromSpec(namespace.Type)
+		if nsType == "" {
+			return nil, util.NewSimpleError("join namespaces", fmt.Sprintf("cannot join namespace type %q", namespace.Type))
+		}
+		// The kernel only lets single-threaded processes change their user
+		// or time namespace, and a Go process never is one
+		if nsType == ns.USER || nsType == ns.TIME {
+			return nil, util.NewSimpleError("join namespaces", fmt.Sprintf("joining an existing %s namespace is not supported", namespace.Type))
+		}
+
+		paths = append(paths, ns.Path{Type: nsType, Path: namespace.Path})
 	}
+
+	ns.SortPaths(paths)
+	return paths, nil
 }
 
-// runWithPIDNamespace handles execution with PID namespace
-func (cp *ContainerProcess) runWithPIDNamespace(nsConfig *ns.NamespaceConfig) error {
-	// Create a pipe for communication with child
-	r, w, err := os.Pipe()
+// ExitError is returned by Run when the container process exits with a
+// non-zero status or is killed by a signal
+type ExitError struct {
+	Code int // Exit status, or 128 plus the signal number
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("container exited with status %d", e.Code)
+}
+
+// Run executes the container process
+func (cp *ContainerProcess) Run() error {
+	// Create namespace configuration from spec
+	nsConfig := cp.namespaceConfig()
+
+	fmt.Printf("Creating namespaces: %s\n", nsConfig.String())
+
+	joined, err := cp.joinedNamespaces()
 	if err != nil {
-		return util.NewError("create pipe", err)
+		return err
 	}
-	defer r.Close()
+	for _, p := range joined {
+		fmt.Printf("Joining %s namespace: %s\n", p.Type, p.Path)
+	}
+
+	// The container always runs in a forked init process, so this one
+	// outlives it to clean up its cgroup, state and address lease. A new
+	// PID namespace only applies to children anyway, while ID mappings,
+	// joined namespaces and the network have to be set up from outside.
+	return cp.runForked(nsConfig, joined)
+}
 
+// runForked handles execution in a forked init process
+func (cp *ContainerProcess) runForked(nsConfig *ns.NamespaceConfig, joined []ns.Path) error {
 	// Fork process
+	cmd, err := cp.initCommand(nsConfig)
+	if err != nil {
+		return err
+	}
+
+	// Bind the host ports before starting so a taken port fails the run
+	// early; the proxy stops once the container exits
+	if len(cp.Publish) > 0 {
+		proxy, err := portmap.Start(cp.Publish, cp.Network.Address)
+		if err != nil {
+			if cp.CgroupManager != nil {
+				cp.CgroupManager.Cleanup()
+			}
+			return util.WrapError("publish ports", err)
+		}
+		defer proxy.Close()
+
+		for _, m := range cp.Publish {
+			fmt.Printf("Publishing %s to %s\n", m, cp.Network.Address)
+		}
+	}
+
+	// Trap signals from here on: they are relayed to the container instead
+	// of killing us before the cleanup below has run
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+
+	if err := cp.startInit(cmd, joined); err != nil {
+		if cp.CgroupManager != nil {
+			cp.CgroupManager.Cleanup()
+		}
+		return err
+	}
+	go relaySignals(signals, cmd.Process.Pid, cp.console)
+
+	if cp.console != nil {
+		// Drain the output and restore our terminal once the container exits
+		finish := proxyConsole(cp.console)
+		defer finish()
+	}
+
+	if cp.OnStart != nil {
+		cp.OnStart(cmd.Process.Pid)
+	}
+
+	// Wait for child process
+	waitErr := cmd.Wait()
+
+	// Clean up cgroup however the container ended
+	if cp.CgroupManager != nil {
+		if err := cp.CgroupManager.Cleanup(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to cleanup cgroup: %v\n", err)
+		}
+	}
+
+	return exitError(waitErr)
+}
+
+// exitError converts the result of waiting for a container process into an
+// ExitError carrying its status
+func exitError(waitErr error) error {
+	if waitErr == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(waitErr, &exitErr) {
+		return util.NewError("wait for container process", waitErr)
+	}
+	code, err := ns.ExitStatus(exitErr.Sys().(syscall.WaitStatus))
+	if err != nil {
+		return util.WrapError("wait for container process", err)
+	}
+	return &ExitError{Code: code}
+}
+
+// relaySignals forwards signals sent to gomini to the container init process
+// until the channel is closed. A PID 1 without a handler for a signal does
+// not receive it, see --init. With a proxied console, window size changes
+// resize the container's pty instead.
+func relaySignals(signals <-chan os.Signal, pid int, console *os.File) {
+	for sig := range signals {
+		switch {
+		case sig == unix.SIGCHLD, sig == unix.SIGPIPE, sig == unix.SIGURG:
+			// About our own children, pipes and goroutine preemption
+		case sig == unix.SIGWINCH && console != nil:
+			resizeTerminal(console)
+		default:
+			signalProcess(pid, sig.(syscall.Signal))
+		}
+	}
+}
+
+// resizeTerminal applies window size changes to a console, replaced in tests
+var resizeTerminal = resizeConsole
+
+// initCommand prepares the "container-init" child that is cloned into the
+// configured namespaces and re-creates the container from the environment
+func (cp *ContainerProcess) initCommand(nsConfig *ns.NamespaceConfig) (*exec.Cmd, error) {
 	cmd := exec.Command("/proc/self/exe", "container-init")
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = []*os.File{w}
 
-	// Set namespace flags
+	// Set namespace flags. The init process creates the cgroup and time
+	// namespaces itself, see createInitNamespaces.
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: nsConfig.CloneFlags(),
+		Cloneflags: nsConfig.CloneFlags() &^ (unix.CLONE_NEWCGROUP | unix.CLONE_NEWTIME),
+	}
+
+	// The ID maps are written by this process once the child is cloned.
+	// An unprivileged parent must deny setgroups before writing gid_map.
+	// The child then switches to container root, since our own IDs may not
+	// be mapped and an unmapped user loses its capabilities on exec.
+	if nsConfig.User {
+		cmd.SysProcAttr.UidMappings = idMappings(cp.Config.Linux.UIDMappings)
+		cmd.SysProcAttr.GidMappings = idMappings(cp.Config.Linux.GIDMappings)
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true}
 	}
 
 	// Set environment variables for child
 	// Use JSON encoding to preserve argument boundaries
 	argsJSON, err := json.Marshal(cp.Args)
 	if err != nil {
-		return util.NewError("marshal args", err)
+		return nil, util.NewError("marshal args", err)
 	}
 
 	cmd.Env = append(os.Environ(),
@@ -128,14 +523,87 @@ func (cp *ContainerProcess) runWithPIDNamespace(nsConfig *ns.NamespaceConfig) er
 		fmt.Sprintf("GOMINI_HOSTNAME=%s", cp.Hostname),
 		fmt.Sprintf("GOMINI_ARGS=%s", string(argsJSON)),
 		fmt.Sprintf("GOMINI_WORKING_DIR=%s", cp.WorkingDir),
+		fmt.Sprintf("GOMINI_SECCOMP=%s", cp.SeccompProfile),
 	)
+	if cp.Network != nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GOMINI_NET=%s", cp.Network.Mode))
+		if cp.Network.NeedsSetup() {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("GOMINI_NETWORK_FILES=%s", cp.NetworkFilesDir))
+		}
+	}
+	if cp.Init {
+		cmd.Env = append(cmd.Env, "GOMINI_INIT=1")
+	}
+	if cp.Rootless {
+		cmd.Env = append(cmd.Env, "GOMINI_ROOTLESS=1")
+	}
+	if cp.Overlay != nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GOMINI_OVERLAY=%s", filepath.Dir(cp.Overlay.UpperDir)))
+	}
 
-	if err := cmd.Start(); err != nil {
-		w.Close()
-		return util.NewError("start container process", err)
+	return cmd, nil
+}
+
+// startInit starts the init process in the joined namespaces and completes
+// the setup that has to be done from outside: cgroup placement and the
+// network. The child blocks on a sync pipe until then, so the container
+// command never runs unconfined.
+func (cp *ContainerProcess) startInit(cmd *exec.Cmd, joined []ns.Path) error {
+	// The child is cloned from a thread that has joined the existing
+	// namespaces, except for the mount namespace: the init binary has to be
+	// found on the host, so the child joins that one itself
+	var inherited []ns.Path
+	for _, p := range joined {
+		if p.Type != ns.MOUNT {
+			inherited = append(inherited, p)
+			continue
+		}
+		// Check it here for a clear error before anything is started
+		fd, err := ns.Open(p)
+		if err != nil {
+			return util.WrapError("join namespaces", err)
+		}
+		unix.Close(fd)
 	}
 
-	w.Close()
+	// The container sends its pty master over this socket, either to us or
+	// to the caller's console socket
+	var consoleParent, consoleChild *os.File
+	var err error
+	if cp.Config.Process.Terminal {
+		consoleParent, consoleChild, err = openConsoleSocket(cp.ConsoleSocket)
+		if err != nil {
+			return err
+		}
+		defer consoleChild.Close()
+		if consoleParent != nil {
+			defer consoleParent.Close()
+		}
+
+		cmd.ExtraFiles = append(cmd.ExtraFiles, consoleChild)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GOMINI_CONSOLE_FD=%d", 2+len(cmd.ExtraFiles)))
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return util.NewError("create sync pipe", err)
+	}
+	defer w.Close()
+
+	// Inherited files start at fd 3
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GOMINI_SYNC_FD=%d", 2+len(cmd.ExtraFiles)))
+
+	err = ns.RunInNamespaces(inherited, cmd.Start)
+	r.Close()
+	// Only the child may hold its end, or we would wait forever for a
+	// console from a container that died before sending it
+	if consoleChild != nil {
+		consoleChild.Close()
+	}
+	if err != nil {
+		return util.NewError("start container process", err)
+	}
 
 	// Add process to cgroup if configured
 	if cp.CgroupManager != nil {
@@ -144,38 +612,122 @@ func (cp *ContainerProcess) runWithPIDNamespace(nsConfig *ns.NamespaceConfig) er
 		}
 	}
 
-	// Wait for child process
-	if err := cmd.Wait(); err != nil {
-		// Clean up cgroup before returning error
-		if cp.CgroupManager != nil {
-			cp.CgroupManager.Cleanup()
-		}
-		return util.NewError("wait for container process", err)
+	if err := cp.setupNetwork(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
 	}
 
-	// Clean up cgroup after successful completion
-	if cp.CgroupManager != nil {
-		if err := cp.CgroupManager.Cleanup(); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to cleanup cgroup: %v\n", err)
+	if _, err := w.Write([]byte{0}); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return util.NewError("release container process", err)
+	}
+
+	// Without a console socket the container sends its pty to us
+	if consoleParent != nil {
+		console, err := receiveConsole(consoleParent)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
 		}
+		cp.console = console
 	}
 
 	return nil
 }
 
-// runWithNamespaces handles execution with namespaces but no PID namespace
-func (cp *ContainerProcess) runWithNamespaces(nsConfig *ns.NamespaceConfig) error {
-	// Create namespaces
-	if err := ns.CreateNamespaces(nsConfig); err != nil {
-		return util.WrapError("create namespaces", err)
+// setupNetwork configures the network namespace of the init process
+func (cp *ContainerProcess) setupNetwork(pid int) error {
+	if cp.Network == nil {
+		return nil
 	}
 
-	// Continue with container initialization
-	return cp.initContainer()
+	// Entering the container's namespaces needs privileges on the host
+	if cp.Rootless && cp.Network.NeedsSetup() {
+		return util.NewSimpleError("setup network", "bridge networking requires root")
+	}
+	if cp.Network.NeedsSetup() && cp.Config.Linux.NamespacePath("network") != "" {
+		return util.NewSimpleError("setup network", "a joined network namespace cannot be connected to a bridge")
+	}
+	if cp.Network.NeedsSetup() && cp.NetworkFilesDir == "" {
+		return util.NewSimpleError("setup network", "no directory for the network files of the container")
+	}
+
+	endpoint, err := net.Setup(cp.Network, cp.ID, pid)
+	if err != nil {
+		return util.WrapError("setup network", err)
+	}
+
+	if endpoint != nil {
+		fmt.Printf("Network: %s %s via %s (host side %s on %s)\n",
+			net.ContainerInterface, endpoint.Address, endpoint.Gateway, endpoint.HostInterface, cp.Network.Bridge)
+
+		hostname := cp.Hostname
+		if hostname == "" {
+			hostname = cp.ID
+		}
+		if err := net.WriteEtcFiles(cp.NetworkFilesDir, hostname, endpoint.Address.Addr()); err != nil {
+			return util.WrapError("setup network", err)
+		}
+	}
+	cp.Endpoint = endpoint
+	return nil
+}
+
+// waitForParent blocks until the parent has finished its part of the setup
+func (cp *ContainerProcess) waitForParent() error {
+	if cp.syncFD == 0 {
+		return nil
+	}
+
+	sync := os.NewFile(uintptr(cp.syncFD), "sync")
+	defer sync.Close()
+	cp.syncFD = 0
+
+	buf := make([]byte, 1)
+	if n, err := sync.Read(buf); n != 1 {
+		return util.NewError("read sync pipe", err)
+	}
+
+	return nil
+}
+
+// idMappings converts spec ID mappings to the form used by SysProcAttr
+func idMappings(mappings []spec.IDMapping) []syscall.SysProcIDMap {
+	var result []syscall.SysProcIDMap
+	for _, m := range mappings {
+		result = append(result, syscall.SysProcIDMap{
+			ContainerID: int(m.ContainerID),
+			HostID:      int(m.HostID),
+			Size:        int(m.Size),
+		})
+	}
+	return result
 }
 
 // initContainer initializes the container environment and executes the process
 func (cp *ContainerProcess) initContainer() error {
+	// Capabilities are per thread, so every step up to exec stays on this one
+	runtime.LockOSThread()
+
+	if err := cp.waitForParent(); err != nil {
+		return util.WrapError("wait for parent", err)
+	}
+
+	if err := cp.createInitNamespaces(); err != nil {
+		return err
+	}
+
+	// The network namespace exists from here on, so services inside the
+	// container can use localhost right away
+	if cp.namespaceConfig().Net {
+		if err := net.BringUpLoopback(); err != nil {
+			return util.WrapError("bring up loopback", err)
+		}
+	}
+
 	// Set hostname if UTS namespace is enabled
 	if cp.Hostname != "" {
 		if err := ns.SetHostname(cp.Hostname); err != nil {
@@ -183,17 +735,23 @@ func (cp *ContainerProcess) initContainer() error {
 		}
 	}
 
-	// Switch root filesystem
-	rootfsPath := cp.Config.GetRootfsPath(cp.BundleDir)
-	rootfsManager := fs.NewRootfsManager(rootfsPath, cp.Config.Root.Readonly)
-
-	if err := rootfsManager.SwitchRoot(); err != nil {
-		return util.WrapError("switch root", err)
+	// Keep mounts made inside a new mount namespace away from the host
+	if cp.namespaceConfig().Mount {
+		if err := fs.MakeRootSlave(); err != nil {
+			return util.WrapError("set mount propagation", err)
+		}
 	}
 
-	// Create basic mounts
-	if err := fs.CreateBasicMounts(); err != nil {
-		return util.WrapError("create basic mounts", err)
+	// A joined mount namespace brings its own root filesystem, setns has
+	// already moved us into it. Otherwise switch to the bundle's rootfs.
+	if path := cp.Config.Linux.NamespacePath("mount"); path != "" {
+		if err := joinMountNamespace(path); err != nil {
+			return err
+		}
+	} else {
+		if err := cp.rootfsManager().SwitchRoot(); err != nil {
+			return util.WrapError("switch root", err)
+		}
 	}
 
 	// Change working directory
@@ -207,6 +765,77 @@ func (cp *ContainerProcess) initContainer() error {
 	return cp.execProcess()
 }
 
+// createInitNamespaces creates the cgroup and time namespaces. The cgroup
+// namespace is only created once the parent has placed us in the container's
+// cgroup, so that cgroup becomes its root. A new time namespace is entered by
+// the following exec, after its offsets have been set.
+func (cp *ContainerProcess) createInitNamespaces() error {
+	nsConfig := cp.namespaceConfig()
+
+	if nsConfig.Cgroup {
+		if err := ns.CreateNamespaces(&ns.NamespaceConfig{Cgroup: true}); err != nil {
+			return util.WrapError("create cgroup namespace", err)
+		}
+	}
+
+	if nsConfig.Time {
+		if err := ns.CreateNamespaces(&ns.NamespaceConfig{Time: true}); err != nil {
+			return util.WrapError("create time namespace", err)
+		}
+
+		var offsets []ns.ClockOffset
+		for clock, offset := range cp.Config.Linux.TimeOffsets {
+			offsets = append(offsets, ns.ClockOffset{Clock: clock, Secs: offset.Secs, Nanosecs: offset.Nanosecs})
+		}
+		if err := ns.SetTimeOffsets(offsets); err != nil {
+			return util.WrapError("create time namespace", err)
+		}
+	}
+
+	return nil
+}
+
+// hasMount reports whether a mount point targets the given destination
+func hasMount(mounts []fs.MountPoint, destination string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Destination) == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// joinMountNamespace enters an existing mount namespace on the current thread
+func joinMountNamespace(path string) error {
+	fd, err := ns.Open(ns.Path{Type: ns.MOUNT, Path: path})
+	if err != nil {
+		return util.WrapError("join mount namespace", err)
+	}
+	defer unix.Close(fd)
+
+	if err := ns.Join(fd, ns.MOUNT); err != nil {
+		return util.WrapError("join mount namespace", err)
+	}
+	return nil
+}
+
+// mountPoints converts the spec mounts, resolving relative bind sources
+// against the bundle directory
+func (cp *ContainerProcess) mountPoints() []fs.MountPoint {
+	var mounts []fs.MountPoint
+	for _, m := range cp.Config.Mounts {
+		mount := fs.NewMountPoint(m.Source, m.Destination, m.Type, m.Options)
+		if m.Type == "bind" {
+			mount.Flags |= unix.MS_BIND
+		}
+		if mount.IsBind() && !filepath.IsAbs(mount.Source) {
+			mount.Source = filepath.Join(cp.BundleDir, mount.Source)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
+
 // execProcess executes the final container process
 func (cp *ContainerProcess) execProcess() error {
 	if len(cp.Args) == 0 {
@@ -219,10 +848,104 @@ func (cp *ContainerProcess) execProcess() error {
 		env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
 	}
 
+	// Resolve the user while /etc of the container is visible
+	execUser, err := cp.resolveUser()
+	if err != nil {
+		return util.WrapError("resolve user", err)
+	}
+	if execUser.Home != "" && !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+execUser.Home)
+	}
+
+	// The pty is allocated in the container's devpts and handed out before
+	// "start", so a console socket receives it while the container is created
+	terminal := cp.consoleFD != 0
+	if terminal {
+		err := setupConsole(cp.consoleFD, execUser.UID, execUser.GID)
+		cp.consoleFD = 0
+		if err != nil {
+			return util.WrapError("setup console", err)
+		}
+	}
+
+	// Compile the seccomp filter before anything is dropped so that errors
+	// surface while the container can still report them
+	var filter []unix.SockFilter
+	if cp.Config.Linux.Seccomp != nil {
+		filter, err = seccomp.Compile(cp.Config.Linux.Seccomp)
+		if err != nil {
+			return util.WrapError("compile seccomp filter", err)
+		}
+	}
+
+	// Block until "start" opens the exec fifo when created via "create"
+	if err := cp.waitForStart(); err != nil {
+		return util.WrapError("wait for start", err)
+	}
+
+	// Raising a hard limit needs CAP_SYS_RESOURCE, so limits are set while
+	// still privileged
+	if err := cp.setupRlimits(); err != nil {
+		return err
+	}
+
+	// Capabilities, user and no_new_privs are set in the order the kernel
+	// requires: the bounding set shrinks while still root, permitted
+	// capabilities are kept across setuid and then trimmed to the spec
+	var capabilities *caps.Capabilities
+	if c := cp.Config.Process.Capabilities; c != nil {
+		capabilities, err = caps.New(c.Bounding, c.Effective, c.Inheritable, c.Permitted, c.Ambient)
+		if err != nil {
+			return util.WrapError("parse capabilities", err)
+		}
+		if err := capabilities.DropBounding(); err != nil {
+			return util.WrapError("drop bounding capabilities", err)
+		}
+		if err := caps.KeepCaps(true); err != nil {
+			return err
+		}
+	}
+
+	// Without no_new_privs the filter needs CAP_SYS_ADMIN, so it goes in
+	// before the user and capabilities change
+	if !cp.Config.Process.NoNewPrivileges {
+		if err := seccomp.Load(filter); err != nil {
+			return err
+		}
+	}
+
+	// Drop to the configured user right before exec
+	if err := cp.setupUser(execUser); err != nil {
+		return util.WrapError("setup user", err)
+	}
+
+	if capabilities != nil {
+		if err := caps.KeepCaps(false); err != nil {
+			return err
+		}
+		if err := capabilities.Apply(); err != nil {
+			return util.WrapError("apply capabilities", err)
+		}
+	}
+
+	if cp.Config.Process.NoNewPrivileges {
+		if err := caps.SetNoNewPrivileges(); err != nil {
+			return err
+		}
+		// Loaded last so the filter only has to allow execve itself
+		if err := seccomp.Load(filter); err != nil {
+			return err
+		}
+	}
+
 	// Execute the process using syscall.Exec to replace current process
 	binary := cp.Args[0]
 	args := cp.Args
 
+	if cp.Init {
+		return runInit(binary, args, env, terminal)
+	}
+
 	if err := syscall.Exec(binary, args, env); err != nil {
 		return util.NewError("exec process", err)
 	}
@@ -231,25 +954,94 @@ func (cp *ContainerProcess) execProcess() error {
 	return nil
 }
 
+// setupRlimits applies process.rlimits to the init process, which the
+// container command inherits across exec
+func (cp *ContainerProcess) setupRlimits() error {
+	for _, rlimit := range cp.Config.Process.Rlimits {
+		resource, err := rlimit.Resource()
+		if err != nil {
+			return err
+		}
+		// syscall.Setrlimit also stops exec from restoring the original
+		// RLIMIT_NOFILE that the Go runtime raised at startup
+		limit := syscall.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}
+		if err := syscall.Setrlimit(resource, &limit); err != nil {
+			return util.NewError(fmt.Sprintf("set %s", rlimit.Type), err)
+		}
+	}
+	return nil
+}
+
+// hasEnv reports whether the environment defines the given variable
+func hasEnv(env []string, name string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// rootfsManager describes the bundle's root filesystem and everything the
+// init mounts into it
+func (cp *ContainerProcess) rootfsManager() *fs.RootfsManager {
+	rootfsPath := cp.Config.GetRootfsPath(cp.BundleDir)
+	rootfsManager := fs.NewRootfsManager(rootfsPath, cp.Config.Root.Readonly)
+	rootfsManager.Mounts = cp.mountPoints()
+	rootfsManager.Overlay = cp.Overlay
+	layers := cp.Config.GetLayerPaths(cp.BundleDir)
+	rootfsManager.Layers = layers[:len(layers)-1]
+	rootfsManager.UserNamespace = cp.namespaceConfig().User
+
+	// Bundles without a mounts array get the basic set of mounts
+	if len(cp.Config.Mounts) == 0 {
+		rootfsManager.Mounts = fs.BasicMounts()
+	}
+
+	// Show the container its own cgroup unless the bundle mounts one
+	if cp.namespaceConfig().Cgroup && !hasMount(rootfsManager.Mounts, "/sys/fs/cgroup") {
+		rootfsManager.Mounts = append(rootfsManager.Mounts, fs.CgroupMount())
+	}
+
+	// The parent has written the network files by now
+	if cp.NetworkFilesDir != "" {
+		rootfsManager.Mounts = append(rootfsManager.Mounts, net.EtcMounts(cp.NetworkFilesDir)...)
+	}
+
+	return rootfsManager
+}
+
 // HandleContainerInit handles the container initialization when called as "container-init"
 func HandleContainerInit() error {
 	// This function is called when the process is executed with "container-init" argument
 	// It runs as PID 1 in the new PID namespace
+	cp, err := containerFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// Initialize container environment
+	return cp.initContainer()
+}
 
+// containerFromEnv re-creates the container the parent described in the
+// environment of the init process, see initCommand
+func containerFromEnv() (*ContainerProcess, error) {
 	// Get configuration from environment variables
 	bundleDir := os.Getenv("GOMINI_BUNDLE_DIR")
 	hostname := os.Getenv("GOMINI_HOSTNAME")
 	argsStr := os.Getenv("GOMINI_ARGS")
 	workingDir := os.Getenv("GOMINI_WORKING_DIR")
+	seccompProfile := os.Getenv("GOMINI_SECCOMP")
 
 	if bundleDir == "" {
-		return util.NewSimpleError("container init", "GOMINI_BUNDLE_DIR not set")
+		return nil, util.NewSimpleError("container init", "GOMINI_BUNDLE_DIR not set")
 	}
 
 	// Load config
 	config, err := spec.LoadConfig(bundleDir)
 	if err != nil {
-		return util.WrapError("load config in init", err)
+		return nil, util.WrapError("load config in init", err)
 	}
 
 	// Create container process
@@ -260,15 +1052,56 @@ func HandleContainerInit() error {
 	if argsStr != "" {
 		var args []string
 		if err := json.Unmarshal([]byte(argsStr), &args); err != nil {
-			return util.WrapError("unmarshal args", err)
+			return nil, util.WrapError("unmarshal args", err)
 		}
 		cp.OverrideArgs(args)
 	}
 	if workingDir != "" {
 		cp.WorkingDir = workingDir
 	}
+	if err := cp.OverrideSeccomp(seccompProfile); err != nil {
+		return nil, err
+	}
+	// The parent added a user namespace to the bundle's, which the init
+	// needs to know about. Its ID mappings are already written.
+	if os.Getenv("GOMINI_ROOTLESS") == "1" {
+		cp.EnableRootless()
+	}
+	// Only the mode matters here, the parent has set up everything else
+	if netMode := os.Getenv("GOMINI_NET"); netMode != "" {
+		cp.SetNetwork(&net.Config{Mode: netMode})
+	}
+	cp.NetworkFilesDir = os.Getenv("GOMINI_NETWORK_FILES")
+	cp.Init = os.Getenv("GOMINI_INIT") == "1"
+	if overlayDir := os.Getenv("GOMINI_OVERLAY"); overlayDir != "" {
+		cp.Overlay = fs.NewOverlay(overlayDir)
+	}
+	if cp.consoleFD, err = inheritedFD("GOMINI_CONSOLE_FD"); err != nil {
+		return nil, err
+	}
+	if cp.syncFD, err = inheritedFD("GOMINI_SYNC_FD"); err != nil {
+		return nil, err
+	}
+	// Keep the exec fifo out of the container process
+	if cp.execFifoFD, err = inheritedFD("GOMINI_EXEC_FIFO_FD"); err != nil {
+		return nil, err
+	}
 
-	// Initialize container environment
-	return cp.initContainer()
+	return cp, nil
 }
 
+// inheritedFD returns the file descriptor number passed in an environment
+// variable, or 0 if it is not set. The descriptor is closed on exec.
+func inheritedFD(name string) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, util.NewSimpleError("inherit file descriptor", fmt.Sprintf("invalid %s %q", name, value))
+	}
+	unix.CloseOnExec(fd)
+	return fd, nil
+}
@@ -0,0 +1,385 @@
+package proc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/cg"
+	"gomini/internal/ns"
+	"gomini/internal/spec"
+)
+
+func TestResourceLimitsFromSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources spec.Resources
+		expected  cg.ResourceLimits
+		empty     bool
+	}{
+		{
+			name:  "no resources",
+			empty: true,
+		},
+		{
+			name:      "cpu",
+			resources: spec.Resources{CPU: spec.CPU{Quota: 50000, Period: 100000, Cpus: "0-1", Mems: "0"}},
+			expected:  cg.ResourceLimits{CPUQuota: 50000, CPUPeriod: 100000, CPUSetCPUs: "0-1", CPUSetMems: "0"},
+		},
+		{
+			name:      "memory",
+			resources: spec.Resources{Memory: spec.Memory{Limit: 64 << 20, Reservation: 32 << 20}},
+			expected:  cg.ResourceLimits{Memory: 64 << 20, MemoryLow: 32 << 20},
+		},
+		{
+			name:      "pids",
+			resources: spec.Resources{Pids: spec.Pids{Limit: 100}},
+			expected:  cg.ResourceLimits{Pids: 100},
+		},
+		{
+			name:      "unified",
+			resources: spec.Resources{Unified: map[string]string{"memory.high": "1G"}},
+			expected:  cg.ResourceLimits{Unified: map[string]string{"memory.high": "1G"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := ResourceLimitsFromSpec(tt.resources)
+			if !reflect.DeepEqual(*limits, tt.expected) {
+				t.Errorf("ResourceLimitsFromSpec() = %+v, want %+v", *limits, tt.expected)
+			}
+			if limits.IsEmpty() != tt.empty {
+				t.Errorf("IsEmpty() = %v, want %v", limits.IsEmpty(), tt.empty)
+			}
+		})
+	}
+}
+
+func TestResourceLimitsFromSpecSwap(t *testing.T) {
+	tests := []struct {
+		name     string
+		memory   spec.Memory
+		expected *int64
+	}{
+		{"unset", spec.Memory{Limit: 1 << 20}, nil},
+		{"unlimited", spec.Memory{Limit: 1 << 20, Swap: -1}, int64Ptr(-1)},
+		{"swap on top of the limit", spec.Memory{Limit: 1 << 20, Swap: 3 << 20}, int64Ptr(2 << 20)},
+		{"no swap", spec.Memory{Limit: 1 << 20, Swap: 1 << 20}, int64Ptr(0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := ResourceLimitsFromSpec(spec.Resources{Memory: tt.memory})
+			if !reflect.DeepEqual(limits.MemorySwap, tt.expected) {
+				t.Errorf("MemorySwap = %v, want %v", deref(limits.MemorySwap), deref(tt.expected))
+			}
+		})
+	}
+}
+
+func TestResourceLimitsFromSpecWeights(t *testing.T) {
+	limits := ResourceLimitsFromSpec(spec.Resources{
+		CPU: spec.CPU{Shares: 1024},
+		BlockIO: spec.BlockIO{
+			Weight:       500,
+			WeightDevice: []spec.WeightDevice{{Major: 8, Minor: 0, Weight: 1000}},
+		},
+	})
+
+	if limits.CPUWeight != 39 {
+		t.Errorf("CPUWeight = %d, want 39", limits.CPUWeight)
+	}
+	if limits.IOWeight != 4950 {
+		t.Errorf("IOWeight = %d, want 4950", limits.IOWeight)
+	}
+	expected := []cg.IOWeightDevice{{Major: 8, Minor: 0, Weight: 10000}}
+	if !reflect.DeepEqual(limits.IOWeightDevices, expected) {
+		t.Errorf("IOWeightDevices = %+v, want %+v", limits.IOWeightDevices, expected)
+	}
+}
+
+func TestResourceLimitsFromSpecThrottles(t *testing.T) {
+	limits := ResourceLimitsFromSpec(spec.Resources{
+		BlockIO: spec.BlockIO{
+			ThrottleReadBpsDevice:   []spec.ThrottleDevice{{Major: 8, Minor: 16, Rate: 100}},
+			ThrottleWriteBpsDevice:  []spec.ThrottleDevice{{Major: 8, Minor: 0, Rate: 200}, {Major: 8, Minor: 16, Rate: 300}},
+			ThrottleReadIOPSDevice:  []spec.ThrottleDevice{{Major: 8, Minor: 0, Rate: 10}},
+			ThrottleWriteIOPSDevice: []spec.ThrottleDevice{{Major: 253, Minor: 1, Rate: 20}},
+		},
+	})
+
+	// One entry per device, in the order the devices first appear
+	expected := []cg.IOMaxDevice{
+		{Major: 8, Minor: 16, ReadBps: 100, WriteBps: 300},
+		{Major: 8, Minor: 0, WriteBps: 200, ReadIOPS: 10},
+		{Major: 253, Minor: 1, WriteIOPS: 20},
+	}
+	if !reflect.DeepEqual(limits.IOMaxDevices, expected) {
+		t.Errorf("IOMaxDevices = %+v, want %+v", limits.IOMaxDevices, expected)
+	}
+}
+
+func TestResourceLimitsFromSpecHugepages(t *testing.T) {
+	limits := ResourceLimitsFromSpec(spec.Resources{
+		HugepageLimits: []spec.HugepageLimit{{PageSize: "2MB", Limit: 4 << 20}, {PageSize: "1GB", Limit: 0}},
+	})
+
+	expected := map[string]uint64{"2MB": 4 << 20, "1GB": 0}
+	if !reflect.DeepEqual(limits.HugetlbLimits, expected) {
+		t.Errorf("HugetlbLimits = %v, want %v", limits.HugetlbLimits, expected)
+	}
+	if empty := ResourceLimitsFromSpec(spec.Resources{}); !empty.IsEmpty() {
+		t.Errorf("limits of empty resources = %+v, want none", empty)
+	}
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func deref(p *int64) any {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// writeBundle writes a bundle with the config to a temporary directory
+func writeBundle(t *testing.T, config *spec.Config) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestContainerFromEnvRootless(t *testing.T) {
+	config := &spec.Config{
+		OCIVersion: "1.0.2",
+		Process:    spec.Process{Args: []string{"/bin/sh"}},
+		Root:       spec.Root{Path: "rootfs"},
+		Linux:      spec.Linux{Namespaces: []spec.Namespace{{Type: "pid"}, {Type: "mount"}}},
+	}
+	bundle := writeBundle(t, config)
+
+	tests := []struct {
+		name     string
+		rootless bool
+	}{
+		{"rootless", true},
+		{"privileged", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := NewContainerProcess(config, bundle)
+			if tt.rootless {
+				parent.EnableRootless()
+			}
+			cmd, err := parent.initCommand(parent.namespaceConfig())
+			if err != nil {
+				t.Fatalf("initCommand() error = %v", err)
+			}
+
+			// The init sees only what the command passes on
+			t.Setenv("GOMINI_ROOTLESS", "")
+			for _, env := range cmd.Env {
+				if name, value, ok := strings.Cut(env, "="); ok && strings.HasPrefix(name, "GOMINI_") {
+					t.Setenv(name, value)
+				}
+			}
+
+			init, err := containerFromEnv()
+			if err != nil {
+				t.Fatalf("containerFromEnv() error = %v", err)
+			}
+			if init.Rootless != tt.rootless {
+				t.Errorf("Rootless = %v, want %v", init.Rootless, tt.rootless)
+			}
+			if got := init.namespaceConfig().User; got != tt.rootless {
+				t.Errorf("user namespace = %v, want %v", got, tt.rootless)
+			}
+			if got := init.rootfsManager().UserNamespace; got != tt.rootless {
+				t.Errorf("rootfs UserNamespace = %v, want %v", got, tt.rootless)
+			}
+		})
+	}
+}
+
+func TestJoinedNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []spec.Namespace
+		expected   []ns.Path
+		wantErr    bool
+	}{
+		{
+			name:       "none joined",
+			namespaces: []spec.Namespace{{Type: "pid"}, {Type: "time"}},
+		},
+		{
+			name: "join order",
+			namespaces: []spec.Namespace{
+				{Type: "mount", Path: "/proc/1/ns/mnt"},
+				{Type: "pid"},
+				{Type: "network", Path: "/var/run/netns/test"},
+				{Type: "ipc", Path: "/proc/1/ns/ipc"},
+			},
+			expected: []ns.Path{
+				{Type: ns.IPC, Path: "/proc/1/ns/ipc"},
+				{Type: ns.NET, Path: "/var/run/netns/test"},
+				{Type: ns.MOUNT, Path: "/proc/1/ns/mnt"},
+			},
+		},
+		{
+			name:       "user",
+			namespaces: []spec.Namespace{{Type: "user", Path: "/proc/1/ns/user"}},
+			wantErr:    true,
+		},
+		{
+			name:       "time",
+			namespaces: []spec.Namespace{{Type: "time", Path: "/proc/1/ns/time"}},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown type",
+			namespaces: []spec.Namespace{{Type: "bogus", Path: "/proc/1/ns/bogus"}},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := NewContainerProcess(&spec.Config{Linux: spec.Linux{Namespaces: tt.namespaces}}, "")
+			got, err := cp.joinedNamespaces()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("joinedNamespaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("joinedNamespaces() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExitError(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		expected int
+	}{
+		{name: "success", script: "exit 0", expected: 0},
+		{name: "exit status", script: "exit 3", expected: 3},
+		{name: "SIGKILL", script: "kill -KILL $$", expected: 137},
+		{name: "SIGTERM", script: "kill -TERM $$", expected: 143},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := exitError(exec.Command("/bin/sh", "-c", tt.script).Run())
+			if tt.expected == 0 {
+				if err != nil {
+					t.Errorf("exitError() = %v, want nil", err)
+				}
+				return
+			}
+
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("exitError() = %v, want an ExitError", err)
+			}
+			if exitErr.Code != tt.expected {
+				t.Errorf("exitError() code = %d, want %d", exitErr.Code, tt.expected)
+			}
+		})
+	}
+
+	// Failing to wait at all is not an exit status
+	err := exitError(exec.Command("/nonexistent").Run())
+	var exitErr *ExitError
+	if err == nil || errors.As(err, &exitErr) {
+		t.Errorf("exitError() = %v, want a plain error", err)
+	}
+}
+
+func TestRelaySignals(t *testing.T) {
+	console, err := os.CreateTemp(t.TempDir(), "console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer console.Close()
+
+	incoming := []os.Signal{unix.SIGCHLD, unix.SIGTERM, unix.SIGPIPE, unix.SIGWINCH, unix.SIGURG, unix.SIGINT, unix.SIGUSR1}
+	tests := []struct {
+		name      string
+		console   *os.File
+		forwarded []syscall.Signal
+		resizes   int
+	}{
+		{
+			name:      "without console",
+			forwarded: []syscall.Signal{unix.SIGTERM, unix.SIGWINCH, unix.SIGINT, unix.SIGUSR1},
+		},
+		{
+			name:      "with console",
+			console:   console,
+			forwarded: []syscall.Signal{unix.SIGTERM, unix.SIGINT, unix.SIGUSR1},
+			resizes:   1,
+		},
+	}
+
+	defer func() {
+		signalProcess = unix.Kill
+		resizeTerminal = resizeConsole
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded []syscall.Signal
+			resizes := 0
+			signalProcess = func(pid int, sig syscall.Signal) error {
+				if pid != 4242 {
+					t.Errorf("signal %v sent to %d, want 4242", sig, pid)
+				}
+				forwarded = append(forwarded, sig)
+				return nil
+			}
+			resizeTerminal = func(master *os.File) {
+				if master != tt.console {
+					t.Errorf("resized %v, want the console", master)
+				}
+				resizes++
+			}
+
+			signals := make(chan os.Signal, len(incoming))
+			for _, sig := range incoming {
+				signals <- sig
+			}
+			close(signals)
+			relaySignals(signals, 4242, tt.console)
+
+			if !reflect.DeepEqual(forwarded, tt.forwarded) {
+				t.Errorf("forwarded %v, want %v", forwarded, tt.forwarded)
+			}
+			if resizes != tt.resizes {
+				t.Errorf("resized %d times, want %d", resizes, tt.resizes)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package proc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/ns"
+	"gomini/internal/nsenter"
+	"gomini/internal/spec"
+	"gomini/internal/util"
+)
+
+// Exec runs the process as an additional process of the running container
+// whose init is pid. A "container-exec" helper joins the namespaces and root
+// directory of the init on startup, see the nsenter package, and is placed
+// in the container's cgroup. Its PID namespace is joined later, see
+// HandleContainerExec. It then applies the user, capabilities and
+// environment of the bundle and forks the process, since a PID namespace
+// only applies to children. The helper stays in front of the process like
+// --init and passes on its exit status.
+func (cp *ContainerProcess) Exec(pid int) error {
+	if !nsenter.Supported {
+		return util.NewSimpleError("exec", "gomini was built without cgo, which exec needs to join namespaces")
+	}
+
+	cmd, err := cp.execCommand()
+	if err != nil {
+		return err
+	}
+
+	// The namespaces and the root are opened here and inherited, since the
+	// helper has no Go code running yet when it needs them
+	paths, err := ns.ProcessPaths(pid)
+	if err != nil {
+		return util.WrapError("join namespaces", err)
+	}
+	first := 3 + len(cmd.ExtraFiles)
+	for _, p := range paths {
+		fd, err := ns.Open(p)
+		if err != nil {
+			return util.WrapError("join namespaces", err)
+		}
+		file := os.NewFile(uintptr(fd), p.Path)
+		defer file.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+	}
+	cmd.Env = append(cmd.Env, nsenterEnv(paths, first)...)
+
+	// The helper cannot see itself in the container's /proc
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/setgroups", pid)); err == nil && strings.TrimSpace(string(data)) == "deny" {
+		cmd.Env = append(cmd.Env, "GOMINI_SETGROUPS=deny")
+	}
+
+	rootPath := fmt.Sprintf("/proc/%d/root", pid)
+	rootFD, err := unix.Open(rootPath, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return util.NewPathError("open container root", rootPath, err)
+	}
+	root := os.NewFile(uintptr(rootFD), rootPath)
+	defer root.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, root)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GOMINI_NSENTER_ROOT=%d", 2+len(cmd.ExtraFiles)))
+
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+
+	// The namespaces are joined by the helper itself, not through startInit
+	if err := cp.startInit(cmd, nil); err != nil {
+		return err
+	}
+	go relaySignals(signals, cmd.Process.Pid, cp.console)
+
+	if cp.console != nil {
+		finish := proxyConsole(cp.console)
+		defer finish()
+	}
+
+	return exitError(cmd.Wait())
+}
+
+// nsenterEnv tells the helper which of its descriptors hold the namespaces
+// to join, given that they are inherited in the order of paths from
+// descriptor first on
+func nsenterEnv(paths []ns.Path, first int) []string {
+	var env, fds []string
+	for i, p := range paths {
+		// The kernel refuses to create threads once a process has joined
+		// another PID namespace for its children, so that one is left to
+		// the helper's locked thread
+		if p.Type == ns.PID {
+			env = append(env, fmt.Sprintf("GOMINI_PID_NS_FD=%d", first+i))
+			continue
+		}
+		fds = append(fds, strconv.Itoa(first+i))
+	}
+	return append(env, "GOMINI_NSENTER_FDS="+strings.Join(fds, ","))
+}
+
+// execCommand prepares the "container-exec" helper and passes the process
+// settings through the environment
+func (cp *ContainerProcess) execCommand() (*exec.Cmd, error) {
+	cmd := exec.Command("/proc/self/exe", "container-exec")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// The helper is confined to the container's root before it could read
+	// the bundle, so it gets the configuration itself, overrides included
+	configJSON, err := json.Marshal(cp.Config)
+	if err != nil {
+		return nil, util.NewError("marshal config", err)
+	}
+	argsJSON, err := json.Marshal(cp.Args)
+	if err != nil {
+		return nil, util.NewError("marshal args", err)
+	}
+
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GOMINI_CONFIG=%s", string(configJSON)),
+		fmt.Sprintf("GOMINI_ARGS=%s", string(argsJSON)),
+		fmt.Sprintf("GOMINI_WORKING_DIR=%s", cp.WorkingDir),
+	)
+
+	return cmd, nil
+}
+
+// HandleContainerExec runs the process of "gomini exec" when called as
+// "container-exec", inside the namespaces and root the helper has joined
+func HandleContainerExec() error {
+	configStr := os.Getenv("GOMINI_CONFIG")
+	if configStr == "" {
+		return util.NewSimpleError("container exec", "GOMINI_CONFIG not set")
+	}
+
+	var config spec.Config
+	if err := json.Unmarshal([]byte(configStr), &config); err != nil {
+		return util.WrapError("unmarshal config", err)
+	}
+
+	cp := NewContainerProcess(&config, "")
+	if argsStr := os.Getenv("GOMINI_ARGS"); argsStr != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(argsStr), &args); err != nil {
+			return util.WrapError("unmarshal args", err)
+		}
+		cp.OverrideArgs(args)
+	}
+	if workingDir := os.Getenv("GOMINI_WORKING_DIR"); workingDir != "" {
+		cp.WorkingDir = workingDir
+	}
+	var err error
+	if cp.consoleFD, err = inheritedFD("GOMINI_CONSOLE_FD"); err != nil {
+		return err
+	}
+	if cp.syncFD, err = inheritedFD("GOMINI_SYNC_FD"); err != nil {
+		return err
+	}
+	cp.setgroupsDenied = os.Getenv("GOMINI_SETGROUPS") == "deny"
+	pidNamespaceFD, err := inheritedFD("GOMINI_PID_NS_FD")
+	if err != nil {
+		return err
+	}
+
+	// Capabilities and the PID namespace for children are per thread, so
+	// every step up to the fork stays on this one
+	runtime.LockOSThread()
+
+	if pidNamespaceFD != 0 {
+		err := ns.Join(pidNamespaceFD, ns.PID)
+		unix.Close(pidNamespaceFD)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The parent places us in the container's cgroup meanwhile
+	if err := cp.waitForParent(); err != nil {
+		return util.WrapError("wait for parent", err)
+	}
+
+	if cp.WorkingDir != "" {
+		if err := os.Chdir(cp.WorkingDir); err != nil {
+			return util.NewPathError("change working directory", cp.WorkingDir, err)
+		}
+	}
+
+	// We are outside of a joined PID namespace ourselves, only the process
+	// we fork is created inside it
+	cp.Init = true
+	return cp.execProcess()
+}
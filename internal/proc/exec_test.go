@@ -0,0 +1,59 @@
+package proc
+
+import (
+	"reflect"
+	"testing"
+
+	"gomini/internal/ns"
+)
+
+func TestNsenterEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []ns.Path
+		first    int
+		expected []string
+	}{
+		{
+			name:     "no namespaces",
+			first:    3,
+			expected: []string{"GOMINI_NSENTER_FDS="},
+		},
+		{
+			name:     "descriptors in path order",
+			paths:    []ns.Path{{Type: ns.USER}, {Type: ns.UTS}, {Type: ns.MOUNT}},
+			first:    3,
+			expected: []string{"GOMINI_NSENTER_FDS=3,4,5"},
+		},
+		{
+			name:     "pid namespace left to the helper",
+			paths:    []ns.Path{{Type: ns.USER}, {Type: ns.NET}, {Type: ns.PID}, {Type: ns.MOUNT}},
+			first:    4,
+			expected: []string{"GOMINI_PID_NS_FD=6", "GOMINI_NSENTER_FDS=4,5,7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nsenterEnv(tt.paths, tt.first); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("nsenterEnv() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNsenterEnvJoinOrder(t *testing.T) {
+	// Descriptors are inherited in the order the paths come in, so once
+	// sorted the user namespace is entered first and the mount one last
+	paths := []ns.Path{{Type: ns.MOUNT}, {Type: ns.IPC}, {Type: ns.USER}, {Type: ns.UTS}}
+	ns.SortPaths(paths)
+
+	env := nsenterEnv(paths, 3)
+	expected := []string{"GOMINI_NSENTER_FDS=3,4,5,6"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("nsenterEnv() = %v, want %v", env, expected)
+	}
+	if paths[0].Type != ns.USER || paths[len(paths)-1].Type != ns.MOUNT {
+		t.Errorf("joined %v, want user first and mount last", paths)
+	}
+}
@@ -0,0 +1,100 @@
+package proc
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/ns"
+	"gomini/internal/util"
+)
+
+// runInit starts the container command as a child and stays in front of it
+// as a minimal init: catchable signals are forwarded to the command and every
+// child that exits is reaped, including orphans of the command. It exits with
+// the command's status and only returns if the command cannot be started.
+// With a terminal, stdin is the container's pty.
+func runInit(binary string, args, env []string, terminal bool) error {
+	// Orphans are reparented to PID 1, but without a PID namespace that is
+	// not us, so ask the kernel to hand them to us instead
+	if os.Getpid() != 1 {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return util.NewError("become child subreaper", err)
+		}
+	}
+
+	// Subscribe before the command exists so that no signal is missed. PID 1
+	// only receives signals it has a handler for, which this installs.
+	signals := make(chan os.Signal, 64)
+	signal.Notify(signals)
+
+	attr := &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	}
+	// On a terminal the command gets the foreground, so keys like Ctrl-C
+	// signal it directly rather than through us
+	if terminal {
+		attr.Sys = &syscall.SysProcAttr{Setpgid: true, Foreground: true, Ctty: 0}
+	}
+
+	process, err := os.StartProcess(binary, args, attr)
+	if err != nil {
+		return util.NewError("exec process", err)
+	}
+	pid := process.Pid
+	// Children are reaped with wait4 below, the handle is not needed
+	process.Release()
+
+	status := superviseCommand(signals, pid)
+	code, err := ns.ExitStatus(status)
+	if err != nil {
+		code = 1
+	}
+	os.Exit(code)
+	return nil
+}
+
+// superviseCommand forwards signals to the command and reaps children until
+// the command has exited, and returns its wait status
+func superviseCommand(signals <-chan os.Signal, pid int) syscall.WaitStatus {
+	for sig := range signals {
+		switch sig {
+		case unix.SIGCHLD:
+			if status, exited := reapChildren(pid); exited {
+				return status
+			}
+		case unix.SIGURG:
+			// Sent by the Go runtime to preempt goroutines
+		default:
+			signalProcess(pid, sig.(syscall.Signal))
+		}
+	}
+
+	return 0
+}
+
+// signalProcess delivers forwarded signals, replaced in tests
+var signalProcess = unix.Kill
+
+// reapChildren collects every child that has exited and reports the status
+// of the container command once it is among them
+func reapChildren(pid int) (syscall.WaitStatus, bool) {
+	var result syscall.WaitStatus
+	exited := false
+
+	for {
+		var status syscall.WaitStatus
+		child, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || child <= 0 {
+			return result, exited
+		}
+		if child == pid {
+			result, exited = status, true
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package proc
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSuperviseCommandForwarding(t *testing.T) {
+	var forwarded []syscall.Signal
+	signalProcess = func(pid int, sig syscall.Signal) error {
+		if pid != 4242 {
+			t.Errorf("signal %v sent to %d, want 4242", sig, pid)
+		}
+		forwarded = append(forwarded, sig)
+		return nil
+	}
+	defer func() { signalProcess = unix.Kill }()
+
+	signals := make(chan os.Signal, 8)
+	for _, sig := range []os.Signal{unix.SIGURG, unix.SIGTERM, unix.SIGHUP, unix.SIGURG, unix.SIGINT, unix.SIGWINCH, unix.SIGPIPE} {
+		signals <- sig
+	}
+	close(signals)
+
+	superviseCommand(signals, 4242)
+
+	expected := []syscall.Signal{unix.SIGTERM, unix.SIGHUP, unix.SIGINT, unix.SIGWINCH, unix.SIGPIPE}
+	if !reflect.DeepEqual(forwarded, expected) {
+		t.Errorf("forwarded %v, want %v", forwarded, expected)
+	}
+}
+
+func TestSuperviseCommandReaping(t *testing.T) {
+	start := func(args ...string) int {
+		process, err := os.StartProcess(args[0], args, &os.ProcAttr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid := process.Pid
+		process.Release()
+		return pid
+	}
+
+	// An exited child other than the command, like an orphan handed to init
+	other := start("/bin/true")
+	waitZombie(t, other)
+	command := start("/bin/sleep", "30")
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan syscall.WaitStatus)
+	go func() {
+		done <- superviseCommand(signals, command)
+	}()
+
+	signals <- unix.SIGTERM
+	var status syscall.WaitStatus
+	for exited := false; !exited; {
+		select {
+		case status = <-done:
+			exited = true
+		case signals <- unix.SIGCHLD:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !status.Signaled() || status.Signal() != unix.SIGTERM {
+		t.Errorf("superviseCommand() = %#x, want killed by SIGTERM", status)
+	}
+	if _, err := syscall.Wait4(other, nil, syscall.WNOHANG, nil); err != syscall.ECHILD {
+		t.Errorf("Wait4() error = %v, want ECHILD as the other child is reaped", err)
+	}
+}
+
+// waitZombie waits until a child has exited without being reaped
+func waitZombie(t *testing.T, pid int) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The state follows the command name in parentheses
+		if fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:])); len(fields) > 0 && fields[0] == "Z" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process %d did not exit", pid)
+}
@@ -0,0 +1,122 @@
+package proc
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/state"
+	"gomini/internal/util"
+)
+
+// Create starts the container init process and leaves it parked on the exec
+// fifo at fifoPath. The init process completes the namespace, rootfs and mount
+// setup and then blocks until Start opens the fifo. It returns the init PID.
+func (cp *ContainerProcess) Create(fifoPath string) (int, error) {
+	// Nobody would be left to read the terminal once create exits
+	if cp.Config.Process.Terminal && cp.ConsoleSocket == "" {
+		return 0, util.NewSimpleError("create container", "process.terminal requires --console-socket")
+	}
+
+	if err := unix.Mkfifo(fifoPath, 0600); err != nil {
+		return 0, util.NewPathError("create exec fifo", fifoPath, err)
+	}
+
+	// An O_PATH descriptor survives the root switch in the child, which later
+	// reopens it through /proc/self/fd for writing
+	fd, err := unix.Open(fifoPath, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, util.NewPathError("open exec fifo", fifoPath, err)
+	}
+	fifo := os.NewFile(uintptr(fd), fifoPath)
+	defer fifo.Close()
+
+	// The init process is always forked so that it outlives this command
+	cmd, err := cp.initCommand(cp.namespaceConfig())
+	if err != nil {
+		return 0, err
+	}
+	cmd.ExtraFiles = []*os.File{fifo}
+	cmd.Env = append(cmd.Env, "GOMINI_EXEC_FIFO_FD=3")
+
+	joined, err := cp.joinedNamespaces()
+	if err != nil {
+		return 0, err
+	}
+	if err := cp.startInit(cmd, joined); err != nil {
+		return 0, err
+	}
+
+	// Let the child be reparented once we exit instead of waiting for it
+	pid := cmd.Process.Pid
+	if err := cmd.Process.Release(); err != nil {
+		return 0, util.NewError("release container process", err)
+	}
+
+	return pid, nil
+}
+
+// startTimeout bounds how long Start waits for the init process to reach
+// the exec fifo
+const startTimeout = 10 * time.Second
+
+// Start releases a created container by reading from its exec fifo. The
+// fifo is opened without blocking and polled, so an init process that died
+// or never gets to the fifo fails the start instead of hanging it.
+func Start(fifoPath string, pid int) error {
+	fd, err := unix.Open(fifoPath, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return util.NewPathError("open exec fifo", fifoPath, err)
+	}
+	defer unix.Close(fd)
+
+	buf := make([]byte, 1)
+	deadline := time.Now().Add(startTimeout)
+	for {
+		// Nothing to read yet either fails with EAGAIN or, as long as the
+		// init has not opened its end, reads end of file
+		n, err := unix.Read(fd, buf)
+		if n > 0 {
+			break
+		}
+		if err != nil && err != unix.EAGAIN {
+			return util.NewPathError("read exec fifo", fifoPath, err)
+		}
+		if !state.ProcessAlive(pid) {
+			return util.NewSimpleError("start container", "container init exited before start")
+		}
+		if time.Now().After(deadline) {
+			return util.NewSimpleError("start container", fmt.Sprintf("container init did not reach the exec fifo within %s", startTimeout))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.Remove(fifoPath); err != nil {
+		return util.NewPathError("remove exec fifo", fifoPath, err)
+	}
+
+	return nil
+}
+
+// waitForStart blocks on the exec fifo until Start reads from it
+func (cp *ContainerProcess) waitForStart() error {
+	if cp.execFifoFD == 0 {
+		return nil
+	}
+
+	path := fmt.Sprintf("/proc/self/fd/%d", cp.execFifoFD)
+	fd, err := unix.Open(path, unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return util.NewPathError("open exec fifo", path, err)
+	}
+	defer unix.Close(fd)
+
+	if _, err := unix.Write(fd, []byte("0")); err != nil {
+		return util.NewError("write exec fifo", err)
+	}
+
+	unix.Close(cp.execFifoFD)
+	cp.execFifoFD = 0
+	return nil
+}
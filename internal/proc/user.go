@@ -0,0 +1,178 @@
+package proc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gomini/internal/util"
+)
+
+const (
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+)
+
+// ExecUser is the resolved identity the container process runs as
+type ExecUser struct {
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+}
+
+// resolveUser determines the container user from the spec. A username is
+// looked up in the container's /etc/passwd and /etc/group, so this must run
+// after the root switch.
+func (cp *ContainerProcess) resolveUser() (*ExecUser, error) {
+	user := cp.Config.Process.User
+	execUser := &ExecUser{UID: user.UID, GID: user.GID}
+
+	if user.Username != "" {
+		entry, err := lookupPasswd(passwdPath, user.Username)
+		if err != nil {
+			return nil, err
+		}
+		execUser.UID = entry.uid
+		execUser.GID = entry.gid
+		execUser.Home = entry.home
+
+		groups, err := lookupGroupMembership(groupPath, user.Username)
+		if err != nil {
+			return nil, err
+		}
+		execUser.Groups = append(execUser.Groups, groups...)
+	}
+
+	for _, gid := range user.AdditionalGids {
+		execUser.Groups = append(execUser.Groups, int(gid))
+	}
+
+	return execUser, nil
+}
+
+// setupUser switches credentials to the container user. It runs right
+// before exec since the process loses its privileges afterwards.
+func (cp *ContainerProcess) setupUser(execUser *ExecUser) error {
+	// setgroups is refused in user namespaces that deny it
+	if !cp.setgroupsDenied && setgroupsAllowed() {
+		if err := syscall.Setgroups(execUser.Groups); err != nil {
+			return util.NewError("setgroups", err)
+		}
+	}
+
+	if err := syscall.Setgid(execUser.GID); err != nil {
+		return util.NewError("setgid", err)
+	}
+
+	if err := syscall.Setuid(execUser.UID); err != nil {
+		return util.NewError("setuid", err)
+	}
+
+	if umask := cp.Config.Process.User.Umask; umask != nil {
+		syscall.Umask(int(*umask))
+	}
+
+	return nil
+}
+
+// setgroupsAllowed reports whether setgroups(2) is permitted in the current
+// user namespace
+func setgroupsAllowed() bool {
+	data, err := os.ReadFile("/proc/self/setgroups")
+	if err != nil {
+		// Kernels without the file have no setgroups restriction
+		return true
+	}
+	return strings.TrimSpace(string(data)) != "deny"
+}
+
+// passwdEntry holds the fields of an /etc/passwd line gomini needs
+type passwdEntry struct {
+	uid  int
+	gid  int
+	home string
+}
+
+// lookupPasswd finds a user by name in a passwd file
+func lookupPasswd(path string, name string) (*passwdEntry, error) {
+	var entry *passwdEntry
+	err := scanColonFile(path, func(fields []string) bool {
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 6 || fields[0] != name {
+			return false
+		}
+		uid, uidErr := strconv.Atoi(fields[2])
+		gid, gidErr := strconv.Atoi(fields[3])
+		if uidErr != nil || gidErr != nil {
+			return false
+		}
+		entry = &passwdEntry{uid: uid, gid: gid, home: fields[5]}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, util.NewSimpleError("lookup user", fmt.Sprintf("user %q not found in %s", name, path))
+	}
+
+	return entry, nil
+}
+
+// lookupGroupMembership returns the GIDs of the groups listing the user as a member
+func lookupGroupMembership(path string, name string) ([]int, error) {
+	var gids []int
+	err := scanColonFile(path, func(fields []string) bool {
+		// name:password:gid:member,member
+		if len(fields) < 4 {
+			return false
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == name {
+				if gid, err := strconv.Atoi(fields[2]); err == nil {
+					gids = append(gids, gid)
+				}
+				break
+			}
+		}
+		return false
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return gids, nil
+}
+
+// scanColonFile calls fn with the fields of each line of a colon-separated
+// file until fn returns true
+func scanColonFile(path string, fn func(fields []string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return util.NewPathError("open", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fn(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return util.NewPathError("read", path, err)
+	}
+
+	return nil
+}
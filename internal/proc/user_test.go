@@ -0,0 +1,94 @@
+package proc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testPasswd = `# comment
+root:x:0:0:root:/root:/bin/sh
+
+broken:x:uid:100:broken:/nowhere:/bin/sh
+app:x:1000:1000:app:/home/app:/bin/sh
+short:x:1001:1001
+`
+
+const testGroup = `root:x:0:
+wheel:x:10:root,app
+app:x:1000:
+docker:x:999:other,app
+bogus:x:gid:app
+`
+
+func writeTestFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookupPasswd(t *testing.T) {
+	path := writeTestFile(t, "passwd", testPasswd)
+
+	tests := []struct {
+		name     string
+		expected *passwdEntry
+		wantErr  bool
+	}{
+		{"root", &passwdEntry{uid: 0, gid: 0, home: "/root"}, false},
+		{"app", &passwdEntry{uid: 1000, gid: 1000, home: "/home/app"}, false},
+		{"broken", nil, true},
+		{"short", nil, true},
+		{"missing", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupPasswd(path, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupPasswd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("lookupPasswd() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+
+	if _, err := lookupPasswd(filepath.Join(t.TempDir(), "passwd"), "root"); err == nil {
+		t.Error("lookupPasswd() without a passwd file succeeded, want an error")
+	}
+}
+
+func TestLookupGroupMembership(t *testing.T) {
+	path := writeTestFile(t, "group", testGroup)
+
+	tests := []struct {
+		name     string
+		expected []int
+	}{
+		{"app", []int{10, 999}},
+		{"root", []int{10}},
+		{"nobody", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupGroupMembership(path, tt.name)
+			if err != nil {
+				t.Fatalf("lookupGroupMembership() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("lookupGroupMembership() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+
+	// A rootfs without /etc/group has no supplementary groups
+	if got, err := lookupGroupMembership(filepath.Join(t.TempDir(), "group"), "app"); err != nil || got != nil {
+		t.Errorf("lookupGroupMembership() without a group file = %v, %v, want none", got, err)
+	}
+}
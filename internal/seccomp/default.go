@@ -0,0 +1,138 @@
+package seccomp
+
+import (
+	"golang.org/x/sys/unix"
+	"gomini/internal/spec"
+)
+
+// defaultAllowed lists the syscalls the default profile always permits. It
+// follows the well-known container default: everything a normal program needs,
+// without kernel module, mount, namespace, tracing, clock and reboot control.
+var defaultAllowed = []string{
+	"_llseek", "_newselect", "accept", "accept4", "access", "adjtimex", "alarm",
+	"arch_prctl", "bind", "brk", "cachestat", "capget", "capset", "chdir", "chmod",
+	"chown", "chown32", "clock_adjtime", "clock_adjtime64", "clock_getres", "clock_getres_time64",
+	"clock_gettime", "clock_gettime64", "clock_nanosleep", "clock_nanosleep_time64",
+	"close", "close_range", "connect", "copy_file_range", "creat", "dup", "dup2",
+	"dup3", "epoll_create", "epoll_create1", "epoll_ctl", "epoll_ctl_old", "epoll_pwait",
+	"epoll_pwait2", "epoll_wait", "epoll_wait_old", "eventfd", "eventfd2", "execve",
+	"execveat", "exit", "exit_group", "faccessat", "faccessat2", "fadvise64",
+	"fadvise64_64", "fallocate", "fanotify_mark", "fchdir", "fchmod", "fchmodat",
+	"fchmodat2", "fchown", "fchown32", "fchownat", "fcntl", "fcntl64", "fdatasync",
+	"fgetxattr", "flistxattr", "flock", "fork", "fremovexattr", "fsetxattr",
+	"fstat", "fstat64", "fstatat64", "fstatfs", "fstatfs64", "fsync", "ftruncate",
+	"ftruncate64", "futex", "futex_requeue", "futex_time64", "futex_wait", "futex_waitv",
+	"futex_wake", "futimesat", "get_robust_list", "get_thread_area", "getcpu",
+	"getcwd", "getdents", "getdents64", "getegid", "getegid32", "geteuid", "geteuid32",
+	"getgid", "getgid32", "getgroups", "getgroups32", "getitimer", "getpeername",
+	"getpgid", "getpgrp", "getpid", "getppid", "getpriority", "getrandom", "getresgid",
+	"getresgid32", "getresuid", "getresuid32", "getrlimit", "getrusage", "getsid",
+	"getsockname", "getsockopt", "gettid", "gettimeofday", "getuid", "getuid32",
+	"getxattr", "inotify_add_watch", "inotify_init", "inotify_init1", "inotify_rm_watch",
+	"io_cancel", "io_destroy", "io_getevents", "io_pgetevents", "io_pgetevents_time64",
+	"io_setup", "io_submit", "ioctl", "ioprio_get", "ioprio_set", "ipc", "kill",
+	"landlock_add_rule", "landlock_create_ruleset", "landlock_restrict_self",
+	"lchown", "lchown32", "lgetxattr", "link", "linkat", "listen", "listxattr",
+	"llistxattr", "lremovexattr", "lseek", "lsetxattr", "lstat", "lstat64", "madvise",
+	"map_shadow_stack", "membarrier", "memfd_create", "memfd_secret", "mincore",
+	"mkdir", "mkdirat", "mknod", "mknodat", "mlock", "mlock2", "mlockall", "mmap",
+	"mmap2", "modify_ldt", "mprotect", "mq_getsetattr", "mq_notify", "mq_open",
+	"mq_timedreceive", "mq_timedreceive_time64", "mq_timedsend", "mq_timedsend_time64",
+	"mq_unlink", "mremap", "msgctl", "msgget", "msgrcv", "msgsnd", "msync", "munlock",
+	"munlockall", "munmap", "name_to_handle_at", "nanosleep", "newfstatat", "open",
+	"openat", "openat2", "pause", "pidfd_open", "pidfd_send_signal", "pipe",
+	"pipe2", "pkey_alloc", "pkey_free", "pkey_mprotect", "poll", "ppoll", "ppoll_time64",
+	"prctl", "pread64", "preadv", "preadv2", "prlimit64", "process_mrelease",
+	"pselect6", "pselect6_time64", "pwrite64", "pwritev", "pwritev2", "read",
+	"readahead", "readlink", "readlinkat", "readv", "recv", "recvfrom", "recvmmsg",
+	"recvmmsg_time64", "recvmsg", "remap_file_pages", "removexattr", "rename",
+	"renameat", "renameat2", "restart_syscall", "rmdir", "rseq", "rt_sigaction",
+	"rt_sigpending", "rt_sigprocmask", "rt_sigqueueinfo", "rt_sigreturn", "rt_sigsuspend",
+	"rt_sigtimedwait", "rt_sigtimedwait_time64", "rt_tgsigqueueinfo", "sched_get_priority_max",
+	"sched_get_priority_min", "sched_getaffinity", "sched_getattr", "sched_getparam",
+	"sched_getscheduler", "sched_rr_get_interval", "sched_rr_get_interval_time64",
+	"sched_setaffinity", "sched_setattr", "sched_setparam", "sched_setscheduler",
+	"sched_yield", "seccomp", "select", "semctl", "semget", "semop", "semtimedop",
+	"semtimedop_time64", "send", "sendfile", "sendfile64", "sendmmsg", "sendmsg",
+	"sendto", "set_robust_list", "set_thread_area", "set_tid_address", "setfsgid",
+	"setfsgid32", "setfsuid", "setfsuid32", "setgid", "setgid32", "setgroups",
+	"setgroups32", "setitimer", "setpgid", "setpriority", "setregid", "setregid32",
+	"setresgid", "setresgid32", "setresuid", "setresuid32", "setreuid", "setreuid32",
+	"setrlimit", "setsid", "setsockopt", "setuid", "setuid32", "setxattr", "shmat",
+	"shmctl", "shmdt", "shmget", "shutdown", "sigaltstack", "signalfd", "signalfd4",
+	"sigprocmask", "sigreturn", "socket", "socketcall", "socketpair", "splice",
+	"stat", "stat64", "statfs", "statfs64", "statx", "symlink", "symlinkat",
+	"sync", "sync_file_range", "syncfs", "sysinfo", "tee", "tgkill", "time",
+	"timer_create", "timer_delete", "timer_getoverrun", "timer_gettime", "timer_gettime64",
+	"timer_settime", "timer_settime64", "timerfd_create", "timerfd_gettime",
+	"timerfd_gettime64", "timerfd_settime", "timerfd_settime64", "times", "tkill",
+	"truncate", "truncate64", "ugetrlimit", "umask", "uname", "unlink", "unlinkat",
+	"utime", "utimensat", "utimensat_time64", "utimes", "vfork", "vmsplice",
+	"wait4", "waitid", "waitpid", "write", "writev",
+}
+
+// namespaceCloneFlags are the clone flags that would create new namespaces
+const namespaceCloneFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+// DefaultProfile returns the built-in seccomp profile. Syscalls outside the
+// allow list fail with EPERM.
+func DefaultProfile() *spec.Seccomp {
+	enosys := uint(unix.ENOSYS)
+
+	// The flags are the first clone argument except on s390x, which is not
+	// supported here
+	cloneIndex := uint(0)
+
+	return &spec.Seccomp{
+		DefaultAction: spec.ActErrno,
+		Architectures: []string{nativeArchName},
+		Syscalls: []spec.SeccompSyscall{
+			{
+				Names:  defaultAllowed,
+				Action: spec.ActAllow,
+			},
+			{
+				// Threads and processes, but no new namespaces
+				Names:  []string{"clone"},
+				Action: spec.ActAllow,
+				Args: []spec.SeccompArg{
+					{Index: cloneIndex, Value: namespaceCloneFlags, ValueTwo: 0, Op: spec.OpMaskedEqual},
+				},
+			},
+			{
+				// clone3 passes its flags in memory the filter cannot inspect;
+				// ENOSYS makes libc fall back to clone
+				Names:    []string{"clone3"},
+				Action:   spec.ActErrno,
+				ErrnoRet: &enosys,
+			},
+			{
+				// Only the personalities programs commonly switch between
+				Names:  []string{"personality"},
+				Action: spec.ActAllow,
+				Args:   []spec.SeccompArg{{Index: 0, Value: 0x0, Op: spec.OpEqualTo}},
+			},
+			{
+				Names:  []string{"personality"},
+				Action: spec.ActAllow,
+				Args:   []spec.SeccompArg{{Index: 0, Value: 0x0008, Op: spec.OpEqualTo}},
+			},
+			{
+				Names:  []string{"personality"},
+				Action: spec.ActAllow,
+				Args:   []spec.SeccompArg{{Index: 0, Value: 0x20000, Op: spec.OpEqualTo}},
+			},
+			{
+				Names:  []string{"personality"},
+				Action: spec.ActAllow,
+				Args:   []spec.SeccompArg{{Index: 0, Value: 0x20008, Op: spec.OpEqualTo}},
+			},
+			{
+				Names:  []string{"personality"},
+				Action: spec.ActAllow,
+				Args:   []spec.SeccompArg{{Index: 0, Value: 0xffffffff, Op: spec.OpEqualTo}},
+			},
+		},
+	}
+}
@@ -0,0 +1,262 @@
+package seccomp
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/spec"
+	"gomini/internal/util"
+)
+
+// Offsets into struct seccomp_data. Arguments are 64 bits wide and the
+// supported architectures are little-endian, so the low word comes first.
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// Jump targets resolved when a condition or rule block is finished
+const (
+	jumpFail = -1 // The rule does not match, continue with the next rule
+	jumpPass = -2 // The condition holds, continue with the next condition
+)
+
+// instruction is a BPF instruction whose jumps may still be symbolic
+type instruction struct {
+	code uint16
+	k    uint32
+	jt   int
+	jf   int
+}
+
+// Compile translates a seccomp configuration into a BPF program for the
+// native architecture. Rules are checked in order and the first match wins.
+// Syscall names unknown on this architecture are skipped.
+func Compile(config *spec.Seccomp) ([]unix.SockFilter, error) {
+	if nativeArch == 0 {
+		return nil, util.NewSimpleError("compile seccomp", "seccomp is not supported on this architecture")
+	}
+
+	// Only native syscall numbers are known, so a profile written for other
+	// architectures cannot be honoured
+	for _, arch := range config.Architectures {
+		if arch != nativeArchName {
+			return nil, util.NewSimpleError("compile seccomp", fmt.Sprintf("architecture %s is not supported, only %s", arch, nativeArchName))
+		}
+	}
+
+	defaultAction, err := actionValue(config.DefaultAction, config.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Syscalls from other architectures (e.g. 32-bit compat) are killed
+	program := []instruction{
+		load(offsetArch),
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: nativeArch, jt: 1},
+		ret(unix.SECCOMP_RET_KILL_PROCESS),
+	}
+
+	// x32 numbers would skip every rule, which must not allow them with an
+	// allowing default action
+	if x32SyscallBit != 0 {
+		program = append(program,
+			load(offsetNr),
+			instruction{code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, k: x32SyscallBit, jf: 1},
+			ret(unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	for _, rule := range config.Syscalls {
+		action, err := actionValue(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range rule.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+
+			block, err := ruleBlock(nr, rule.Args, action)
+			if err != nil {
+				return nil, util.WrapError(fmt.Sprintf("compile rule for %s", name), err)
+			}
+			program = append(program, block...)
+		}
+	}
+
+	program = append(program, ret(defaultAction))
+
+	if len(program) > unix.BPF_MAXINSNS {
+		return nil, util.NewSimpleError("compile seccomp", fmt.Sprintf("filter has %d instructions, the kernel allows %d", len(program), unix.BPF_MAXINSNS))
+	}
+
+	filter := make([]unix.SockFilter, len(program))
+	for i, insn := range program {
+		filter[i] = unix.SockFilter{Code: insn.code, K: insn.k, Jt: uint8(insn.jt), Jf: uint8(insn.jf)}
+	}
+
+	return filter, nil
+}
+
+// ruleBlock builds the instructions matching one syscall and its argument
+// conditions. A failed match jumps past the block to the next rule.
+func ruleBlock(nr uint32, args []spec.SeccompArg, action uint32) ([]instruction, error) {
+	block := []instruction{
+		load(offsetNr),
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: nr, jf: jumpFail},
+	}
+
+	for _, arg := range args {
+		condition, err := argCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, resolve(condition, jumpPass)...)
+	}
+
+	block = append(block, ret(action))
+	return resolve(block, jumpFail), nil
+}
+
+// argCondition compares a 64-bit argument as two 32-bit halves
+func argCondition(arg spec.SeccompArg) ([]instruction, error) {
+	hi := offsetArgs + 8*uint32(arg.Index) + 4
+	lo := offsetArgs + 8*uint32(arg.Index)
+	valueHi, valueLo := uint32(arg.Value>>32), uint32(arg.Value)
+
+	jeq := func(k uint32, jt, jf int) instruction {
+		return instruction{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: k, jt: jt, jf: jf}
+	}
+	jgt := func(k uint32, jt, jf int) instruction {
+		return instruction{code: unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, k: k, jt: jt, jf: jf}
+	}
+	jge := func(k uint32, jt, jf int) instruction {
+		return instruction{code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, k: k, jt: jt, jf: jf}
+	}
+
+	switch arg.Op {
+	case spec.OpEqualTo:
+		return []instruction{
+			load(hi), jeq(valueHi, 0, jumpFail),
+			load(lo), jeq(valueLo, 0, jumpFail),
+		}, nil
+	case spec.OpNotEqual:
+		return []instruction{
+			load(hi), jeq(valueHi, 0, jumpPass),
+			load(lo), jeq(valueLo, jumpFail, 0),
+		}, nil
+	case spec.OpGreaterThan:
+		return []instruction{
+			load(hi), jgt(valueHi, jumpPass, 0), jeq(valueHi, 0, jumpFail),
+			load(lo), jgt(valueLo, 0, jumpFail),
+		}, nil
+	case spec.OpGreaterEqual:
+		return []instruction{
+			load(hi), jgt(valueHi, jumpPass, 0), jeq(valueHi, 0, jumpFail),
+			load(lo), jge(valueLo, 0, jumpFail),
+		}, nil
+	case spec.OpLessThan:
+		return []instruction{
+			load(hi), jgt(valueHi, jumpFail, 0), jeq(valueHi, 0, jumpPass),
+			load(lo), jge(valueLo, jumpFail, 0),
+		}, nil
+	case spec.OpLessEqual:
+		return []instruction{
+			load(hi), jgt(valueHi, jumpFail, 0), jeq(valueHi, 0, jumpPass),
+			load(lo), jgt(valueLo, jumpFail, 0),
+		}, nil
+	case spec.OpMaskedEqual:
+		// Value is the mask and ValueTwo the expected result
+		expectedHi, expectedLo := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+		return []instruction{
+			load(hi), and(valueHi), jeq(expectedHi, 0, jumpFail),
+			load(lo), and(valueLo), jeq(expectedLo, 0, jumpFail),
+		}, nil
+	}
+
+	return nil, util.NewSimpleError("compile seccomp", fmt.Sprintf("unknown operator %q", arg.Op))
+}
+
+// resolve replaces a symbolic jump target with the offset to the end of the
+// instruction list
+func resolve(insns []instruction, target int) []instruction {
+	for i := range insns {
+		if insns[i].jt == target {
+			insns[i].jt = len(insns) - i - 1
+		}
+		if insns[i].jf == target {
+			insns[i].jf = len(insns) - i - 1
+		}
+	}
+	return insns
+}
+
+// load loads a 32-bit word of seccomp_data into the accumulator
+func load(offset uint32) instruction {
+	return instruction{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: offset}
+}
+
+// and masks the accumulator
+func and(mask uint32) instruction {
+	return instruction{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, k: mask}
+}
+
+// ret returns a seccomp action
+func ret(action uint32) instruction {
+	return instruction{code: unix.BPF_RET | unix.BPF_K, k: action}
+}
+
+// actionValue converts an OCI action to the filter return value
+func actionValue(action spec.SeccompAction, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+
+	switch action {
+	case spec.ActKill, spec.ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case spec.ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case spec.ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case spec.ActErrno:
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case spec.ActTrace:
+		return unix.SECCOMP_RET_TRACE | (errno & unix.SECCOMP_RET_DATA), nil
+	case spec.ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	case spec.ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	}
+
+	return 0, util.NewSimpleError("compile seccomp", fmt.Sprintf("unknown action %q", action))
+}
+
+// Load installs the filter on every thread of the calling process. Without
+// CAP_SYS_ADMIN the kernel requires no_new_privs to be set first.
+func Load(filter []unix.SockFilter) error {
+	if len(filter) == 0 {
+		return nil
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP,
+		unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return util.NewError("load seccomp filter", errno)
+	}
+
+	return nil
+}
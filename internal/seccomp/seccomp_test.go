@@ -0,0 +1,303 @@
+package seccomp
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/spec"
+)
+
+// run executes a compiled filter on a syscall like the kernel would and
+// returns the action
+func run(t *testing.T, filter []unix.SockFilter, arch, nr uint32, args [6]uint64) uint32 {
+	t.Helper()
+
+	word := func(offset uint32) uint32 {
+		switch {
+		case offset == offsetNr:
+			return nr
+		case offset == offsetArch:
+			return arch
+		case offset >= offsetArgs && offset < offsetArgs+6*8:
+			arg := args[(offset-offsetArgs)/8]
+			if (offset-offsetArgs)%8 == 4 {
+				return uint32(arg >> 32)
+			}
+			return uint32(arg)
+		}
+		t.Fatalf("load from unexpected offset %d", offset)
+		return 0
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		insn := filter[pc]
+		switch insn.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = word(insn.K)
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= insn.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			var taken bool
+			switch insn.Code &^ (unix.BPF_JMP | unix.BPF_K) {
+			case unix.BPF_JEQ:
+				taken = acc == insn.K
+			case unix.BPF_JGT:
+				taken = acc > insn.K
+			case unix.BPF_JGE:
+				taken = acc >= insn.K
+			}
+			if taken {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return insn.K
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", insn.Code, pc)
+		}
+	}
+
+	t.Fatalf("filter ran off its end")
+	return 0
+}
+
+func TestCompileArgConditions(t *testing.T) {
+	if nativeArch == 0 {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+
+	const denied = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	high := uint64(1) << 32
+
+	tests := []struct {
+		name     string
+		arg      spec.SeccompArg
+		value    uint64
+		expected uint32
+	}{
+		{"eq match", spec.SeccompArg{Op: spec.OpEqualTo, Value: 5}, 5, denied},
+		{"eq low differs", spec.SeccompArg{Op: spec.OpEqualTo, Value: 5}, 6, unix.SECCOMP_RET_ALLOW},
+		{"eq high differs", spec.SeccompArg{Op: spec.OpEqualTo, Value: 5}, high + 5, unix.SECCOMP_RET_ALLOW},
+		{"ne match", spec.SeccompArg{Op: spec.OpNotEqual, Value: 5}, 6, denied},
+		{"ne high differs", spec.SeccompArg{Op: spec.OpNotEqual, Value: 5}, high + 5, denied},
+		{"ne equal", spec.SeccompArg{Op: spec.OpNotEqual, Value: 5}, 5, unix.SECCOMP_RET_ALLOW},
+		{"gt above", spec.SeccompArg{Op: spec.OpGreaterThan, Value: 5}, 6, denied},
+		{"gt high word above", spec.SeccompArg{Op: spec.OpGreaterThan, Value: high + 5}, 2 * high, denied},
+		{"gt equal", spec.SeccompArg{Op: spec.OpGreaterThan, Value: 5}, 5, unix.SECCOMP_RET_ALLOW},
+		{"gt high word below", spec.SeccompArg{Op: spec.OpGreaterThan, Value: high}, 0xffffffff, unix.SECCOMP_RET_ALLOW},
+		{"ge equal", spec.SeccompArg{Op: spec.OpGreaterEqual, Value: high + 5}, high + 5, denied},
+		{"ge below", spec.SeccompArg{Op: spec.OpGreaterEqual, Value: 5}, 4, unix.SECCOMP_RET_ALLOW},
+		{"lt below", spec.SeccompArg{Op: spec.OpLessThan, Value: 5}, 4, denied},
+		{"lt high word below", spec.SeccompArg{Op: spec.OpLessThan, Value: high}, 0xffffffff, denied},
+		{"lt equal", spec.SeccompArg{Op: spec.OpLessThan, Value: 5}, 5, unix.SECCOMP_RET_ALLOW},
+		{"lt high word above", spec.SeccompArg{Op: spec.OpLessThan, Value: 5}, high, unix.SECCOMP_RET_ALLOW},
+		{"le equal", spec.SeccompArg{Op: spec.OpLessEqual, Value: 5}, 5, denied},
+		{"le above", spec.SeccompArg{Op: spec.OpLessEqual, Value: 5}, 6, unix.SECCOMP_RET_ALLOW},
+		{"masked match", spec.SeccompArg{Op: spec.OpMaskedEqual, Value: 0xff, ValueTwo: 0x12}, 0x3412, denied},
+		{"masked high bits", spec.SeccompArg{Op: spec.OpMaskedEqual, Value: high | 0xff, ValueTwo: 0x12}, high | 0x12, unix.SECCOMP_RET_ALLOW},
+		{"masked no match", spec.SeccompArg{Op: spec.OpMaskedEqual, Value: 0xff, ValueTwo: 0x12}, 0x13, unix.SECCOMP_RET_ALLOW},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.arg.Index = 1
+			filter, err := Compile(&spec.Seccomp{
+				DefaultAction: spec.ActAllow,
+				Syscalls: []spec.SeccompSyscall{
+					{Names: []string{"personality"}, Action: spec.ActErrno, Args: []spec.SeccompArg{tt.arg}},
+				},
+			})
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+
+			args := [6]uint64{tt.value, tt.value}
+			if got := run(t, filter, nativeArch, syscallNumbers["personality"], args); got != tt.expected {
+				t.Errorf("action = %#x, want %#x", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	if nativeArch == 0 {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+
+	errno := uint(unix.ENOSYS)
+	config := &spec.Seccomp{
+		DefaultAction: spec.ActErrno,
+		Syscalls: []spec.SeccompSyscall{
+			// The first matching rule wins, so personality(0) is allowed
+			{Names: []string{"personality"}, Action: spec.ActAllow, Args: []spec.SeccompArg{
+				{Index: 0, Op: spec.OpEqualTo, Value: 0},
+			}},
+			{Names: []string{"personality", "getpid"}, Action: spec.ActErrno, ErrnoRet: &errno},
+			{Names: []string{"read", "no_such_syscall"}, Action: spec.ActAllow},
+			{Names: []string{"write"}, Action: spec.ActAllow, Args: []spec.SeccompArg{
+				{Index: 0, Op: spec.OpGreaterEqual, Value: 1},
+				{Index: 0, Op: spec.OpLessEqual, Value: 2},
+			}},
+		},
+	}
+	filter, err := Compile(config)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	enosys := unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+	eperm := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	tests := []struct {
+		name     string
+		arch     uint32
+		syscall  string
+		arg      uint64
+		expected uint32
+	}{
+		{"first rule", nativeArch, "personality", 0, unix.SECCOMP_RET_ALLOW},
+		{"second rule", nativeArch, "personality", 8, enosys},
+		{"second name", nativeArch, "getpid", 0, enosys},
+		{"unknown name skipped", nativeArch, "read", 0, unix.SECCOMP_RET_ALLOW},
+		{"all conditions hold", nativeArch, "write", 2, unix.SECCOMP_RET_ALLOW},
+		{"one condition fails", nativeArch, "write", 3, eperm},
+		{"default action", nativeArch, "close", 0, eperm},
+		{"foreign architecture", nativeArch + 1, "read", 0, unix.SECCOMP_RET_KILL_PROCESS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nr, ok := syscallNumbers[tt.syscall]
+			if !ok {
+				t.Skipf("no %s syscall on this architecture", tt.syscall)
+			}
+			if got := run(t, filter, tt.arch, nr, [6]uint64{tt.arg}); got != tt.expected {
+				t.Errorf("action = %#x, want %#x", got, tt.expected)
+			}
+		})
+	}
+
+	// x32 syscalls share the architecture but not the numbers
+	if x32SyscallBit != 0 {
+		if got := run(t, filter, nativeArch, x32SyscallBit|syscallNumbers["read"], [6]uint64{}); got != unix.SECCOMP_RET_KILL_PROCESS {
+			t.Errorf("x32 read: action = %#x, want %#x", got, unix.SECCOMP_RET_KILL_PROCESS)
+		}
+	}
+}
+
+func TestCompileX32DenyList(t *testing.T) {
+	if x32SyscallBit == 0 {
+		t.Skip("no x32 ABI on this architecture")
+	}
+
+	// A deny list must not be bypassed through the x32 numbers of its syscalls
+	filter, err := Compile(&spec.Seccomp{
+		DefaultAction: spec.ActAllow,
+		Syscalls:      []spec.SeccompSyscall{{Names: []string{"mount"}, Action: spec.ActErrno}},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		nr       uint32
+		expected uint32
+	}{
+		{"native denied", syscallNumbers["mount"], unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+		{"native allowed", syscallNumbers["read"], unix.SECCOMP_RET_ALLOW},
+		{"x32 denied", x32SyscallBit | syscallNumbers["mount"], unix.SECCOMP_RET_KILL_PROCESS},
+		{"x32 allowed", x32SyscallBit | syscallNumbers["read"], unix.SECCOMP_RET_KILL_PROCESS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, filter, nativeArch, tt.nr, [6]uint64{}); got != tt.expected {
+				t.Errorf("action = %#x, want %#x", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	if nativeArch == 0 {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+
+	tests := []struct {
+		name   string
+		config *spec.Seccomp
+	}{
+		{"unknown default action", &spec.Seccomp{DefaultAction: "SCMP_ACT_NOTIFY"}},
+		{"foreign architecture", &spec.Seccomp{DefaultAction: spec.ActAllow, Architectures: []string{nativeArchName, "SCMP_ARCH_X86"}}},
+		{"unknown rule action", &spec.Seccomp{
+			DefaultAction: spec.ActAllow,
+			Syscalls:      []spec.SeccompSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_BOGUS"}},
+		}},
+		{"unknown operator", &spec.Seccomp{
+			DefaultAction: spec.ActAllow,
+			Syscalls: []spec.SeccompSyscall{{Names: []string{"read"}, Action: spec.ActErrno, Args: []spec.SeccompArg{
+				{Index: 0, Op: "SCMP_CMP_BOGUS"},
+			}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(tt.config); err == nil {
+				t.Error("Compile() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	insns := []instruction{
+		{jt: jumpFail},
+		{jf: jumpPass},
+		{jt: jumpFail, jf: jumpFail},
+		{},
+	}
+
+	resolve(insns, jumpFail)
+	if insns[0].jt != 3 || insns[2].jt != 1 || insns[2].jf != 1 {
+		t.Errorf("jumpFail not resolved to the end: %+v", insns)
+	}
+	if insns[1].jf != jumpPass {
+		t.Errorf("other targets changed: %+v", insns[1])
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	if nativeArch == 0 {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+
+	filter, err := Compile(DefaultProfile())
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	eperm := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	tests := []struct {
+		name     string
+		syscall  string
+		arg      uint64
+		expected uint32
+	}{
+		{"allowed", "read", 0, unix.SECCOMP_RET_ALLOW},
+		{"not allowed", "mount", 0, eperm},
+		{"thread", "clone", unix.CLONE_VM | unix.CLONE_THREAD, unix.SECCOMP_RET_ALLOW},
+		{"new namespace", "clone", unix.CLONE_NEWUSER, eperm},
+		{"clone3", "clone3", 0, unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)},
+		{"linux32 personality", "personality", 0x0008, unix.SECCOMP_RET_ALLOW},
+		{"other personality", "personality", 0x0400000, eperm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, filter, nativeArch, syscallNumbers[tt.syscall], [6]uint64{tt.arg}); got != tt.expected {
+				t.Errorf("action = %#x, want %#x", got, tt.expected)
+			}
+		})
+	}
+}
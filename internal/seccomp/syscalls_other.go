@@ -0,0 +1,15 @@
+//go:build !amd64 && !arm64
+
+package seccomp
+
+// nativeArch is zero where seccomp filters are not supported
+const nativeArch = 0
+
+// nativeArchName is empty where seccomp filters are not supported
+const nativeArchName = ""
+
+// x32SyscallBit is unused on this architecture
+const x32SyscallBit = 0
+
+// syscallNumbers is empty where seccomp filters are not supported
+var syscallNumbers = map[string]uint32{}
@@ -2,37 +2,46 @@ package spec
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 
+	"golang.org/x/sys/unix"
+
+	"gomini/internal/caps"
 	"gomini/internal/util"
 )
 
 // Config represents a subset of the OCI runtime configuration
 type Config struct {
-	OCIVersion string  `json:"ociVersion"`
-	Process    Process `json:"process"`
-	Root       Root    `json:"root"`
-	Hostname   string  `json:"hostname"`
-	Mounts     []Mount `json:"mounts"`
-	Linux      Linux   `json:"linux"`
+	OCIVersion  string            `json:"ociVersion"`
+	Process     Process           `json:"process"`
+	Root        Root              `json:"root"`
+	Hostname    string            `json:"hostname"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       Linux             `json:"linux"`
 }
 
 // Process defines the container process configuration
 type Process struct {
-	Terminal     bool         `json:"terminal"`
-	User         User         `json:"user"`
-	Args         []string     `json:"args"`
-	Env          []string     `json:"env"`
-	Cwd          string       `json:"cwd"`
-	Capabilities Capabilities `json:"capabilities"`
-	Rlimits      []Rlimit     `json:"rlimits"`
+	Terminal        bool          `json:"terminal"`
+	User            User          `json:"user"`
+	Args            []string      `json:"args"`
+	Env             []string      `json:"env"`
+	Cwd             string        `json:"cwd"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+	Rlimits         []Rlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool          `json:"noNewPrivileges,omitempty"`
 }
 
 // User defines user information for the container process
 type User struct {
-	UID int `json:"uid"`
-	GID int `json:"gid"`
+	UID            int      `json:"uid"`
+	GID            int      `json:"gid"`
+	Umask          *uint32  `json:"umask,omitempty"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+	Username       string   `json:"username,omitempty"` // Resolved against the container's /etc/passwd
 }
 
 // Capabilities defines the process capabilities
@@ -41,19 +50,54 @@ type Capabilities struct {
 	Effective   []string `json:"effective"`
 	Inheritable []string `json:"inheritable"`
 	Permitted   []string `json:"permitted"`
+	Ambient     []string `json:"ambient"`
 }
 
 // Rlimit defines resource limits
 type Rlimit struct {
 	Type string `json:"type"`
-	Hard int    `json:"hard"`
-	Soft int    `json:"soft"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// rlimitTypes maps OCI rlimit types to setrlimit resources
+var rlimitTypes = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// Resource returns the setrlimit resource number of the limit type
+func (r Rlimit) Resource() (int, error) {
+	resource, ok := rlimitTypes[r.Type]
+	if !ok {
+		return 0, util.NewSimpleError("rlimit", fmt.Sprintf("unknown rlimit type %q", r.Type))
+	}
+	return resource, nil
 }
 
 // Root defines the root filesystem for the container
 type Root struct {
 	Path     string `json:"path"`
 	Readonly bool   `json:"readonly"`
+
+	// Layers is a gomini extension listing read-only layer directories
+	// below Path, bottom first. They are combined with Path, the top layer,
+	// into one rootfs, see GetLayerPaths.
+	Layers []string `json:"layers,omitempty"`
 }
 
 // Mount defines a mount point in the container
@@ -66,26 +110,55 @@ type Mount struct {
 
 // Linux contains Linux-specific configuration
 type Linux struct {
-	Resources  Resources   `json:"resources"`
+	Resources  Resources   `json:"resources,omitzero"`
 	Namespaces []Namespace `json:"namespaces"`
+	Seccomp    *Seccomp    `json:"seccomp,omitempty"`
+
+	// ID mappings for the user namespace
+	UIDMappings []IDMapping `json:"uidMappings,omitempty"`
+	GIDMappings []IDMapping `json:"gidMappings,omitempty"`
+
+	// Clock offsets for the time namespace, keyed by "monotonic" or "boottime"
+	TimeOffsets map[string]TimeOffset `json:"timeOffsets,omitempty"`
+}
+
+// TimeOffset shifts a clock in a new time namespace
+type TimeOffset struct {
+	Secs     int64  `json:"secs"`
+	Nanosecs uint32 `json:"nanosecs"`
+}
+
+// IDMapping maps a range of container user or group IDs to host IDs
+type IDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
 }
 
 // Resources defines container resource limits
 type Resources struct {
-	Memory Memory `json:"memory"`
-	CPU    CPU    `json:"cpu"`
-	Pids   Pids   `json:"pids"`
+	Memory         Memory            `json:"memory"`
+	CPU            CPU               `json:"cpu"`
+	Pids           Pids              `json:"pids"`
+	BlockIO        BlockIO           `json:"blockIO"`
+	HugepageLimits []HugepageLimit   `json:"hugepageLimits"`
+	Unified        map[string]string `json:"unified"`
 }
 
 // Memory defines memory resource limits
 type Memory struct {
-	Limit int64 `json:"limit"`
+	Limit       int64 `json:"limit"`
+	Reservation int64 `json:"reservation"`
+	Swap        int64 `json:"swap"` // Memory plus swap limit, -1 for unlimited
 }
 
 // CPU defines CPU resource limits
 type CPU struct {
-	Quota  int64 `json:"quota"`
-	Period int64 `json:"period"`
+	Shares uint64 `json:"shares"`
+	Quota  int64  `json:"quota"`
+	Period int64  `json:"period"`
+	Cpus   string `json:"cpus"`
+	Mems   string `json:"mems"`
 }
 
 // Pids defines process count limits
@@ -93,9 +166,94 @@ type Pids struct {
 	Limit int `json:"limit"`
 }
 
+// BlockIO defines block IO weights and throttles
+type BlockIO struct {
+	Weight                  uint16           `json:"weight"`
+	WeightDevice            []WeightDevice   `json:"weightDevice"`
+	ThrottleReadBpsDevice   []ThrottleDevice `json:"throttleReadBpsDevice"`
+	ThrottleWriteBpsDevice  []ThrottleDevice `json:"throttleWriteBpsDevice"`
+	ThrottleReadIOPSDevice  []ThrottleDevice `json:"throttleReadIOPSDevice"`
+	ThrottleWriteIOPSDevice []ThrottleDevice `json:"throttleWriteIOPSDevice"`
+}
+
+// WeightDevice defines a per-device block IO weight
+type WeightDevice struct {
+	Major  int64  `json:"major"`
+	Minor  int64  `json:"minor"`
+	Weight uint16 `json:"weight"`
+}
+
+// ThrottleDevice defines a per-device block IO rate limit
+type ThrottleDevice struct {
+	Major int64  `json:"major"`
+	Minor int64  `json:"minor"`
+	Rate  uint64 `json:"rate"`
+}
+
+// HugepageLimit defines a hugetlb limit for one page size
+type HugepageLimit struct {
+	PageSize string `json:"pageSize"`
+	Limit    uint64 `json:"limit"`
+}
+
+// Seccomp defines the syscall filter for the container process
+type Seccomp struct {
+	DefaultAction   SeccompAction    `json:"defaultAction"`
+	DefaultErrnoRet *uint            `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls,omitempty"`
+}
+
+// SeccompAction is the action taken when a seccomp rule matches
+type SeccompAction string
+
+// Seccomp actions
+const (
+	ActKill        SeccompAction = "SCMP_ACT_KILL"
+	ActKillProcess SeccompAction = "SCMP_ACT_KILL_PROCESS"
+	ActKillThread  SeccompAction = "SCMP_ACT_KILL_THREAD"
+	ActTrap        SeccompAction = "SCMP_ACT_TRAP"
+	ActErrno       SeccompAction = "SCMP_ACT_ERRNO"
+	ActTrace       SeccompAction = "SCMP_ACT_TRACE"
+	ActAllow       SeccompAction = "SCMP_ACT_ALLOW"
+	ActLog         SeccompAction = "SCMP_ACT_LOG"
+)
+
+// SeccompOperator compares a syscall argument against rule values
+type SeccompOperator string
+
+// Seccomp argument operators
+const (
+	OpNotEqual     SeccompOperator = "SCMP_CMP_NE"
+	OpLessThan     SeccompOperator = "SCMP_CMP_LT"
+	OpLessEqual    SeccompOperator = "SCMP_CMP_LE"
+	OpEqualTo      SeccompOperator = "SCMP_CMP_EQ"
+	OpGreaterEqual SeccompOperator = "SCMP_CMP_GE"
+	OpGreaterThan  SeccompOperator = "SCMP_CMP_GT"
+	OpMaskedEqual  SeccompOperator = "SCMP_CMP_MASKED_EQ"
+)
+
+// SeccompSyscall is a rule applying an action to the named syscalls
+type SeccompSyscall struct {
+	Names    []string      `json:"names"`
+	Action   SeccompAction `json:"action"`
+	ErrnoRet *uint         `json:"errnoRet,omitempty"`
+	Args     []SeccompArg  `json:"args,omitempty"`
+}
+
+// SeccompArg is a condition on a syscall argument; all conditions of a
+// rule must hold for it to match
+type SeccompArg struct {
+	Index    uint            `json:"index"`
+	Value    uint64          `json:"value"`
+	ValueTwo uint64          `json:"valueTwo,omitempty"`
+	Op       SeccompOperator `json:"op"`
+}
+
 // Namespace defines a namespace for the container
 type Namespace struct {
 	Type string `json:"type"`
+	Path string `json:"path,omitempty"` // Existing namespace to join instead of creating one
 }
 
 // LoadConfig loads and parses a config.json file from the specified bundle directory
@@ -116,6 +274,9 @@ func LoadConfig(bundleDir string) (*Config, error) {
 	if err := validateConfig(&config); err != nil {
 		return nil, util.NewPathError("validate config", configPath, err)
 	}
+	if err := validateLayers(&config, bundleDir); err != nil {
+		return nil, util.NewPathError("validate config", configPath, err)
+	}
 
 	return &config, nil
 }
@@ -134,13 +295,246 @@ func validateConfig(config *Config) error {
 		return util.NewSimpleError("validate config", "missing root path")
 	}
 
+	if c := config.Process.Capabilities; c != nil {
+		if _, err := caps.New(c.Bounding, c.Effective, c.Inheritable, c.Permitted, c.Ambient); err != nil {
+			return err
+		}
+	}
+
+	if err := validateRlimits(config.Process.Rlimits); err != nil {
+		return err
+	}
+
+	if err := validateSeccomp(config.Linux.Seccomp); err != nil {
+		return err
+	}
+
+	if err := validateNamespaces(config.Linux.Namespaces); err != nil {
+		return err
+	}
+
+	if err := validateIDMappings(config.Linux); err != nil {
+		return err
+	}
+
+	if err := validateTimeOffsets(config.Linux); err != nil {
+		return err
+	}
+
+	memory := config.Linux.Resources.Memory
+	if memory.Swap > 0 && memory.Limit <= 0 {
+		return util.NewSimpleError("validate config", "memory swap limit requires a memory limit")
+	}
+	if memory.Swap > 0 && memory.Swap < memory.Limit {
+		return util.NewSimpleError("validate config", "memory swap limit must not be lower than the memory limit")
+	}
+
+	cpu := config.Linux.Resources.CPU
+	if cpu.Period > 0 && cpu.Quota <= 0 {
+		return util.NewSimpleError("validate config", "cpu period requires a cpu quota")
+	}
+
+	for _, mount := range config.Mounts {
+		if !filepath.IsAbs(mount.Destination) {
+			return util.NewSimpleError("validate config", fmt.Sprintf("mount destination %q is not an absolute path", mount.Destination))
+		}
+	}
+
+	return nil
+}
+
+// validateLayers checks that every rootfs layer is an existing directory
+func validateLayers(config *Config, bundleDir string) error {
+	if len(config.Root.Layers) == 0 {
+		return nil
+	}
+	for _, layer := range config.Root.Layers {
+		if layer == "" {
+			return util.NewSimpleError("validate config", "empty rootfs layer path")
+		}
+	}
+
+	for _, path := range config.GetLayerPaths(bundleDir) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return util.WrapError("rootfs layer", err)
+		}
+		if !info.IsDir() {
+			return util.NewSimpleError("validate config", fmt.Sprintf("rootfs layer %q is not a directory", path))
+		}
+	}
+	return nil
+}
+
+// validateNamespaces rejects duplicate namespace types and relative paths
+func validateNamespaces(namespaces []Namespace) error {
+	seen := make(map[string]bool)
+	for _, ns := range namespaces {
+		if seen[ns.Type] {
+			return util.NewSimpleError("validate config", fmt.Sprintf("duplicate %s namespace", ns.Type))
+		}
+		seen[ns.Type] = true
+
+		if ns.Path != "" && !filepath.IsAbs(ns.Path) {
+			return util.NewSimpleError("validate config", fmt.Sprintf("%s namespace path %q is not an absolute path", ns.Type, ns.Path))
+		}
+	}
+
+	return nil
+}
+
+// validateIDMappings checks that ID mappings come with a user namespace and
+// cover at least one ID each
+func validateIDMappings(linux Linux) error {
+	if len(linux.UIDMappings) == 0 && len(linux.GIDMappings) == 0 {
+		return nil
+	}
+
+	if !linux.HasNamespace("user") {
+		return util.NewSimpleError("validate config", "uidMappings and gidMappings require a user namespace")
+	}
+
+	if linux.NamespacePath("user") != "" {
+		return util.NewSimpleError("validate config", "uidMappings and gidMappings cannot be applied to a joined user namespace")
+	}
+
+	for _, mapping := range append(linux.UIDMappings, linux.GIDMappings...) {
+		if mapping.Size == 0 {
+			return util.NewSimpleError("validate config", fmt.Sprintf("ID mapping for container ID %d has size 0", mapping.ContainerID))
+		}
+	}
+
+	return nil
+}
+
+// validateTimeOffsets checks that time offsets come with a new time namespace
+// and only shift the clocks the kernel supports
+func validateTimeOffsets(linux Linux) error {
+	if len(linux.TimeOffsets) == 0 {
+		return nil
+	}
+
+	if !linux.HasNamespace("time") {
+		return util.NewSimpleError("validate config", "timeOffsets require a time namespace")
+	}
+
+	if linux.NamespacePath("time") != "" {
+		return util.NewSimpleError("validate config", "timeOffsets cannot be applied to a joined time namespace")
+	}
+
+	for clock, offset := range linux.TimeOffsets {
+		if clock != "monotonic" && clock != "boottime" {
+			return util.NewSimpleError("validate config", fmt.Sprintf("unknown clock %q in timeOffsets", clock))
+		}
+		if offset.Nanosecs >= 1000000000 {
+			return util.NewSimpleError("validate config", fmt.Sprintf("%s offset nanosecs must be below one second", clock))
+		}
+	}
+
 	return nil
 }
 
+// validateRlimits rejects unknown, duplicate and inverted resource limits
+func validateRlimits(rlimits []Rlimit) error {
+	seen := make(map[string]bool)
+	for _, rlimit := range rlimits {
+		if _, err := rlimit.Resource(); err != nil {
+			return err
+		}
+		if seen[rlimit.Type] {
+			return util.NewSimpleError("validate config", fmt.Sprintf("duplicate rlimit type %q", rlimit.Type))
+		}
+		seen[rlimit.Type] = true
+		if rlimit.Soft > rlimit.Hard {
+			return util.NewSimpleError("validate config", fmt.Sprintf("rlimit %s soft limit %d exceeds hard limit %d", rlimit.Type, rlimit.Soft, rlimit.Hard))
+		}
+	}
+	return nil
+}
+
+// validateSeccomp checks that a seccomp section only uses known actions and operators
+func validateSeccomp(seccomp *Seccomp) error {
+	if seccomp == nil {
+		return nil
+	}
+
+	if !seccomp.DefaultAction.valid() {
+		return util.NewSimpleError("validate config", fmt.Sprintf("unknown seccomp default action %q", seccomp.DefaultAction))
+	}
+
+	for _, syscall := range seccomp.Syscalls {
+		if !syscall.Action.valid() {
+			return util.NewSimpleError("validate config", fmt.Sprintf("unknown seccomp action %q", syscall.Action))
+		}
+		for _, arg := range syscall.Args {
+			if arg.Index > 5 {
+				return util.NewSimpleError("validate config", fmt.Sprintf("seccomp argument index %d out of range", arg.Index))
+			}
+			if !arg.Op.valid() {
+				return util.NewSimpleError("validate config", fmt.Sprintf("unknown seccomp operator %q", arg.Op))
+			}
+		}
+	}
+
+	return nil
+}
+
+// valid reports whether the action is supported
+func (a SeccompAction) valid() bool {
+	switch a {
+	case ActKill, ActKillProcess, ActKillThread, ActTrap, ActErrno, ActTrace, ActAllow, ActLog:
+		return true
+	}
+	return false
+}
+
+// valid reports whether the operator is supported
+func (o SeccompOperator) valid() bool {
+	switch o {
+	case OpNotEqual, OpLessThan, OpLessEqual, OpEqualTo, OpGreaterEqual, OpGreaterThan, OpMaskedEqual:
+		return true
+	}
+	return false
+}
+
+// HasNamespace reports whether a namespace of the given OCI type is configured
+func (l *Linux) HasNamespace(nsType string) bool {
+	for _, ns := range l.Namespaces {
+		if ns.Type == nsType {
+			return true
+		}
+	}
+	return false
+}
+
+// NamespacePath returns the path of an existing namespace of the given OCI
+// type the container joins, or "" if it creates a new one or none
+func (l *Linux) NamespacePath(nsType string) string {
+	for _, ns := range l.Namespaces {
+		if ns.Type == nsType {
+			return ns.Path
+		}
+	}
+	return ""
+}
+
 // GetRootfsPath returns the absolute path to the container's root filesystem
 func (c *Config) GetRootfsPath(bundleDir string) string {
 	if filepath.IsAbs(c.Root.Path) {
 		return c.Root.Path
 	}
 	return filepath.Join(bundleDir, c.Root.Path)
-}
\ No newline at end of file
+}
+
+// GetLayerPaths returns the absolute paths of the rootfs layers, bottom
+// first and ending with the rootfs path itself as the top layer
+func (c *Config) GetLayerPaths(bundleDir string) []string {
+	var paths []string
+	for _, layer := range c.Root.Layers {
+		if !filepath.IsAbs(layer) {
+			layer = filepath.Join(bundleDir, layer)
+		}
+		paths = append(paths, layer)
+	}
+	return append(paths, c.GetRootfsPath(bundleDir))
+}
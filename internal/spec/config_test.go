@@ -0,0 +1,246 @@
+package spec
+
+import "testing"
+
+// validConfig returns the smallest config that passes validateConfig
+func validConfig() *Config {
+	return &Config{
+		OCIVersion: "1.0.2",
+		Process:    Process{Args: []string{"/bin/sh"}},
+		Root:       Root{Path: "rootfs"},
+	}
+}
+
+func TestValidateConfigResources(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources Resources
+		wantErr   bool
+	}{
+		{"none", Resources{}, false},
+		{"swap with limit", Resources{Memory: Memory{Limit: 1 << 20, Swap: 2 << 20}}, false},
+		{"unlimited swap", Resources{Memory: Memory{Swap: -1}}, false},
+		{"swap without limit", Resources{Memory: Memory{Swap: 2 << 20}}, true},
+		{"swap below limit", Resources{Memory: Memory{Limit: 2 << 20, Swap: 1 << 20}}, true},
+		{"quota with period", Resources{CPU: CPU{Quota: 50000, Period: 100000}}, false},
+		{"quota alone", Resources{CPU: CPU{Quota: 50000}}, false},
+		{"period without quota", Resources{CPU: CPU{Period: 100000}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			config.Linux.Resources = tt.resources
+			if err := validateConfig(config); (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRlimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		rlimits []Rlimit
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"valid", []Rlimit{{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 4096}, {Type: "RLIMIT_CORE"}}, false},
+		{"soft equals hard", []Rlimit{{Type: "RLIMIT_NPROC", Soft: 64, Hard: 64}}, false},
+		{"unknown type", []Rlimit{{Type: "RLIMIT_BOGUS"}}, true},
+		{"lowercase type", []Rlimit{{Type: "rlimit_nofile"}}, true},
+		{"duplicate", []Rlimit{{Type: "RLIMIT_NOFILE"}, {Type: "RLIMIT_NOFILE"}}, true},
+		{"soft above hard", []Rlimit{{Type: "RLIMIT_NOFILE", Soft: 4096, Hard: 1024}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRlimits(tt.rlimits); (err != nil) != tt.wantErr {
+				t.Errorf("validateRlimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigCapabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities *Capabilities
+		wantErr      bool
+	}{
+		{"none", nil, false},
+		{"known", &Capabilities{Bounding: []string{"CAP_KILL"}, Effective: []string{"CAP_KILL"}}, false},
+		{"unknown", &Capabilities{Ambient: []string{"CAP_BOGUS"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			config.Process.Capabilities = tt.capabilities
+			if err := validateConfig(config); (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSeccomp(t *testing.T) {
+	tests := []struct {
+		name    string
+		seccomp *Seccomp
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"valid", &Seccomp{
+			DefaultAction: ActErrno,
+			Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: ActAllow, Args: []SeccompArg{
+				{Index: 5, Op: OpMaskedEqual, Value: 1, ValueTwo: 1},
+			}}},
+		}, false},
+		{"missing default action", &Seccomp{}, true},
+		{"unknown default action", &Seccomp{DefaultAction: "SCMP_ACT_BOGUS"}, true},
+		{"unknown action", &Seccomp{
+			DefaultAction: ActAllow,
+			Syscalls:      []SeccompSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_BOGUS"}},
+		}, true},
+		{"index out of range", &Seccomp{
+			DefaultAction: ActAllow,
+			Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: ActErrno, Args: []SeccompArg{
+				{Index: 6, Op: OpEqualTo},
+			}}},
+		}, true},
+		{"unknown operator", &Seccomp{
+			DefaultAction: ActAllow,
+			Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: ActErrno, Args: []SeccompArg{
+				{Index: 0, Op: "SCMP_CMP_BOGUS"},
+			}}},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSeccomp(tt.seccomp); (err != nil) != tt.wantErr {
+				t.Errorf("validateSeccomp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateIDMappings(t *testing.T) {
+	mapping := []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+
+	tests := []struct {
+		name    string
+		linux   Linux
+		wantErr bool
+	}{
+		{"none", Linux{}, false},
+		{"with user namespace", Linux{
+			Namespaces:  []Namespace{{Type: "user"}},
+			UIDMappings: mapping,
+			GIDMappings: mapping,
+		}, false},
+		{"without user namespace", Linux{UIDMappings: mapping}, true},
+		{"joined user namespace", Linux{
+			Namespaces:  []Namespace{{Type: "user", Path: "/proc/1/ns/user"}},
+			GIDMappings: mapping,
+		}, true},
+		{"empty mapping", Linux{
+			Namespaces:  []Namespace{{Type: "user"}},
+			UIDMappings: mapping,
+			GIDMappings: []IDMapping{{ContainerID: 0, HostID: 100000}},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateIDMappings(tt.linux); (err != nil) != tt.wantErr {
+				t.Errorf("validateIDMappings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []Namespace
+		wantErr    bool
+	}{
+		{"none", nil, false},
+		{"new", []Namespace{{Type: "pid"}, {Type: "mount"}}, false},
+		{"joined", []Namespace{{Type: "network", Path: "/var/run/netns/test"}}, false},
+		{"duplicate", []Namespace{{Type: "pid"}, {Type: "pid", Path: "/proc/1/ns/pid"}}, true},
+		{"relative path", []Namespace{{Type: "network", Path: "netns/test"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateNamespaces(tt.namespaces); (err != nil) != tt.wantErr {
+				t.Errorf("validateNamespaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNamespacePath(t *testing.T) {
+	linux := Linux{Namespaces: []Namespace{{Type: "pid"}, {Type: "network", Path: "/var/run/netns/test"}}}
+
+	tests := []struct {
+		nsType   string
+		has      bool
+		expected string
+	}{
+		{"pid", true, ""},
+		{"network", true, "/var/run/netns/test"},
+		{"user", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.nsType, func(t *testing.T) {
+			if got := linux.HasNamespace(tt.nsType); got != tt.has {
+				t.Errorf("HasNamespace(%s) = %v, want %v", tt.nsType, got, tt.has)
+			}
+			if got := linux.NamespacePath(tt.nsType); got != tt.expected {
+				t.Errorf("NamespacePath(%s) = %q, want %q", tt.nsType, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateTimeOffsets(t *testing.T) {
+	timeNamespace := []Namespace{{Type: "time"}}
+
+	tests := []struct {
+		name    string
+		linux   Linux
+		wantErr bool
+	}{
+		{"none", Linux{}, false},
+		{"valid", Linux{
+			Namespaces:  timeNamespace,
+			TimeOffsets: map[string]TimeOffset{"monotonic": {Secs: -60}, "boottime": {Secs: 3600, Nanosecs: 999999999}},
+		}, false},
+		{"without time namespace", Linux{TimeOffsets: map[string]TimeOffset{"monotonic": {Secs: 1}}}, true},
+		{"joined time namespace", Linux{
+			Namespaces:  []Namespace{{Type: "time", Path: "/proc/1/ns/time"}},
+			TimeOffsets: map[string]TimeOffset{"monotonic": {Secs: 1}},
+		}, true},
+		{"unknown clock", Linux{
+			Namespaces:  timeNamespace,
+			TimeOffsets: map[string]TimeOffset{"realtime": {Secs: 1}},
+		}, true},
+		{"nanosecs overflow", Linux{
+			Namespaces:  timeNamespace,
+			TimeOffsets: map[string]TimeOffset{"boottime": {Nanosecs: 1000000000}},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTimeOffsets(tt.linux); (err != nil) != tt.wantErr {
+				t.Errorf("validateTimeOffsets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
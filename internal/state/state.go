@@ -0,0 +1,355 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gomini/internal/fs"
+	"gomini/internal/util"
+)
+
+// DefaultRoot is the directory where per-container state is kept by default
+const DefaultRoot = "/run/gomini"
+
+// DefaultRootDir returns the default state directory for the current user.
+// Unprivileged users cannot write to DefaultRoot, so their state lives under
+// $XDG_RUNTIME_DIR instead.
+func DefaultRootDir() string {
+	if os.Geteuid() != 0 {
+		if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+			return filepath.Join(runtimeDir, "gomini")
+		}
+	}
+	return DefaultRoot
+}
+
+// Container status values as defined by the OCI runtime specification
+const (
+	StatusCreating = "creating"
+	StatusCreated  = "created"
+	StatusRunning  = "running"
+	StatusStopped  = "stopped"
+)
+
+const (
+	stateFile    = "state.json"
+	execFifoFile = "exec.fifo"
+	overlayDir   = "overlay"
+	networkDir   = "network"
+	keptSuffix   = ".upper"
+)
+
+// State is the persisted record of a container, a superset of the OCI state
+type State struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	StartTime   uint64            `json:"startTime,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Created     time.Time         `json:"created"`
+	CgroupPath  string            `json:"cgroupPath,omitempty"`
+}
+
+// Store manages container state directories under a root directory
+type Store struct {
+	Root string
+}
+
+// NewStore creates a new state store rooted at the given directory
+func NewStore(root string) *Store {
+	if root == "" {
+		root = DefaultRootDir()
+	}
+	return &Store{Root: root}
+}
+
+// Exists reports whether a container with the given ID is registered
+func (s *Store) Exists(id string) bool {
+	if ValidateID(id) != nil {
+		return false
+	}
+	_, err := os.Stat(s.Dir(id))
+	return err == nil
+}
+
+// Dir returns the state directory of the given container
+func (s *Store) Dir(id string) string {
+	return filepath.Join(s.Root, id)
+}
+
+// ExecFifoPath returns the path of the fifo that blocks a created container
+func (s *Store) ExecFifoPath(id string) string {
+	return filepath.Join(s.Dir(id), execFifoFile)
+}
+
+// OverlayDir returns the directory holding the container's overlay layers
+func (s *Store) OverlayDir(id string) string {
+	return filepath.Join(s.Dir(id), overlayDir)
+}
+
+// NetworkDir returns the directory holding the /etc files generated for a
+// bridged container
+func (s *Store) NetworkDir(id string) string {
+	return filepath.Join(s.Dir(id), networkDir)
+}
+
+// KeepOverlay moves the container's changes out of the state directory
+// before it is removed and returns where they are kept
+func (s *Store) KeepOverlay(id string) (string, error) {
+	if err := ValidateID(id); err != nil {
+		return "", err
+	}
+
+	upper := fs.NewOverlay(s.OverlayDir(id)).UpperDir
+	if _, err := os.Stat(upper); err != nil {
+		if os.IsNotExist(err) {
+			return "", util.NewSimpleError("keep overlay", fmt.Sprintf("container %q has no overlay", id))
+		}
+		return "", util.NewPathError("keep overlay", upper, err)
+	}
+
+	kept := filepath.Join(s.Root, id+keptSuffix)
+	if _, err := os.Lstat(kept); err == nil {
+		return "", util.NewPathError("keep overlay", kept, os.ErrExist)
+	}
+	if err := os.Rename(upper, kept); err != nil {
+		return "", util.NewPathError("keep overlay", kept, err)
+	}
+
+	return kept, nil
+}
+
+// Create creates the state directory for a new container
+func (s *Store) Create(id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.Root, 0711); err != nil {
+		return util.NewPathError("create state root", s.Root, err)
+	}
+
+	dir := s.Dir(id)
+	if err := os.Mkdir(dir, 0711); err != nil {
+		if os.IsExist(err) {
+			return util.NewSimpleError("create container", fmt.Sprintf("container %q already exists", id))
+		}
+		return util.NewPathError("create state directory", dir, err)
+	}
+
+	return nil
+}
+
+// Lock takes an exclusive lock on the container's state directory so that
+// concurrent gomini invocations serialize their read-modify-write cycles.
+// The returned function releases the lock.
+func (s *Store) Lock(id string) (func(), error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+
+	dir := s.Dir(id)
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, util.NewSimpleError("lock state", fmt.Sprintf("container %q does not exist", id))
+		}
+		return nil, util.NewPathError("open state directory", dir, err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, util.NewPathError("lock state directory", dir, err)
+	}
+
+	return func() { f.Close() }, nil
+}
+
+// Save atomically writes the container state to disk
+func (s *Store) Save(st *State) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return util.NewError("marshal state", err)
+	}
+
+	// Write to a temporary file and rename it so readers never see a partial file
+	dir := s.Dir(st.ID)
+	tmp, err := os.CreateTemp(dir, stateFile+".tmp-*")
+	if err != nil {
+		return util.NewPathError("create temporary state", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return util.NewPathError("write state", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return util.NewPathError("sync state", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return util.NewPathError("close state", tmp.Name(), err)
+	}
+
+	path := filepath.Join(dir, stateFile)
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return util.NewPathError("chmod state", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return util.NewPathError("rename state", path, err)
+	}
+
+	return nil
+}
+
+// Load reads the state of the given container
+func (s *Store) Load(id string) (*State, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(s.Dir(id), stateFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, util.NewSimpleError("load state", fmt.Sprintf("container %q does not exist", id))
+		}
+		return nil, util.NewPathError("read state", path, err)
+	}
+
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, util.NewPathError("parse state", path, err)
+	}
+
+	return &st, nil
+}
+
+// List returns the state of every container under the store root
+func (s *Store) List() ([]*State, error) {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, util.NewPathError("read state root", s.Root, err)
+	}
+
+	var states []*State
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		st, err := s.Load(entry.Name())
+		if err != nil {
+			// Directories without a state file are being created or deleted
+			continue
+		}
+		states = append(states, st)
+	}
+
+	return states, nil
+}
+
+// Remove deletes the state directory of the given container
+func (s *Store) Remove(id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+
+	dir := s.Dir(id)
+	if err := os.RemoveAll(dir); err != nil {
+		return util.NewPathError("remove state directory", dir, err)
+	}
+
+	return nil
+}
+
+// SetPid records the container's init process along with its start time,
+// which tells it apart from a later process that reuses the PID
+func (st *State) SetPid(pid int) {
+	st.Pid = pid
+	st.StartTime, _ = ProcessStartTime(pid)
+}
+
+// RefreshStatus updates the status of a container whose init process has
+// exited. A process with the same PID but another start time is not the
+// container's.
+func (st *State) RefreshStatus() {
+	if st.Status == StatusStopped {
+		return
+	}
+	if st.Pid == 0 || !ProcessAlive(st.Pid) {
+		st.Status = StatusStopped
+		return
+	}
+	if st.StartTime != 0 {
+		if startTime, err := ProcessStartTime(st.Pid); err != nil || startTime != st.StartTime {
+			st.Status = StatusStopped
+		}
+	}
+}
+
+// ProcessAlive reports whether the process exists and is not a zombie
+func ProcessAlive(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+
+	// The state field follows the parenthesised command name
+	stat := string(data)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 || idx+2 >= len(stat) {
+		return false
+	}
+
+	return stat[idx+2] != 'Z' && stat[idx+2] != 'X'
+}
+
+// ProcessStartTime returns the start time of a process in clock ticks
+// since boot, field 22 of /proc/<pid>/stat
+func ProcessStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The fields after the command name start with the state, field 3
+	stat := string(data)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// ValidateID checks that a container ID is safe to use as a directory name
+func ValidateID(id string) error {
+	if id == "" {
+		return util.NewSimpleError("validate container id", "container id must not be empty")
+	}
+	if id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return util.NewSimpleError("validate container id", fmt.Sprintf("invalid container id %q", id))
+	}
+	// Reserved for the overlay changes kept next to the containers
+	if strings.HasSuffix(id, keptSuffix) {
+		return util.NewSimpleError("validate container id", fmt.Sprintf("container id %q must not end in %q", id, keptSuffix))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package state
+
+import (
+	"os"
+	"testing"
+)
+
+func TestValidateID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{"web", false},
+		{"web-1.example_2", false},
+		{"upper", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"a/b", true},
+		{"a\x00b", true},
+		{"web.upper", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if err := ValidateID(tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateID(%q) error = %v, wantErr %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	if err := store.Create("c1"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := store.Create("c1"); err == nil {
+		t.Error("Create() of an existing container succeeded, want an error")
+	}
+	if !store.Exists("c1") || store.Exists("c2") {
+		t.Error("Exists() does not match the created containers")
+	}
+
+	st := &State{ID: "c1", Status: StatusCreated, Bundle: "/bundle"}
+	st.SetPid(os.Getpid())
+	if err := store.Save(st); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, err := store.Load("c1")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if loaded.Pid != st.Pid || loaded.StartTime != st.StartTime || loaded.Bundle != st.Bundle {
+		t.Errorf("Load() = %+v, want %+v", loaded, st)
+	}
+	if _, err := store.Load("c2"); err == nil {
+		t.Error("Load() of a missing container succeeded, want an error")
+	}
+
+	// A directory without state is not listed
+	if err := store.Create("c2"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	states, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(states) != 1 || states[0].ID != "c1" {
+		t.Errorf("List() = %+v, want only c1", states)
+	}
+
+	if err := store.Remove("c1"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if store.Exists("c1") {
+		t.Error("container still exists after Remove()")
+	}
+}
+
+func TestProcessStartTime(t *testing.T) {
+	startTime, err := ProcessStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("ProcessStartTime() error = %v", err)
+	}
+	if startTime == 0 {
+		t.Error("ProcessStartTime() = 0, want the start time of the test")
+	}
+	if parent, err := ProcessStartTime(os.Getppid()); err != nil || parent > startTime {
+		t.Errorf("ProcessStartTime() of the parent = %d, %v, want at most %d", parent, err, startTime)
+	}
+}
+
+func TestRefreshStatus(t *testing.T) {
+	self := &State{Status: StatusCreated}
+	self.SetPid(os.Getpid())
+
+	tests := []struct {
+		name     string
+		state    State
+		expected string
+	}{
+		{"alive", *self, StatusCreated},
+		{"no start time recorded", State{Status: StatusRunning, Pid: os.Getpid()}, StatusRunning},
+		{"reused pid", State{Status: StatusRunning, Pid: os.Getpid(), StartTime: self.StartTime + 1}, StatusStopped},
+		{"no pid", State{Status: StatusCreated}, StatusStopped},
+		{"stopped", State{Status: StatusStopped, Pid: os.Getpid()}, StatusStopped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.state.RefreshStatus()
+			if tt.state.Status != tt.expected {
+				t.Errorf("RefreshStatus() status = %s, want %s", tt.state.Status, tt.expected)
+			}
+		})
+	}
+}